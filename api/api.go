@@ -1,12 +1,24 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/gomeeseeks/meeseeks-box/jobs"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	"github.com/gomeeseeks/meeseeks-box/tokens"
 )
 
@@ -29,30 +41,79 @@ type Listener struct {
 	messageCh chan message.Message
 }
 
-func (l Listener) sendMessage(token tokens.Token, message string) {
-	channelID, err := l.metadata.ParseChannelLink(token.ChannelLink)
+func (l Listener) sendMessage(token tokens.Token, p Payload) (*jobTracker, error) {
+	channelID, userID, err := l.parseLinks(token)
 	if err != nil {
-		logrus.Errorf("Failed to parse channel link %s: %s. Dropping message!", token.ChannelLink, err)
-		return
+		logrus.Errorf("%s. Dropping message!", err)
+		return nil, err
 		// TODO: this error should go to the administration channel
 	}
-
-	userID, err := l.metadata.ParseUserLink(token.UserLink)
-	if err != nil {
-		logrus.Errorf("Failed to parse user link %s: %s. Dropping message!", token.UserLink, err)
-		return
-		// TODO: this error should go to the administration channel
+	if p.Reply == "" {
+		p.Reply = token.ReplyMode
+	}
+	if p.Reply == request.ReplyToCallback {
+		p.callbackURL = token.CallbackURL
 	}
+	return l.send(channelID, userID, token.Text, p), nil
+}
 
+// send sends the message to the pipeline as sent by the user in the channel
+func (l Listener) send(channelID, userID, text string, p Payload) *jobTracker {
 	m := apiMessage{
 		channelID:      channelID,
 		userID:         userID,
-		text:           token.Text,
+		text:           text,
 		metadata:       l.metadata,
-		messagePayload: message,
+		messagePayload: p.message,
+		args:           p.Args,
+		env:            p.Env,
+		replyMode:      p.Reply,
+		jobTracker:     newJobTracker(p.callbackURL),
 	}
-	logrus.Debugf("Sending API message %#v to messages channel", m)
+	logrus.Debugf("Sending API message from %s in %s running %s with env %s to messages channel",
+		userID, channelID, strings.SplitN(text, " ", 2)[0], request.EnvNames(p.Env))
 	l.messageCh <- m
+	return m.jobTracker
+}
+
+// parseLinks returns the channel and user IDs the token is bound to
+func (l Listener) parseLinks(token tokens.Token) (string, string, error) {
+	channelID, err := l.metadata.ParseChannelLink(token.ChannelLink)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse channel link %s: %s", token.ChannelLink, err)
+	}
+	userID, err := l.metadata.ParseUserLink(token.UserLink)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse user link %s: %s", token.UserLink, err)
+	}
+	return channelID, userID, nil
+}
+
+// userRequest returns a request from the user the token is bound to
+func (l Listener) userRequest(token tokens.Token) (request.Request, error) {
+	channelID, userID, err := l.parseLinks(token)
+	if err != nil {
+		return request.Request{}, err
+	}
+	return l.requestFrom(userID, channelID), nil
+}
+
+// requestFrom returns a request from the user in the channel
+//
+// The request is an IM only when the channel is, just like the messages posted
+// through the API. The channel is empty for the users authenticated with a
+// client certificate, those requests are flagged as sent from no channel.
+func (l Listener) requestFrom(userID, channelID string) request.Request {
+	return request.Request{
+		Username:    l.metadata.GetUsername(userID),
+		UserID:      userID,
+		UserLink:    l.metadata.GetUserLink(userID),
+		Channel:     l.metadata.GetChannel(channelID),
+		ChannelID:   channelID,
+		ChannelLink: l.metadata.GetChannelLink(channelID),
+		IsIM:        channelID != "" && l.metadata.IsIM(channelID),
+		NoChannel:   channelID == "",
+	}
 }
 
 // ListenMessages listens to messages and sends the matching ones through the channel
@@ -76,26 +137,57 @@ func NewListener(client MetadataClient) Listener {
 	}
 }
 
+// ShutdownTimeout is how long the server waits for the requests in flight to
+// finish when shutting down
+const ShutdownTimeout = 5 * time.Second
+
+// ErrNoToken is returned when a request carries no token
+var ErrNoToken = errors.New("no token")
+
+// ErrUserToken is returned when a token that is bound only to a user, which is
+// meant for the REST endpoints, is used to post a message
+var ErrUserToken = errors.New("token is bound only to a user, posting messages requires a command token")
+
+// ErrNoCallbackURL is returned when a request wants to reply to the callback
+// of a token that has no callback URL
+var ErrNoCallbackURL = errors.New("token has no callback URL to reply to")
+
 // Server is used to provide API access
 type Server struct {
 	listener   Listener
 	httpServer http.Server
+	mux        *http.ServeMux
+	nonces     *nonceCache
+	webhooks   map[string]bool
+
+	socket             *SocketOpts
+	certificates       *certificateReloader
+	certificatesReload time.Duration
+	clientUsers        map[string]string
+	stop               chan bool
 }
 
 // NewServer returns a new API Server that will use the provided metadata client
-func NewServer(client MetadataClient, address string) Server {
-	return Server{
+func NewServer(client MetadataClient, address string) *Server {
+	mux := http.NewServeMux()
+	s := &Server{
 		listener: NewListener(client),
 		httpServer: http.Server{
-			Addr: address,
+			Addr:    address,
+			Handler: mux,
 		},
+		mux:      mux,
+		nonces:   newNonceCache(),
+		webhooks: make(map[string]bool),
+		stop:     make(chan bool),
 	}
+	s.registerRESTHandlers()
+	return s
 }
 
-// ListenAndServe starts listening on the provided address, then serving http requests
-func (s *Server) ListenAndServe(path string) error {
-	http.HandleFunc(path, s.HandlePostToken)
-	return s.httpServer.ListenAndServe()
+// ServeHTTP implements the http.Handler interface serving the REST endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
 }
 
 // GetListener returns the internal messages listener to register with the chat pipeline
@@ -107,29 +199,243 @@ func (s *Server) GetListener() Listener {
 func (s *Server) Shutdown() error {
 	defer s.listener.Shutdown()
 	logrus.Infof("Shutting down API server")
+	close(s.stop)
 
-	return s.httpServer.Shutdown(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return s.httpServer.Shutdown(ctx)
 }
 
-// HandlePostToken handles a request
+// Payload is the JSON body of a request, its args are appended to the text of
+// the token as they are, without being parsed, and env is the environment the
+// command runs with
+//
+// Reply overrides the reply mode of the token for the request.
+type Payload struct {
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+	Wait    bool              `json:"wait"`
+	Timeout string            `json:"timeout"`
+	Reply   string            `json:"reply"`
+
+	// message is the text appended to the text of the token by form requests,
+	// which is parsed along with it
+	message string
+	// callbackURL is where the result is posted when replying to the callback,
+	// which always comes from the token
+	callbackURL string
+}
+
+// parsePayload reads the payload either from a JSON body or from the form
+// values message, wait, timeout and reply
+func parsePayload(r *http.Request) (Payload, error) {
+	p := Payload{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil && err != io.EOF {
+			return p, fmt.Errorf("invalid JSON payload: %s", err)
+		}
+		return p, request.ValidateReplyMode(p.Reply)
+	}
+
+	p.message = r.FormValue("message")
+	if v := r.FormValue("wait"); v != "" {
+		wait, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid wait %s: %s", v, err)
+		}
+		p.Wait = wait
+	}
+	p.Timeout = r.FormValue("timeout")
+	p.Reply = r.FormValue("reply")
+	return p, request.ValidateReplyMode(p.Reply)
+}
+
+// allowedBy checks that the token allows appending the arguments and setting
+// the environment of the payload
+func (p Payload) allowedBy(token tokens.Token) error {
+	if (p.message != "" || len(p.Args) > 0) && !token.AllowArgs {
+		return tokens.ErrArgsNotAllowed
+	}
+	names := make([]string, 0, len(p.Env))
+	for name := range p.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !token.AllowsEnv(name) {
+			return fmt.Errorf("token doesn't allow setting %s", name)
+		}
+	}
+	return nil
+}
+
+// HandlePostToken handles a request, which either carries the token in the
+// TOKEN header or is signed with the secret of the token
+//
+// The request is validated before the use of the token is counted, so the
+// requests that are rejected don't use it up.
 func (s *Server) HandlePostToken(w http.ResponseWriter, r *http.Request) {
-	tokenID := r.Header.Get("TOKEN")
-	if tokenID == "" {
-		http.Error(w, "no token", http.StatusBadRequest)
+	// the body is read before using the token so it's not read from the client
+	// while the token is being used
+	if _, err := readBody(w, r); err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+
+	var p Payload
+	var timeout time.Duration
+	token, err := s.authenticate(w, r, func(token tokens.Token) (err error) {
+		p, timeout, err = acceptPost(r, token)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
 		return
 	}
-	logrus.Debugf("received token %s through API", tokenID) // Add requester info
 
-	token, err := tokens.Get(tokenID)
+	tracker, err := s.listener.sendMessage(token, p)
 	if err != nil {
-		logrus.Debugf("Token %s is unknown", token) // Add requester info
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.replyWithJob(w, tracker, p.Wait, time.After(timeout))
+}
+
+// acceptPost parses the payload of the request and checks that the token allows
+// it, it returns the payload along with how long to wait for the job
+func acceptPost(r *http.Request, token tokens.Token) (Payload, time.Duration, error) {
+	if token.Text == "" {
+		return Payload{}, 0, rejected(http.StatusForbidden, ErrUserToken)
+	}
+
+	p, err := parsePayload(r)
+	if err != nil {
+		return p, 0, rejected(http.StatusBadRequest, err)
+	}
+	if err = p.allowedBy(token); err != nil {
+		return p, 0, rejected(http.StatusForbidden, err)
+	}
+	if p.Reply == request.ReplyToCallback && token.CallbackURL == "" {
+		return p, 0, rejected(http.StatusBadRequest, ErrNoCallbackURL)
+	}
+	timeout := DefaultWaitTimeout
+	if p.Timeout != "" {
+		if timeout, err = time.ParseDuration(p.Timeout); err != nil || timeout <= 0 {
+			return p, 0, rejected(http.StatusBadRequest, fmt.Errorf("invalid timeout %s", p.Timeout))
+		}
+		if timeout > MaxWaitTimeout {
+			return p, 0, rejected(http.StatusBadRequest,
+				fmt.Errorf("invalid timeout %s: it can't be longer than %s", p.Timeout, MaxWaitTimeout))
+		}
+	}
+	return p, timeout, nil
+}
+
+// rejection is an error that rejects a request with the http status
+type rejection struct {
+	status int
+	err    error
+}
+
+func rejected(status int, err error) error {
+	return rejection{status: status, err: err}
+}
+
+func (r rejection) Error() string {
+	return r.err.Error()
+}
+
+// authenticate uses the token of the request, either from the TOKEN header or
+// from the signature headers, if the accept function doesn't reject it
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, accept func(tokens.Token) error) (tokens.Token, error) {
+	var token tokens.Token
+	var err error
+	if r.Header.Get(SignatureHeader) != "" {
+		logrus.Debugf("received signed request for token %s through API", r.Header.Get(TokenPrefixHeader))
+		token, err = s.useSigned(w, r, accept)
+	} else {
+		tokenID := r.Header.Get("TOKEN")
+		if tokenID == "" {
+			return token, ErrNoToken
+		}
+		logrus.Debugf("received token %s through API", tokenID) // Add requester info
+		token, err = tokens.Use(tokenID, remoteIP(r), accept)
+	}
+	if err != nil {
+		logrus.Debugf("Token can't be used from %s: %s", r.RemoteAddr, err)
+	}
+	return token, err
+}
+
+// replyWithJob replies with the job started by the message, waiting for it to
+// finish when requested, until the timeout
+func (s *Server) replyWithJob(w http.ResponseWriter, tracker *jobTracker, wait bool, timeout <-chan time.Time) {
+	var job jobs.Job
+	select {
+	case err := <-tracker.rejected:
+		writeJSON(w, http.StatusUnprocessableEntity, JobResult{Status: RejectedStatus, Error: err.Error()})
+		return
+	case job = <-tracker.started:
+	case <-timeout:
+		http.Error(w, "timed out waiting for the job to start", http.StatusGatewayTimeout)
+		return
+	}
+
+	if job.ID != 0 {
+		w.Header().Set("Location", fmt.Sprintf("%s/%d", JobsPath, job.ID))
+	}
+	if !wait {
+		writeJSON(w, http.StatusAccepted, newJobResult(job, "", nil))
 		return
 	}
 
-	s.listener.sendMessage(token, r.FormValue("message"))
+	select {
+	case f := <-tracker.finished:
+		writeJSON(w, http.StatusOK, newJobResult(f.job, f.output, f.err))
+	case <-timeout:
+		writeJSON(w, http.StatusAccepted, newJobResult(job, "", nil))
+	}
+}
 
-	w.WriteHeader(http.StatusAccepted)
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Failed to write API response: %s", err)
+	}
+}
+
+// tokenErrorStatus returns the http status for each reason a token can't be used
+func tokenErrorStatus(err error) int {
+	if r, ok := err.(rejection); ok {
+		return r.status
+	}
+	switch err {
+	case tokens.ErrTokenNotFound, tokens.ErrSignatureRequired, tokens.ErrTokenNotSigned,
+		ErrInvalidSignature, ErrTimestampSkewed, ErrReplayedRequest:
+		return http.StatusUnauthorized
+	case ErrNoToken, ErrMissingSignatureHeaders, ErrInvalidTimestamp:
+		return http.StatusBadRequest
+	case tokens.ErrTokenExpired:
+		return http.StatusGone
+	case tokens.ErrTokenExhausted, ErrTooManyNonces:
+		return http.StatusTooManyRequests
+	case tokens.ErrSourceNotAllowed:
+		return http.StatusForbidden
+	case ErrPayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// remoteIP returns the IP address the request comes from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 // Message a chat message
@@ -138,7 +444,11 @@ type apiMessage struct {
 	channelID      string
 	text           string
 	messagePayload string
+	args           []string
+	env            map[string]string
+	replyMode      string
 	metadata       MetadataClient
+	*jobTracker
 }
 
 // GetText returns the message text
@@ -150,6 +460,22 @@ func (m apiMessage) GetText() string {
 	return text
 }
 
+// GetArgs implements the message.StructuredMessage interface returning the
+// arguments of a JSON payload
+func (m apiMessage) GetArgs() []string {
+	return m.args
+}
+
+// GetEnv implements the message.StructuredMessage interface
+func (m apiMessage) GetEnv() map[string]string {
+	return m.env
+}
+
+// GetReplyMode implements the message.RoutedMessage interface
+func (m apiMessage) GetReplyMode() string {
+	return m.replyMode
+}
+
 // GetUsernameID returns the user id formatted for using in a slack message
 func (m apiMessage) GetUserID() string {
 	return m.userID
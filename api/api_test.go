@@ -1,15 +1,25 @@
 package api_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
 	"github.com/gomeeseeks/meeseeks-box/api"
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	"github.com/gomeeseeks/meeseeks-box/tokens"
 
 	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
@@ -69,6 +79,44 @@ func TestAPIServer(t *testing.T) {
 			UserLink:    "someoneLink",
 			ChannelLink: "generalLink",
 			Text:        "echo something",
+			AllowArgs:   true,
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		noArgs, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		expired, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+			ExpiresOn:   time.Now().Add(-time.Minute),
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		once, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo once",
+			MaxUses:     1,
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		remote, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:     "someoneLink",
+			ChannelLink:  "generalLink",
+			Text:         "echo something",
+			AllowedCIDRs: []string{"10.0.0.0/8"},
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		user, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
 		})
 		stubs.Must(t, "failed to create the token", err)
 
@@ -119,6 +167,7 @@ func TestAPIServer(t *testing.T) {
 				assertHttpStatus(http.StatusAccepted),
 				func(t *testing.T, ch chan message.Message) {
 					msg := <-ch
+					startJob(msg)
 					stubs.AssertEquals(t, "echo something", msg.GetText())
 					stubs.AssertEquals(t, "general", msg.GetChannelID())
 					stubs.AssertEquals(t, "name: general", msg.GetChannel())
@@ -136,9 +185,63 @@ func TestAPIServer(t *testing.T) {
 				assertHttpStatus(http.StatusAccepted),
 				func(t *testing.T, ch chan message.Message) {
 					msg := <-ch
+					startJob(msg)
 					stubs.AssertEquals(t, "echo something with arguments that will be attached", msg.GetText())
 				},
 			},
+			{
+				"payload with a token that doesn't allow args",
+				noArgs,
+				"with arguments that will be refused",
+				assertHttpStatus(http.StatusForbidden),
+				assertNothing,
+			},
+			{
+				"expired token",
+				expired,
+				"",
+				assertHttpStatus(http.StatusGone),
+				assertNothing,
+			},
+			{
+				"single use token with a refused payload",
+				once,
+				"with arguments that don't use up the token",
+				assertHttpStatus(http.StatusForbidden),
+				assertNothing,
+			},
+			{
+				"single use token",
+				once,
+				"",
+				assertHttpStatus(http.StatusAccepted),
+				func(t *testing.T, ch chan message.Message) {
+					msg := <-ch
+					startJob(msg)
+					stubs.AssertEquals(t, "echo once", msg.GetText())
+				},
+			},
+			{
+				"single use token used twice",
+				once,
+				"",
+				assertHttpStatus(http.StatusTooManyRequests),
+				assertNothing,
+			},
+			{
+				"token used from a not allowed address",
+				remote,
+				"",
+				assertHttpStatus(http.StatusForbidden),
+				assertNothing,
+			},
+			{
+				"user token",
+				user,
+				"echo something",
+				assertHttpStatus(http.StatusForbidden),
+				assertNothing,
+			},
 		}
 		for _, tc := range tt {
 			t.Run(tc.name, func(t *testing.T) {
@@ -154,13 +257,573 @@ func TestAPIServer(t *testing.T) {
 				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 				req.Header.Add("TOKEN", tc.reqToken)
 
-				resp, err := testSrv.Client().Do(req)
-				stubs.Must(t, "failed to do request", err)
+				respCh := do(testSrv, req)
+				tc.assertMessage(t, ch)
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
 
 				tc.assertStatus(t, resp.Status)
-				tc.assertMessage(t, ch)
 			})
 		}
 
 	}))
 }
+
+func TestAPIServerSignedRequests(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		tk, secret, err := tokens.CreateSigned(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo signed",
+			AllowArgs:   true,
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		unsigned, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo unsigned",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		now := fmt.Sprintf("%d", time.Now().Unix())
+		tt := []struct {
+			name      string
+			prefix    string
+			secret    string
+			timestamp string
+			nonce     string
+			token     string
+			tamper    bool
+			query     string
+			uri       string
+			body      string
+			expected  int
+		}{
+			{name: "valid signature", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "1", expected: http.StatusAccepted},
+			{name: "replayed nonce", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "1", expected: http.StatusUnauthorized},
+			{name: "tampered body", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "2", tamper: true, expected: http.StatusUnauthorized},
+			{name: "wrong secret", prefix: tk[:tokens.PrefixLength], secret: "wrong", timestamp: now, nonce: "3", expected: http.StatusUnauthorized},
+			{name: "skewed timestamp", prefix: tk[:tokens.PrefixLength], secret: secret,
+				timestamp: fmt.Sprintf("%d", time.Now().Add(-10*time.Minute).Unix()), nonce: "4", expected: http.StatusUnauthorized},
+			{name: "invalid timestamp", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: "yesterday", nonce: "5", expected: http.StatusBadRequest},
+			{name: "missing nonce", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, expected: http.StatusBadRequest},
+			{name: "unsigned token", prefix: unsigned[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "6", expected: http.StatusUnauthorized},
+			{name: "signed token without signature", token: tk, expected: http.StatusUnauthorized},
+			{name: "signed query", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "7",
+				query: "?via=signed", uri: "/message?via=signed", expected: http.StatusAccepted},
+			{name: "tampered query", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "8",
+				query: "?via=tampered", expected: http.StatusUnauthorized},
+			{name: "too large body", prefix: tk[:tokens.PrefixLength], secret: secret, timestamp: now, nonce: "9",
+				body: strings.Repeat("x", api.MaxPayload+1), expected: http.StatusRequestEntityTooLarge},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				body := url.Values{"message": []string{"with args"}}.Encode()
+				if tc.body != "" {
+					body = tc.body
+				}
+				uri := "/message"
+				if tc.uri != "" {
+					uri = tc.uri
+				}
+				req, err := http.NewRequest("POST", testSrv.URL+"/message"+tc.query, strings.NewReader(body))
+				stubs.Must(t, "Could not create request", err)
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+				if tc.token != "" {
+					req.Header.Set("TOKEN", tc.token)
+				} else {
+					if tc.tamper {
+						body += "+and+more"
+					}
+					req.Header.Set(api.TokenPrefixHeader, tc.prefix)
+					req.Header.Set(api.TimestampHeader, tc.timestamp)
+					req.Header.Set(api.NonceHeader, tc.nonce)
+					req.Header.Set(api.SignatureHeader, api.Sign(tc.secret, "POST", uri, tc.timestamp, tc.nonce, []byte(body)))
+				}
+
+				respCh := do(testSrv, req)
+				if tc.expected == http.StatusAccepted {
+					msg := <-ch
+					startJob(msg)
+					stubs.AssertEquals(t, "echo signed with args", msg.GetText())
+				}
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
+				stubs.AssertEquals(t, tc.expected, resp.StatusCode)
+			})
+		}
+	}))
+}
+
+func TestAPIServerSignedRequestsPerToken(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		newToken := func() (string, string) {
+			tk, secret, err := tokens.CreateSigned(tokens.NewTokenRequest{
+				UserLink:    "someoneLink",
+				ChannelLink: "generalLink",
+				Text:        "echo signed",
+			})
+			stubs.Must(t, "failed to create the token", err)
+			return tk[:tokens.PrefixLength], secret
+		}
+		busy, busySecret := newToken()
+		idle, idleSecret := newToken()
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		// the token doesn't allow args, so the requests are refused without
+		// being used, but their nonces are remembered anyway
+		post := func(prefix, secret, nonce string) int {
+			body := url.Values{"message": []string{"with args"}}.Encode()
+			req, err := http.NewRequest("POST", testSrv.URL+"/message", strings.NewReader(body))
+			stubs.Must(t, "Could not create request", err)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			now := fmt.Sprintf("%d", time.Now().Unix())
+			req.Header.Set(api.TokenPrefixHeader, prefix)
+			req.Header.Set(api.TimestampHeader, now)
+			req.Header.Set(api.NonceHeader, nonce)
+			req.Header.Set(api.SignatureHeader, api.Sign(secret, "POST", "/message", now, nonce, []byte(body)))
+
+			resp, err := testSrv.Client().Do(req)
+			stubs.Must(t, "failed to do request", err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		for i := 0; i < api.MaxNonces; i++ {
+			stubs.AssertEquals(t, http.StatusForbidden, post(busy, busySecret, fmt.Sprintf("%d", i)))
+		}
+		stubs.AssertEquals(t, http.StatusTooManyRequests, post(busy, busySecret, "one too many"))
+		stubs.AssertEquals(t, http.StatusForbidden, post(idle, idleSecret, "0"))
+	}))
+}
+
+func TestAPIServerReplies(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		tk, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+		job := jobs.Job{ID: 7, Status: jobs.RunningStatus, StartTime: start}
+		finished := jobs.Job{ID: 7, Status: jobs.FailedStatus, StartTime: start, EndTime: start.Add(time.Minute)}
+
+		tt := []struct {
+			name             string
+			query            string
+			pipeline         func(meeseeks.JobObserver)
+			expectedStatus   int
+			expectedLocation string
+			expectedBody     string
+		}{
+			{
+				name:             "not waiting",
+				pipeline:         func(o meeseeks.JobObserver) { o.JobStarted(job) },
+				expectedStatus:   http.StatusAccepted,
+				expectedLocation: "/jobs/7",
+				expectedBody:     `{"job_id":7,"status":"Running","start_time":"2018-01-01T10:00:00Z"}`,
+			},
+			{
+				name:  "waiting",
+				query: "?wait=true",
+				pipeline: func(o meeseeks.JobObserver) {
+					o.JobStarted(job)
+					o.JobFinished(finished, "some output", fmt.Errorf("exit status 1"))
+				},
+				expectedStatus:   http.StatusOK,
+				expectedLocation: "/jobs/7",
+				expectedBody: `{"job_id":7,"status":"Failed","output":"some output","error":"exit status 1",` +
+					`"start_time":"2018-01-01T10:00:00Z","end_time":"2018-01-01T10:01:00Z","duration":"1m0s"}`,
+			},
+			{
+				name:             "waiting past the timeout",
+				query:            "?wait=true&timeout=10ms",
+				pipeline:         func(o meeseeks.JobObserver) { o.JobStarted(job) },
+				expectedStatus:   http.StatusAccepted,
+				expectedLocation: "/jobs/7",
+				expectedBody:     `{"job_id":7,"status":"Running","start_time":"2018-01-01T10:00:00Z"}`,
+			},
+			{
+				name:           "rejected",
+				query:          "?wait=true",
+				pipeline:       func(o meeseeks.JobObserver) { o.JobRejected(fmt.Errorf("not allowed")) },
+				expectedStatus: http.StatusUnprocessableEntity,
+				expectedBody:   `{"job_id":0,"status":"Rejected","error":"not allowed"}`,
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", testSrv.URL+tc.query, nil)
+				stubs.Must(t, "Could not create request", err)
+				req.Header.Add("TOKEN", tk)
+
+				respCh := do(testSrv, req)
+				tc.pipeline((<-ch).(meeseeks.JobObserver))
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
+
+				body, err := ioutil.ReadAll(resp.Body)
+				stubs.Must(t, "failed to read the response", err)
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				stubs.AssertEquals(t, tc.expectedLocation, resp.Header.Get("Location"))
+				stubs.AssertEquals(t, tc.expectedBody, strings.TrimSpace(string(body)))
+			})
+		}
+	}))
+}
+
+func TestAPIServerJSONPayload(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		tk, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+			AllowArgs:   true,
+			AllowedEnv:  []string{"VERSION"},
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		noArgs, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		tt := []struct {
+			name            string
+			token           string
+			body            string
+			expectedStatus  int
+			expectedError   string
+			expectedRequest request.Request
+		}{
+			{
+				name:           "args are not parsed",
+				token:          tk,
+				body:           `{"args":["it's", "a \"quoted\" arg", "--flag=a b"],"env":{"VERSION":"1.0"}}`,
+				expectedStatus: http.StatusAccepted,
+				expectedRequest: request.Request{
+					Command: "echo",
+					Args:    []string{"something", "it's", `a "quoted" arg`, "--flag=a b"},
+					Env:     map[string]string{"VERSION": "1.0"},
+				},
+			},
+			{
+				name:           "empty body",
+				token:          noArgs,
+				expectedStatus: http.StatusAccepted,
+				expectedRequest: request.Request{
+					Command: "echo",
+					Args:    []string{"something"},
+				},
+			},
+			{
+				name:           "args with a token that doesn't allow them",
+				token:          noArgs,
+				body:           `{"args":["more"]}`,
+				expectedStatus: http.StatusForbidden,
+				expectedError:  "token doesn't allow appending arguments",
+			},
+			{
+				name:           "env that is not allowed",
+				token:          tk,
+				body:           `{"env":{"VERSION":"1.0","PATH":"/tmp"}}`,
+				expectedStatus: http.StatusForbidden,
+				expectedError:  "token doesn't allow setting PATH",
+			},
+			{
+				name:           "invalid JSON",
+				token:          tk,
+				body:           `{"args":"not a list"}`,
+				expectedStatus: http.StatusBadRequest,
+				expectedError:  "invalid JSON payload: json: cannot unmarshal string into Go struct field Payload.args of type []string",
+			},
+			{
+				name:           "timeout over the max",
+				token:          tk,
+				body:           `{"wait":true,"timeout":"2h"}`,
+				expectedStatus: http.StatusBadRequest,
+				expectedError:  "invalid timeout 2h: it can't be longer than 10m0s",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", testSrv.URL, strings.NewReader(tc.body))
+				stubs.Must(t, "Could not create request", err)
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				req.Header.Set("TOKEN", tc.token)
+
+				respCh := do(testSrv, req)
+				if tc.expectedStatus == http.StatusAccepted {
+					msg := <-ch
+					startJob(msg)
+					r, err := request.FromMessage(msg)
+					stubs.Must(t, "failed to build the request", err)
+					stubs.AssertEquals(t, tc.expectedRequest.Command, r.Command)
+					stubs.AssertEquals(t, tc.expectedRequest.Args, r.Args)
+					stubs.AssertEquals(t, tc.expectedRequest.Env, r.Env)
+				}
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				if tc.expectedError != "" {
+					body, err := ioutil.ReadAll(resp.Body)
+					stubs.Must(t, "failed to read the response", err)
+					stubs.AssertEquals(t, tc.expectedError, strings.TrimSpace(string(body)))
+				}
+			})
+		}
+	}))
+}
+
+func TestAPIServerDoesNotLogEnv(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		tk, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+			AllowedEnv:  []string{"PASSWORD"},
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		out := &bytes.Buffer{}
+		logrus.SetOutput(out)
+		logrus.SetLevel(logrus.DebugLevel)
+		defer logrus.SetOutput(os.Stderr)
+		defer logrus.SetLevel(logrus.InfoLevel)
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		req, err := http.NewRequest("POST", testSrv.URL, strings.NewReader(`{"env":{"PASSWORD":"hunter2"}}`))
+		stubs.Must(t, "Could not create request", err)
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("TOKEN", tk)
+
+		respCh := do(testSrv, req)
+		msg := <-ch
+		r, err := request.FromMessage(msg)
+		stubs.Must(t, "failed to build the request", err)
+		_, err = jobs.Create(r)
+		stubs.Must(t, "failed to create the job", err)
+		startJob(msg)
+		resp := <-respCh
+		stubs.Must(t, "failed to do request", resp.err)
+		stubs.AssertEquals(t, http.StatusAccepted, resp.StatusCode)
+
+		logs := out.String()
+		stubs.AssertMatches(t, `Sending API message from someone in general running echo with env \[PASSWORD\]`, logs)
+		stubs.AssertMatches(t, `Creating job 1 running echo with env \[PASSWORD\]`, logs)
+		if strings.Contains(logs, "hunter2") {
+			t.Fatalf("env value was logged:\n%s", logs)
+		}
+	}))
+}
+
+func TestAPIServerReplyModes(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		callbacks := make(chan api.JobResult, 1)
+		callbackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := api.JobResult{}
+			stubs.Must(t, "failed to decode the callback", json.NewDecoder(r.Body).Decode(&result))
+			callbacks <- result
+		}))
+		defer callbackSrv.Close()
+
+		withCallback, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo nightly",
+			ReplyMode:   request.ReplyToCallback,
+			CallbackURL: callbackSrv.URL,
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		plain, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+			Text:        "echo something",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(http.HandlerFunc(s.HandlePostToken))
+		defer testSrv.Close()
+
+		tt := []struct {
+			name             string
+			token            string
+			body             string
+			expectedStatus   int
+			expectedError    string
+			expectedMode     string
+			expectedCallback bool
+		}{
+			{
+				name:             "token that replies to the callback",
+				token:            withCallback,
+				expectedStatus:   http.StatusAccepted,
+				expectedMode:     request.ReplyToCallback,
+				expectedCallback: true,
+			},
+			{
+				name:           "request that overrides the token mode",
+				token:          withCallback,
+				body:           `{"reply":"channel"}`,
+				expectedStatus: http.StatusAccepted,
+				expectedMode:   request.ReplyToChannel,
+			},
+			{
+				name:           "token that replies to the channel",
+				token:          plain,
+				expectedStatus: http.StatusAccepted,
+			},
+			{
+				name:           "request that replies in an IM",
+				token:          plain,
+				body:           `{"reply":"im"}`,
+				expectedStatus: http.StatusAccepted,
+				expectedMode:   request.ReplyToIM,
+			},
+			{
+				name:           "request that doesn't reply",
+				token:          plain,
+				body:           `{"reply":"silent"}`,
+				expectedStatus: http.StatusAccepted,
+				expectedMode:   request.ReplySilently,
+			},
+			{
+				name:           "callback of a token that has none",
+				token:          plain,
+				body:           `{"reply":"callback"}`,
+				expectedStatus: http.StatusBadRequest,
+				expectedError:  "token has no callback URL to reply to",
+			},
+			{
+				name:           "unknown mode",
+				token:          plain,
+				body:           `{"reply":"email"}`,
+				expectedStatus: http.StatusBadRequest,
+				expectedError:  `invalid reply mode "email", it should be one of channel, im, callback or silent`,
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest("POST", testSrv.URL, strings.NewReader(tc.body))
+				stubs.Must(t, "Could not create request", err)
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("TOKEN", tc.token)
+
+				respCh := do(testSrv, req)
+				if tc.expectedStatus == http.StatusAccepted {
+					msg := <-ch
+					startJob(msg)
+					stubs.AssertEquals(t, tc.expectedMode, request.ReplyModeOf(msg))
+					msg.(meeseeks.JobObserver).JobFinished(jobs.Job{ID: 1, Status: jobs.SuccessStatus}, "nightly\n", nil)
+				}
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				if tc.expectedError != "" {
+					body, err := ioutil.ReadAll(resp.Body)
+					stubs.Must(t, "failed to read the response", err)
+					stubs.AssertEquals(t, tc.expectedError, strings.TrimSpace(string(body)))
+				}
+				if tc.expectedCallback {
+					result := <-callbacks
+					stubs.AssertEquals(t, uint64(1), result.JobID)
+					stubs.AssertEquals(t, jobs.SuccessStatus, result.Status)
+					stubs.AssertEquals(t, "nightly\n", result.Output)
+				}
+			})
+		}
+
+		select {
+		case result := <-callbacks:
+			t.Fatalf("unexpected callback %#v", result)
+		default:
+		}
+	}))
+}
+
+type response struct {
+	*http.Response
+	err error
+}
+
+// do sends the request in the background, so the test can play the pipeline
+// while the server waits for it
+func do(srv *httptest.Server, req *http.Request) chan response {
+	ch := make(chan response, 1)
+	go func() {
+		resp, err := srv.Client().Do(req)
+		ch <- response{Response: resp, err: err}
+	}()
+	return ch
+}
+
+// startJob starts a job for the message as the pipeline does
+func startJob(msg message.Message) {
+	msg.(meeseeks.JobObserver).JobStarted(jobs.Job{ID: 1, Status: jobs.RunningStatus})
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+)
+
+// JobsPath is the path in which the jobs started through the API are located
+const JobsPath = "/jobs"
+
+// DefaultWaitTimeout is how long a request waits for the job to finish when no
+// timeout is passed, after which it replies as if it wasn't waiting
+const DefaultWaitTimeout = time.Minute
+
+// MaxWaitTimeout is the longest a request can wait for the job to finish, so
+// requests can't hold connections open indefinitely
+const MaxWaitTimeout = 10 * time.Minute
+
+// RejectedStatus is the status replied when the message doesn't start a job
+const RejectedStatus = "Rejected"
+
+// CallbackTimeout is how long posting a result to a callback URL can take
+const CallbackTimeout = 10 * time.Second
+
+// JobResult is the JSON reply to the API requests
+type JobResult struct {
+	JobID     uint64     `json:"job_id"`
+	Status    string     `json:"status"`
+	Output    string     `json:"output,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+}
+
+func newJobResult(job jobs.Job, output string, err error) JobResult {
+	r := JobResult{
+		JobID:     job.ID,
+		Status:    job.Status,
+		Output:    output,
+		StartTime: &job.StartTime,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if !job.EndTime.IsZero() {
+		r.EndTime = &job.EndTime
+		r.Duration = job.EndTime.Sub(job.StartTime).String()
+	}
+	return r
+}
+
+// jobTracker implements the meeseeks.JobObserver interface to follow what
+// happens with the job started by an API message, it also posts the result to
+// the callback URL when there is one
+type jobTracker struct {
+	rejected chan error
+	started  chan jobs.Job
+	finished chan finishedJob
+	callback string
+}
+
+type finishedJob struct {
+	job    jobs.Job
+	output string
+	err    error
+}
+
+// newJobTracker creates a tracker whose channels are buffered so the pipeline
+// never blocks when the request is not waiting anymore
+func newJobTracker(callback string) *jobTracker {
+	return &jobTracker{
+		rejected: make(chan error, 1),
+		started:  make(chan jobs.Job, 1),
+		finished: make(chan finishedJob, 1),
+		callback: callback,
+	}
+}
+
+// JobRejected implements the meeseeks.JobObserver interface
+func (t *jobTracker) JobRejected(err error) {
+	t.rejected <- err
+	t.post(JobResult{Status: RejectedStatus, Error: err.Error()})
+}
+
+// JobStarted implements the meeseeks.JobObserver interface
+func (t *jobTracker) JobStarted(job jobs.Job) {
+	t.started <- job
+}
+
+// JobFinished implements the meeseeks.JobObserver interface
+func (t *jobTracker) JobFinished(job jobs.Job, output string, err error) {
+	t.finished <- finishedJob{job: job, output: output, err: err}
+	t.post(newJobResult(job, output, err))
+}
+
+// post posts the result to the callback URL in the background, so a slow
+// receiver doesn't hold the pipeline
+func (t *jobTracker) post(result JobResult) {
+	if t.callback == "" {
+		return
+	}
+	go func() {
+		if err := postResult(t.callback, result); err != nil {
+			logrus.Errorf("Failed to post job %d result to its callback: %s", result.JobID, err)
+		}
+	}()
+}
+
+func postResult(url string, result JobResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("could not marshal result: %s", err)
+	}
+	client := http.Client{Timeout: CallbackTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback replied with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+)
+
+// DefaultCertificateReload is how often the certificate files are checked for
+// changes when no reload interval is configured
+const DefaultCertificateReload = time.Minute
+
+// DefaultSocketMode is the file mode of the unix socket when none is configured
+const DefaultSocketMode os.FileMode = 0660
+
+// ErrNothingToListen is returned when the server has neither an address nor a
+// socket to listen on
+var ErrNothingToListen = errors.New("no address or socket to listen on")
+
+// TLSOpts configure the server to only accept TLS connections on its address
+//
+// When a client CA is configured the client certificates signed by it are
+// verified, and the ones whose subject common name is in ClientUsers
+// authenticate the REST requests as the mapped user, without a token. Clients
+// can't connect without a certificate when RequireClientCert is set.
+type TLSOpts struct {
+	Cert              string
+	Key               string
+	ClientCA          string
+	RequireClientCert bool
+	ClientUsers       map[string]string
+	Reload            time.Duration
+}
+
+// SocketOpts configure the server to also listen on a unix domain socket,
+// which is created with the file mode
+type SocketOpts struct {
+	Path string
+	Mode os.FileMode
+}
+
+// ListenOpts configure how the server listens besides its address, which can
+// be empty to only listen on the socket
+type ListenOpts struct {
+	TLS    *TLSOpts
+	Socket *SocketOpts
+}
+
+// Configure sets how the server listens, it loads the certificates and
+// resolves the users of the client certificates, so it must be called before
+// ListenAndServe
+func (s *Server) Configure(opts ListenOpts) error {
+	if opts.Socket != nil {
+		if opts.Socket.Path == "" {
+			return fmt.Errorf("invalid socket: no path to listen on")
+		}
+		s.socket = opts.Socket
+	}
+	if opts.TLS == nil {
+		return nil
+	}
+
+	t := opts.TLS
+	if t.Cert == "" || t.Key == "" {
+		return fmt.Errorf("invalid TLS configuration: a cert and a key are required")
+	}
+	certificates, err := newCertificateReloader(t.Cert, t.Key)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %s", err)
+	}
+	config := &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+	}
+
+	if t.ClientCA == "" {
+		if t.RequireClientCert || len(t.ClientUsers) > 0 {
+			return fmt.Errorf("invalid TLS configuration: client certificates require a client CA")
+		}
+	} else {
+		pem, err := ioutil.ReadFile(t.ClientCA)
+		if err != nil {
+			return fmt.Errorf("invalid TLS configuration: could not read client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("invalid TLS configuration: no certificates found in client CA %s", t.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	clientUsers := make(map[string]string, len(t.ClientUsers))
+	for subject, user := range t.ClientUsers {
+		userID, err := auth.ResolveUser(user)
+		if err != nil {
+			return fmt.Errorf("invalid TLS configuration: client %s: %s", subject, err)
+		}
+		clientUsers[subject] = userID
+	}
+
+	reload := t.Reload
+	if reload <= 0 {
+		reload = DefaultCertificateReload
+	}
+	s.httpServer.TLSConfig = config
+	s.certificates = certificates
+	s.certificatesReload = reload
+	s.clientUsers = clientUsers
+	return nil
+}
+
+// ListenAndServe starts listening on the provided address and socket, then
+// serving http requests, messages are posted to the path and the REST
+// endpoints are served along with it
+//
+// The address is served over TLS when it's configured, the socket is always
+// served in plain http as it's protected by its file mode.
+func (s *Server) ListenAndServe(path string) error {
+	s.mux.HandleFunc(path, s.HandlePostToken)
+
+	errs := make(chan error, 2)
+	listening := 0
+	if s.socket != nil {
+		l, err := listenSocket(*s.socket)
+		if err != nil {
+			return err
+		}
+		listening++
+		go func() { errs <- s.httpServer.Serve(l) }()
+	}
+	if s.httpServer.Addr != "" {
+		l, err := net.Listen("tcp", s.httpServer.Addr)
+		if err != nil {
+			return err
+		}
+		listening++
+		if s.certificates != nil {
+			go s.certificates.watch(s.certificatesReload, s.stop)
+			go func() { errs <- s.httpServer.ServeTLS(l, "", "") }()
+		} else {
+			go func() { errs <- s.httpServer.Serve(l) }()
+		}
+	}
+	if listening == 0 {
+		return ErrNothingToListen
+	}
+	return <-errs
+}
+
+// listenSocket listens on the unix socket, replacing the one left behind by a
+// previous run, anything else in its path is left alone
+//
+// The socket is created in a private directory where it gets its mode before
+// it's moved into its path, so it can't be connected to with the mode it's
+// created with.
+func listenSocket(opts SocketOpts) (net.Listener, error) {
+	info, err := os.Lstat(opts.Path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("could not check previous socket %s: %s", opts.Path, err)
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("could not listen on %s: it exists and it's not a socket", opts.Path)
+	default:
+		if err = os.Remove(opts.Path); err != nil {
+			return nil, fmt.Errorf("could not remove previous socket %s: %s", opts.Path, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(opts.Path), ".meeseeks-socket")
+	if err != nil {
+		return nil, fmt.Errorf("could not create socket %s: %s", opts.Path, err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err = os.Chmod(private, mode); err == nil {
+		err = os.Rename(private, opts.Path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("could not create socket %s: %s", opts.Path, err)
+	}
+	return socketListener{Listener: l, path: opts.Path}, nil
+}
+
+// socketListener removes the socket when it's closed, as it was moved from
+// the path it was created on
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+func (l socketListener) Close() error {
+	err := l.Listener.Close()
+	if rmErr := os.Remove(l.path); err == nil && rmErr != nil && !os.IsNotExist(rmErr) {
+		err = rmErr
+	}
+	return err
+}
+
+// certificateUser returns the user mapped to the subject of the verified
+// client certificate of the request
+func (s *Server) certificateUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	userID, ok := s.clientUsers[r.TLS.PeerCertificates[0].Subject.CommonName]
+	return userID, ok
+}
+
+// certificateReloader serves the certificate loaded from its files, which are
+// loaded again when they change
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	m           sync.RWMutex
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate when its files changed since they were last
+// loaded, it returns whether they did
+func (c *certificateReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate: %s", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate key: %s", err)
+	}
+
+	c.m.RLock()
+	changed := !certInfo.ModTime().Equal(c.certModTime) || !keyInfo.ModTime().Equal(c.keyModTime)
+	c.m.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not load certificate: %s", err)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.certificate = &certificate
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// GetCertificate implements the tls.Config GetCertificate function
+func (c *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.certificate, nil
+}
+
+// watch reloads the certificate periodically until the stop channel is closed,
+// the previous certificate is kept when the new one can't be loaded
+func (c *certificateReloader) watch(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				logrus.Errorf("Could not reload API certificate: %s", err)
+				continue
+			}
+			if reloaded {
+				logrus.Infof("Reloaded API certificate from %s", c.certFile)
+			}
+		}
+	}
+}
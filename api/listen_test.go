@@ -0,0 +1,354 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/api"
+	"github.com/gomeeseeks/meeseeks-box/tokens"
+	"github.com/renstrom/dedent"
+
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert creates a certificate for the common name, signed by the parent
+// or self signed when there is none
+func newTestCert(t *testing.T, serial int64, cn string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stubs.Must(t, "failed to generate key", err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	stubs.Must(t, "failed to create certificate", err)
+	cert, err := x509.ParseCertificate(der)
+	stubs.Must(t, "failed to parse certificate", err)
+
+	return testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (c testCert) write(t *testing.T, certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	stubs.Must(t, "failed to marshal key", err)
+	stubs.Must(t, "failed to write certificate", ioutil.WriteFile(certFile, c.pem, 0600))
+	stubs.Must(t, "failed to write key", ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// freeAddress returns a local address that is not in use
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	stubs.Must(t, "failed to find a free address", err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, f func() error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = f(); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: %s", what, err)
+}
+
+func TestAPIServerConfigureErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-tls")
+	stubs.Must(t, "failed to create a temporary dir", err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, 1, "server", nil).write(t, certFile, keyFile)
+
+	tt := []struct {
+		name     string
+		opts     api.ListenOpts
+		expected string
+	}{
+		{
+			name:     "socket without path",
+			opts:     api.ListenOpts{Socket: &api.SocketOpts{}},
+			expected: "invalid socket: no path to listen on",
+		},
+		{
+			name:     "tls without key",
+			opts:     api.ListenOpts{TLS: &api.TLSOpts{Cert: certFile}},
+			expected: "invalid TLS configuration: a cert and a key are required",
+		},
+		{
+			name:     "tls with a missing cert",
+			opts:     api.ListenOpts{TLS: &api.TLSOpts{Cert: filepath.Join(dir, "missing.pem"), Key: keyFile}},
+			expected: "invalid TLS configuration: could not read certificate: stat " + filepath.Join(dir, "missing.pem") + ": no such file or directory",
+		},
+		{
+			name:     "client users without a client CA",
+			opts:     api.ListenOpts{TLS: &api.TLSOpts{Cert: certFile, Key: keyFile, ClientUsers: map[string]string{"ci": "someone"}}},
+			expected: "invalid TLS configuration: client certificates require a client CA",
+		},
+		{
+			name:     "client CA without certificates",
+			opts:     api.ListenOpts{TLS: &api.TLSOpts{Cert: certFile, Key: keyFile, ClientCA: keyFile}},
+			expected: "invalid TLS configuration: no certificates found in client CA " + keyFile,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := api.NewServer(stubs.MetadataStub{}, ":0")
+			defer s.Shutdown()
+			stubs.AssertEquals(t, tc.expected, s.Configure(tc.opts).Error())
+		})
+	}
+}
+
+func TestAPIServerTLS(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithConfig(dedent.Dedent(`
+			groups:
+			  admin: ["admin"]
+			policy:
+			  - name: no audits in general
+			    effect: deny
+			    commands: ["audit"]
+			    channels: ["#general"]
+			`)).WithDBPath(dbpath).Load()
+
+		dir := filepath.Dir(dbpath)
+		certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+
+		ca := newTestCert(t, 1, "ca", nil)
+		stubs.Must(t, "failed to write the CA", ioutil.WriteFile(caFile, ca.pem, 0600))
+		server := newTestCert(t, 2, "server", &ca)
+		server.write(t, certFile, keyFile)
+		admin := newTestCert(t, 3, "admin-client", &ca)
+		unknown := newTestCert(t, 4, "unknown-client", &ca)
+		untrusted := newTestCert(t, 5, "admin-client", nil)
+
+		token, err := tokens.Create(tokens.NewTokenRequest{UserLink: "someoneLink", ChannelLink: "generalLink"})
+		stubs.Must(t, "failed to create the token", err)
+
+		address := freeAddress(t)
+		s := api.NewServer(stubs.MetadataStub{}, address)
+		stubs.Must(t, "failed to configure the server", s.Configure(api.ListenOpts{
+			TLS: &api.TLSOpts{
+				Cert:        certFile,
+				Key:         keyFile,
+				ClientCA:    caFile,
+				ClientUsers: map[string]string{"admin-client": "admin"},
+				Reload:      10 * time.Millisecond,
+			},
+		}))
+		go s.ListenAndServe("/message")
+		defer s.Shutdown()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		client := func(certs ...tls.Certificate) *http.Client {
+			return &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+			}}
+		}
+		waitFor(t, "server did not start", func() error {
+			conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		})
+
+		tt := []struct {
+			name           string
+			client         *http.Client
+			token          string
+			path           string
+			expectedStatus int
+			expectedBody   string
+		}{
+			{
+				name:           "client certificate mapped to a user",
+				client:         client(admin.tlsCertificate()),
+				path:           "/tokens",
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[{"prefix":.*}\]$`,
+			},
+			{
+				name:           "client certificate denied by a channel rule",
+				client:         client(admin.tlsCertificate()),
+				path:           "/jobs?all=true",
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"user name: admin is not allowed to run audit"}$`,
+			},
+			{
+				name:           "client certificate not mapped to a user",
+				client:         client(unknown.tlsCertificate()),
+				path:           "/tokens",
+				expectedStatus: http.StatusBadRequest,
+				expectedBody:   `^{"error":"no token"}$`,
+			},
+			{
+				name:           "client certificate from another CA",
+				client:         client(untrusted.tlsCertificate()),
+				path:           "/tokens",
+				expectedStatus: http.StatusBadRequest,
+				expectedBody:   `^{"error":"no token"}$`,
+			},
+			{
+				name:           "token without client certificate",
+				client:         client(),
+				token:          token,
+				path:           "/jobs",
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[\]$`,
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest("GET", "https://"+address+tc.path, nil)
+				stubs.Must(t, "Could not create request", err)
+				if tc.token != "" {
+					req.Header.Set("TOKEN", tc.token)
+				}
+				resp, err := tc.client.Do(req)
+				stubs.Must(t, "failed to do request", err)
+				body, err := ioutil.ReadAll(resp.Body)
+				stubs.Must(t, "failed to read the response", err)
+				resp.Body.Close()
+
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				stubs.AssertMatches(t, tc.expectedBody, strings.TrimSpace(string(body)))
+			})
+		}
+
+		t.Run("plaintext request", func(t *testing.T) {
+			resp, err := http.Get("http://" + address + "/jobs")
+			stubs.Must(t, "failed to do request", err)
+			resp.Body.Close()
+			stubs.AssertEquals(t, http.StatusBadRequest, resp.StatusCode)
+		})
+
+		t.Run("certificate is reloaded", func(t *testing.T) {
+			renewed := newTestCert(t, 6, "server", &ca)
+			renewed.write(t, certFile, keyFile)
+			later := time.Now().Add(time.Minute)
+			stubs.Must(t, "failed to touch the certificate", os.Chtimes(certFile, later, later))
+
+			waitFor(t, "certificate was not reloaded", func() error {
+				conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 6 {
+					return fmt.Errorf("serving certificate %d", serial)
+				}
+				return nil
+			})
+		})
+	}))
+}
+
+func TestAPIServerSocket(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithDBPath(dbpath).Load()
+
+		token, err := tokens.Create(tokens.NewTokenRequest{UserLink: "someoneLink", ChannelLink: "generalLink"})
+		stubs.Must(t, "failed to create the token", err)
+
+		notSocket := filepath.Join(filepath.Dir(dbpath), "not.sock")
+		stubs.Must(t, "failed to write a file", ioutil.WriteFile(notSocket, []byte("keep"), 0600))
+		s := api.NewServer(stubs.MetadataStub{}, "")
+		stubs.Must(t, "failed to configure the server", s.Configure(api.ListenOpts{
+			Socket: &api.SocketOpts{Path: notSocket},
+		}))
+		err = s.ListenAndServe("/message")
+		stubs.AssertEquals(t, "could not listen on "+notSocket+": it exists and it's not a socket", err.Error())
+
+		socket := filepath.Join(filepath.Dir(dbpath), "meeseeks.sock")
+		stale, err := net.Listen("unix", socket)
+		stubs.Must(t, "failed to leave a stale socket", err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		s = api.NewServer(stubs.MetadataStub{}, "")
+		stubs.Must(t, "failed to configure the server", s.Configure(api.ListenOpts{
+			Socket: &api.SocketOpts{Path: socket, Mode: 0600},
+		}))
+		go s.ListenAndServe("/message")
+		defer s.Shutdown()
+
+		client := &http.Client{Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}}
+		waitFor(t, "server did not start", func() error {
+			conn, err := net.Dial("unix", socket)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		})
+
+		info, err := os.Stat(socket)
+		stubs.Must(t, "failed to stat the socket", err)
+		stubs.AssertEquals(t, os.FileMode(0600), info.Mode().Perm())
+
+		req, err := http.NewRequest("GET", "http://meeseeks/jobs", nil)
+		stubs.Must(t, "Could not create request", err)
+		req.Header.Set("TOKEN", token)
+		resp, err := client.Do(req)
+		stubs.Must(t, "failed to do request", err)
+		resp.Body.Close()
+		stubs.AssertEquals(t, http.StatusOK, resp.StatusCode)
+	}))
+}
+
+func TestAPIServerWithNothingToListen(t *testing.T) {
+	s := api.NewServer(stubs.MetadataStub{}, "")
+	defer s.Shutdown()
+	stubs.AssertEquals(t, api.ErrNothingToListen, s.ListenAndServe("/message"))
+}
@@ -0,0 +1,389 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+	"github.com/gomeeseeks/meeseeks-box/commands"
+	"github.com/gomeeseeks/meeseeks-box/commands/builtins"
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/jobs/logs"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+	"github.com/gomeeseeks/meeseeks-box/tokens"
+)
+
+// TokensPath is the path in which the API tokens are managed
+const TokensPath = "/tokens"
+
+// DefaultListLimit is how many jobs or tokens are listed when no limit is passed
+const DefaultListLimit = 5
+
+// ErrCommandToken is returned when a token that is bound to a command is used
+// in the REST endpoints, which require tokens bound only to a user
+var ErrCommandToken = errors.New("token is bound to a command, the REST API requires a user token")
+
+// JobLogs is the JSON reply with the logs of a job
+type JobLogs struct {
+	JobID  uint64 `json:"job_id"`
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewToken is the JSON request to create a token
+type NewToken struct {
+	UserLink     string   `json:"user_link"`
+	ChannelLink  string   `json:"channel_link"`
+	Text         string   `json:"text"`
+	Description  string   `json:"description"`
+	ExpiresIn    string   `json:"expires_in"`
+	MaxUses      int      `json:"max_uses"`
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	Signed       bool     `json:"signed"`
+	AllowArgs    bool     `json:"allow_args"`
+	AllowedEnv   []string `json:"allowed_env"`
+	ReplyMode    string   `json:"reply_mode"`
+	CallbackURL  string   `json:"callback_url"`
+}
+
+// CreatedToken is the JSON reply with a new token, the token and its secret
+// can't be recovered later
+type CreatedToken struct {
+	Token  string `json:"token"`
+	Prefix string `json:"prefix"`
+	Secret string `json:"secret,omitempty"`
+}
+
+func (s *Server) registerRESTHandlers() {
+	s.mux.HandleFunc(JobsPath, s.handleJobs)
+	s.mux.HandleFunc(JobsPath+"/", s.handleJob)
+	s.mux.HandleFunc(TokensPath, s.handleTokens)
+	s.mux.HandleFunc(TokensPath+"/", s.handleToken)
+}
+
+// authorize authenticates the request with a client certificate mapped to a
+// user or with a user token, and checks that the user is allowed to run the
+// builtin command equivalent to the endpoint
+//
+// The requests are sent from the channel the token is bound to, or from no
+// channel at all for client certificates, see requestFrom. It writes the error
+// reply and returns false when the request is not allowed.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, command string) (request.Request, bool) {
+	if userID, ok := s.certificateUser(r); ok {
+		req := s.listener.requestFrom(userID, "")
+		return req, s.check(w, req, command)
+	}
+
+	token, err := s.authenticate(w, r, func(token tokens.Token) error {
+		if token.Text != "" {
+			return rejected(http.StatusForbidden, ErrCommandToken)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, tokenErrorStatus(err), err)
+		return request.Request{}, false
+	}
+	req, err := s.listener.userRequest(token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return request.Request{}, false
+	}
+	return req, s.check(w, req, command)
+}
+
+// check checks that the user of the request is allowed to run the builtin
+// command, writing the error reply when it's not
+func (s *Server) check(w http.ResponseWriter, req request.Request, command string) bool {
+	req.Command = command
+	cmd, ok := commands.Find(command)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("command %s is not registered", command))
+		return false
+	}
+	if err := auth.Check(req, cmd); err != nil {
+		logrus.Debugf("User %s is not allowed to use the API as %s: %s", req.UserID, command, err)
+		if err == auth.ErrUserNotAllowed {
+			err = fmt.Errorf("user %s is not allowed to run %s", req.Username, command)
+		}
+		writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// handleJobs lists the jobs of the calling user, or of any user as audit does
+// when filtering by user or passing all=true
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	query := r.URL.Query()
+	user := query.Get("user")
+	all, _ := strconv.ParseBool(query.Get("all"))
+
+	command := builtins.BuiltinJobsCommand
+	if user != "" || all {
+		command = builtins.BuiltinAuditCommand
+	}
+	req, ok := s.authorize(w, r, command)
+	if !ok {
+		return
+	}
+
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID := req.UserID
+	if command == builtins.BuiltinAuditCommand {
+		if userID, err = auth.ResolveUser(user); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	status := strings.Title(query.Get("status"))
+	channel := query.Get("channel")
+	cmd := query.Get("command")
+
+	found, err := jobs.Find(jobs.JobFilter{
+		Limit: limit,
+		Match: func(j jobs.Job) bool {
+			return (userID == "" || j.Request.UserID == userID) &&
+				(status == "" || j.Status == status) &&
+				(channel == "" || j.Request.ChannelID == channel || j.Request.Channel == channel) &&
+				(cmd == "" || j.Request.Command == cmd)
+		},
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// handleJob serves a job, its logs, a live stream of its logs, and its
+// cancellation, using the audit commands when the job is not from the calling
+// user
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, JobsPath+"/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid job ID %s", parts[0]))
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = strings.Join(parts[1:], "/")
+	}
+
+	var own, other, method string
+	switch action {
+	case "":
+		own, other, method = builtins.BuiltinFindJobCommand, builtins.BuiltinAuditJobCommand, http.MethodGet
+	case "logs", "logs/stream":
+		own, other, method = builtins.BuiltinLogsCommand, builtins.BuiltinAuditLogsCommand, http.MethodGet
+	case "cancel":
+		own, other, method = builtins.BuiltinCancelJobCommand, builtins.BuiltinKillJobCommand, http.MethodPost
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	req, ok := s.authorize(w, r, own)
+	if !ok {
+		return
+	}
+	job, err := jobs.Get(id)
+	if err == jobs.ErrNoJobWithID {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	command := own
+	if job.Request.UserID != req.UserID {
+		command = other
+		if !s.check(w, req, command) {
+			return
+		}
+	}
+
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, job)
+	case "logs":
+		// jobs that didn't log anything yet have no logs
+		l, err := logs.Get(id)
+		if err != nil && err != logs.ErrNoLogsForJob {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, JobLogs{JobID: id, Output: l.Output, Error: l.Error})
+	case "logs/stream":
+		streamLogs(w, r, id)
+	case "cancel":
+		s.execute(w, req, command, parts[0])
+	}
+}
+
+// execute runs the builtin command, replying with its output as the message
+func (s *Server) execute(w http.ResponseWriter, req request.Request, command string, args ...string) {
+	cmd, _ := commands.Find(command)
+	req.Command = command
+	req.Args = args
+	out, err := cmd.Execute(context.Background(), jobs.NullJob(req))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": out})
+}
+
+// handleTokens lists and creates tokens
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := s.authorize(w, r, builtins.BuiltinListAPITokenCommand); !ok {
+			return
+		}
+		s.listTokens(w, r)
+
+	case http.MethodPost:
+		if _, ok := s.authorize(w, r, builtins.BuiltinNewAPITokenCommand); !ok {
+			return
+		}
+		s.createToken(w, r)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	user := query.Get("user")
+	channel := query.Get("channel")
+	command := query.Get("command")
+
+	found, err := tokens.Find(tokens.Filter{
+		Limit: limit,
+		Match: func(t tokens.Token) bool {
+			return (user == "" || t.UserLink == user) &&
+				(channel == "" || t.ChannelLink == channel) &&
+				(command == "" || strings.HasPrefix(t.Text, command))
+		},
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	n := NewToken{}
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid token request: %s", err))
+		return
+	}
+	if n.UserLink == "" || n.ChannelLink == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user_link and channel_link are required"))
+		return
+	}
+
+	req := tokens.NewTokenRequest{
+		UserLink:     n.UserLink,
+		ChannelLink:  n.ChannelLink,
+		Text:         n.Text,
+		Description:  n.Description,
+		MaxUses:      n.MaxUses,
+		AllowedCIDRs: n.AllowedCIDRs,
+		AllowArgs:    n.AllowArgs,
+		AllowedEnv:   n.AllowedEnv,
+		ReplyMode:    n.ReplyMode,
+		CallbackURL:  n.CallbackURL,
+	}
+	if n.ExpiresIn != "" {
+		d, err := time.ParseDuration(n.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid expires_in %s", n.ExpiresIn))
+			return
+		}
+		req.ExpiresOn = time.Now().Add(d)
+	}
+
+	created := CreatedToken{}
+	var err error
+	if n.Signed {
+		created.Token, created.Secret, err = tokens.CreateSigned(req)
+	} else {
+		created.Token, err = tokens.Create(req)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	created.Prefix = created.Token[:tokens.PrefixLength]
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handleToken revokes a token by prefix
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if _, ok := s.authorize(w, r, builtins.BuiltinRevokeAPITokenCommand); !ok {
+		return
+	}
+
+	prefix := strings.TrimPrefix(r.URL.Path, TokensPath+"/")
+	err := tokens.Revoke(prefix)
+	if err == tokens.ErrTokenNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseLimit(limit string) (int, error) {
+	if limit == "" {
+		return DefaultListLimit, nil
+	}
+	l, err := strconv.Atoi(limit)
+	if err != nil || l < 0 {
+		return 0, fmt.Errorf("invalid limit %s", limit)
+	}
+	return l, nil
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,400 @@
+package api_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gomeeseeks/meeseeks-box/api"
+	"github.com/gomeeseeks/meeseeks-box/commands"
+	"github.com/gomeeseeks/meeseeks-box/commands/builtins"
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/jobs/logs"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+	"github.com/gomeeseeks/meeseeks-box/tokens"
+	"github.com/renstrom/dedent"
+
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+)
+
+func TestAPIServerREST(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithConfig(dedent.Dedent(`
+			groups:
+			  admin: ["admin"]
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+
+		cancelled := make(chan uint64, 1)
+		commands.Add(builtins.BuiltinCancelJobCommand, builtins.NewCancelJobCommand(func(id uint64) {
+			cancelled <- id
+		}))
+
+		newToken := func(user, text string) string {
+			tk, err := tokens.Create(tokens.NewTokenRequest{
+				UserLink:    user + "Link",
+				ChannelLink: "generalLink",
+				Text:        text,
+			})
+			stubs.Must(t, "failed to create the token", err)
+			return tk
+		}
+		someone := newToken("someone", "")
+		admin := newToken("admin", "")
+		command := newToken("someone", "echo")
+
+		for _, user := range []string{"someone", "admin"} {
+			j, err := jobs.Create(request.Request{Command: "echo", Args: []string{"hello"}, UserID: user,
+				Username: user, ChannelID: "general", Channel: "general"})
+			stubs.Must(t, "failed to create job", err)
+			if user == "someone" {
+				stubs.Must(t, "failed to append logs", logs.Append(j.ID, "hello\n"))
+			}
+		}
+
+		s := api.NewServer(stubs.MetadataStub{IM: true}, ":0")
+		defer s.Shutdown()
+
+		testSrv := httptest.NewServer(s)
+		defer testSrv.Close()
+
+		tt := []struct {
+			name           string
+			method         string
+			path           string
+			token          string
+			body           string
+			expectedStatus int
+			expectedBody   string
+		}{
+			{
+				name:           "no token",
+				method:         "GET",
+				path:           "/jobs",
+				expectedStatus: http.StatusBadRequest,
+				expectedBody:   `^{"error":"no token"}$`,
+			},
+			{
+				name:           "command token",
+				method:         "GET",
+				path:           "/jobs",
+				token:          command,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"token is bound to a command, the REST API requires a user token"}$`,
+			},
+			{
+				name:           "own jobs",
+				method:         "GET",
+				path:           "/jobs",
+				token:          someone,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[{"ID":1,"Request":{"Command":"echo","Arguments":\["hello"\],"Username":"someone","UserID":"someone",.*"Status":"Running"}\]$`,
+			},
+			{
+				name:           "all jobs as a user",
+				method:         "GET",
+				path:           "/jobs?all=true",
+				token:          someone,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"user name: someone is not allowed to run audit"}$`,
+			},
+			{
+				name:           "all jobs as an admin",
+				method:         "GET",
+				path:           "/jobs?all=true&status=running&command=echo",
+				token:          admin,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[{"ID":2,.*},{"ID":1,.*}\]$`,
+			},
+			{
+				name:           "jobs of a user as an admin",
+				method:         "GET",
+				path:           "/jobs?user=someone",
+				token:          admin,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[{"ID":1,.*}\]$`,
+			},
+			{
+				name:           "own job",
+				method:         "GET",
+				path:           "/jobs/1",
+				token:          someone,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^{"ID":1,.*}$`,
+			},
+			{
+				name:           "job from another user",
+				method:         "GET",
+				path:           "/jobs/2",
+				token:          someone,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"user name: someone is not allowed to run auditjob"}$`,
+			},
+			{
+				name:           "job from another user as an admin",
+				method:         "GET",
+				path:           "/jobs/1",
+				token:          admin,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^{"ID":1,.*}$`,
+			},
+			{
+				name:           "unknown job",
+				method:         "GET",
+				path:           "/jobs/99",
+				token:          admin,
+				expectedStatus: http.StatusNotFound,
+				expectedBody:   `^{"error":"no job could be found"}$`,
+			},
+			{
+				name:           "own job logs",
+				method:         "GET",
+				path:           "/jobs/1/logs",
+				token:          someone,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^{"job_id":1,"output":"hello\\n"}$`,
+			},
+			{
+				name:           "own job without logs",
+				method:         "GET",
+				path:           "/jobs/2/logs",
+				token:          admin,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^{"job_id":2,"output":""}$`,
+			},
+			{
+				name:           "cancel with the wrong method",
+				method:         "GET",
+				path:           "/jobs/1/cancel",
+				token:          someone,
+				expectedStatus: http.StatusMethodNotAllowed,
+				expectedBody:   `^{"error":"method GET not allowed"}$`,
+			},
+			{
+				name:           "cancel own job",
+				method:         "POST",
+				path:           "/jobs/1/cancel",
+				token:          someone,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^{"message":"Issued command cancellation to job 1"}$`,
+			},
+			{
+				name:           "list tokens as a user",
+				method:         "GET",
+				path:           "/tokens",
+				token:          someone,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"user name: someone is not allowed to run tokens"}$`,
+			},
+			{
+				name:           "list tokens as an admin",
+				method:         "GET",
+				path:           "/tokens?command=echo",
+				token:          admin,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[{"prefix":"` + command[:tokens.PrefixLength] + `","userLink":"someoneLink",.*"text":"echo",.*}\]$`,
+			},
+			{
+				name:           "create a token",
+				method:         "POST",
+				path:           "/tokens",
+				token:          admin,
+				body:           `{"user_link":"someoneLink","channel_link":"generalLink","text":"echo","expires_in":"1h","signed":true}`,
+				expectedStatus: http.StatusCreated,
+				expectedBody:   `^{"token":"[0-9a-f-]{36}","prefix":"[0-9a-f]{8}","secret":"[0-9a-f]{64}"}$`,
+			},
+			{
+				name:           "create an invalid token",
+				method:         "POST",
+				path:           "/tokens",
+				token:          admin,
+				body:           `{"user_link":"someoneLink"}`,
+				expectedStatus: http.StatusBadRequest,
+				expectedBody:   `^{"error":"user_link and channel_link are required"}$`,
+			},
+			{
+				name:           "revoke a token",
+				method:         "DELETE",
+				path:           "/tokens/" + command[:tokens.PrefixLength],
+				token:          admin,
+				expectedStatus: http.StatusNoContent,
+			},
+			{
+				name:           "revoke a revoked token",
+				method:         "DELETE",
+				path:           "/tokens/" + command[:tokens.PrefixLength],
+				token:          admin,
+				expectedStatus: http.StatusNotFound,
+				expectedBody:   `^{"error":"no token found"}$`,
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest(tc.method, testSrv.URL+tc.path, strings.NewReader(tc.body))
+				stubs.Must(t, "Could not create request", err)
+				if tc.token != "" {
+					req.Header.Set("TOKEN", tc.token)
+				}
+
+				resp, err := testSrv.Client().Do(req)
+				stubs.Must(t, "failed to do request", err)
+				body, err := ioutil.ReadAll(resp.Body)
+				stubs.Must(t, "failed to read the response", err)
+
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				stubs.AssertMatches(t, tc.expectedBody, strings.TrimSpace(string(body)))
+			})
+		}
+		stubs.AssertEquals(t, uint64(1), <-cancelled)
+	}))
+}
+
+func TestAPIServerRESTFromAChannel(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithConfig(dedent.Dedent(`
+			groups:
+			  admin: ["admin"]
+			policy:
+			  - name: no audits in general
+			    effect: deny
+			    commands: ["audit"]
+			    channels: ["#general"]
+			  - effect: allow
+			    groups: ["admin"]
+			`)).WithDBPath(dbpath).Load()
+
+		newToken := func(channel string) string {
+			tk, err := tokens.Create(tokens.NewTokenRequest{
+				UserLink:    "adminLink",
+				ChannelLink: channel + "Link",
+			})
+			stubs.Must(t, "failed to create the token", err)
+			return tk
+		}
+		general := newToken("general")
+		random := newToken("random")
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		testSrv := httptest.NewServer(s)
+		defer testSrv.Close()
+
+		tt := []struct {
+			name           string
+			path           string
+			token          string
+			expectedStatus int
+			expectedBody   string
+		}{
+			{
+				name:           "IM only command",
+				path:           "/tokens",
+				token:          random,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"this command can only be used over an IM conversation"}$`,
+			},
+			{
+				name:           "denied in the channel",
+				path:           "/jobs?all=true",
+				token:          general,
+				expectedStatus: http.StatusForbidden,
+				expectedBody:   `^{"error":"user name: admin is not allowed to run audit"}$`,
+			},
+			{
+				name:           "allowed in another channel",
+				path:           "/jobs?all=true",
+				token:          random,
+				expectedStatus: http.StatusOK,
+				expectedBody:   `^\[\]$`,
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest("GET", testSrv.URL+tc.path, nil)
+				stubs.Must(t, "Could not create request", err)
+				req.Header.Set("TOKEN", tc.token)
+
+				resp, err := testSrv.Client().Do(req)
+				stubs.Must(t, "failed to do request", err)
+				body, err := ioutil.ReadAll(resp.Body)
+				stubs.Must(t, "failed to read the response", err)
+
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				stubs.AssertMatches(t, tc.expectedBody, strings.TrimSpace(string(body)))
+			})
+		}
+	}))
+}
+
+func TestAPIServerStreamLogs(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithConfig(dedent.Dedent(`
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+
+		token, err := tokens.Create(tokens.NewTokenRequest{
+			UserLink:    "someoneLink",
+			ChannelLink: "generalLink",
+		})
+		stubs.Must(t, "failed to create the token", err)
+
+		j, err := jobs.Create(request.Request{Command: "echo", UserID: "someone", Username: "someone",
+			ChannelID: "general", Channel: "general"})
+		stubs.Must(t, "failed to create job", err)
+		stubs.Must(t, "failed to append logs", logs.Append(j.ID, "hello\n"))
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		testSrv := httptest.NewServer(s)
+		defer testSrv.Close()
+
+		stream := func() *http.Response {
+			req, err := http.NewRequest("GET", testSrv.URL+"/jobs/1/logs/stream", nil)
+			stubs.Must(t, "Could not create request", err)
+			req.Header.Set("TOKEN", token)
+			resp, err := testSrv.Client().Do(req)
+			stubs.Must(t, "failed to do request", err)
+			stubs.AssertEquals(t, http.StatusOK, resp.StatusCode)
+			stubs.AssertEquals(t, "text/event-stream", resp.Header.Get("Content-Type"))
+			return resp
+		}
+
+		resp := stream()
+		reader := bufio.NewReader(resp.Body)
+		readEvent := func() string {
+			event := ""
+			for {
+				line, err := reader.ReadString('\n')
+				stubs.Must(t, "failed to read the stream", err)
+				if line == "\n" {
+					return event
+				}
+				event += line
+			}
+		}
+		stubs.AssertEquals(t, "id: 1\ndata: hello\ndata: \n", readEvent())
+
+		stubs.Must(t, "failed to append logs", logs.Append(j.ID, "bye"))
+		stubs.AssertEquals(t, "id: 2\ndata: bye\n", readEvent())
+
+		stubs.Must(t, "failed to finish the job", j.Finish(jobs.SuccessStatus))
+		stubs.AssertEquals(t, "event: end\ndata: Successful\n", readEvent())
+		resp.Body.Close()
+
+		resp = stream()
+		body, err := ioutil.ReadAll(resp.Body)
+		stubs.Must(t, "failed to read the response", err)
+		stubs.AssertEquals(t, "id: 1\ndata: hello\ndata: \n\nid: 2\ndata: bye\n\nevent: end\ndata: Successful\n\n", string(body))
+	}))
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/tokens"
+)
+
+// Headers used to sign requests
+//
+// Signed requests identify the token by its prefix and carry an HMAC-SHA256
+// of the request built with the signing secret of the token, so the token
+// itself is never sent.
+const (
+	TokenPrefixHeader = "X-Meeseeks-Token-Prefix"
+	TimestampHeader   = "X-Meeseeks-Timestamp"
+	NonceHeader       = "X-Meeseeks-Nonce"
+	SignatureHeader   = "X-Meeseeks-Signature"
+)
+
+// MaxSignatureSkew is how far the timestamp of a signed request can be from the
+// server time, nonces are remembered for long enough to cover this window
+const MaxSignatureSkew = 5 * time.Minute
+
+// MaxNonces is how many signed requests each token can send within the time
+// nonces are remembered, the requests over it are rejected
+const MaxNonces = 1000
+
+// MaxPayload is the largest body of a request posted with a token, signed or not
+const MaxPayload = 1 << 20
+
+// Errors returned when a signed request is rejected
+var (
+	ErrMissingSignatureHeaders = errors.New("signed request is missing headers")
+	ErrInvalidTimestamp        = errors.New("signed request timestamp is invalid")
+	ErrTimestampSkewed         = errors.New("signed request timestamp is out of the allowed window")
+	ErrInvalidSignature        = errors.New("signed request signature is invalid")
+	ErrReplayedRequest         = errors.New("signed request nonce was already used")
+	ErrTooManyNonces           = errors.New("too many signed requests for the token, try again later")
+	ErrPayloadTooLarge         = errors.New("request body is too large")
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of the request with the secret, the
+// uri is the path along with the query string, and the timestamp is in unix
+// seconds
+func Sign(secret, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// useSigned verifies the signature of the request and uses the token it was
+// signed for if the request is accepted, the body of the request is restored so
+// it can be read again
+func (s *Server) useSigned(w http.ResponseWriter, r *http.Request, accept func(tokens.Token) error) (tokens.Token, error) {
+	prefix := r.Header.Get(TokenPrefixHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	signature := r.Header.Get(SignatureHeader)
+	if prefix == "" || timestamp == "" || nonce == "" || signature == "" {
+		return tokens.Token{}, ErrMissingSignatureHeaders
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return tokens.Token{}, ErrInvalidTimestamp
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > MaxSignatureSkew || skew < -MaxSignatureSkew {
+		return tokens.Token{}, ErrTimestampSkewed
+	}
+
+	body, err := readBody(w, r)
+	if err != nil {
+		return tokens.Token{}, err
+	}
+
+	return tokens.UseSigned(prefix, remoteIP(r), func(secret string) error {
+		expected := Sign(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return ErrInvalidSignature
+		}
+		return s.nonces.add(prefix, nonce, now, 2*MaxSignatureSkew)
+	}, accept)
+}
+
+// readBody reads the body of the request, up to MaxPayload, and restores it so
+// it can be read again
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPayload)); err != nil {
+			if len(body) >= MaxPayload {
+				return nil, ErrPayloadTooLarge
+			}
+			return nil, err
+		}
+		r.Body.Close()
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// nonceCache remembers the nonces of the signed requests of each token to
+// reject replays, up to MaxNonces per token
+//
+// All the nonces are remembered for the same time, so they expire in the order
+// they are added and are swept from the oldest one.
+type nonceCache struct {
+	seen  map[string]map[string]bool
+	queue []seenNonce
+	m     sync.Mutex
+}
+
+type seenNonce struct {
+	prefix    string
+	nonce     string
+	expiresAt time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		seen: make(map[string]map[string]bool),
+	}
+}
+
+// add records the nonce of the token for the ttl, it returns
+// ErrReplayedRequest when it was already seen, or ErrTooManyNonces when the
+// token has too many nonces that didn't expire yet
+func (c *nonceCache) add(prefix, nonce string, now time.Time, ttl time.Duration) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.sweep(now)
+	nonces := c.seen[prefix]
+	if nonces[nonce] {
+		return ErrReplayedRequest
+	}
+	if len(nonces) >= MaxNonces {
+		return ErrTooManyNonces
+	}
+	if nonces == nil {
+		nonces = make(map[string]bool)
+		c.seen[prefix] = nonces
+	}
+	nonces[nonce] = true
+	c.queue = append(c.queue, seenNonce{prefix: prefix, nonce: nonce, expiresAt: now.Add(ttl)})
+	return nil
+}
+
+// sweep forgets the nonces that expired, from the oldest one
+func (c *nonceCache) sweep(now time.Time) {
+	for len(c.queue) > 0 && !now.Before(c.queue[0].expiresAt) {
+		n := c.queue[0]
+		c.queue = c.queue[1:]
+		delete(c.seen[n.prefix], n.nonce)
+		if len(c.seen[n.prefix]) == 0 {
+			delete(c.seen, n.prefix)
+		}
+	}
+}
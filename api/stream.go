@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/jobs/logs"
+)
+
+// streamLogs tails the logs of the job as server-sent events, sending what was
+// already logged first and then every line as it's appended, until the job
+// finishes or the client goes away
+//
+// Each chunk of output is sent as a message whose id is its sequence, and the
+// stream ends with an end event carrying the final status of the job.
+func streamLogs(w http.ResponseWriter, r *http.Request, jobID uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	// Subscribing before reading the backlog makes sure no line is lost in
+	// between, the lines received twice are skipped by sequence
+	sub := logs.Subscribe(jobID)
+	defer sub.Unsubscribe()
+
+	job, err := jobs.Get(jobID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	lines, err := logs.GetLines(jobID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var last uint64
+	for _, line := range lines {
+		writeEvent(w, line)
+		last = line.Sequence
+	}
+	flusher.Flush()
+
+	if job.Status != jobs.RunningStatus {
+		writeEnd(w, job.Status)
+		flusher.Flush()
+		return
+	}
+
+	for {
+		select {
+		case line, ok := <-sub.Lines:
+			if !ok {
+				if sub.Overflowed() {
+					fmt.Fprintf(w, "event: error\ndata: fell behind the job output\n\n")
+				} else if job, err = jobs.Get(jobID); err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+				} else {
+					writeEnd(w, job.Status)
+				}
+				flusher.Flush()
+				return
+			}
+			if line.Sequence <= last {
+				continue
+			}
+			writeEvent(w, line)
+			last = line.Sequence
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes the line as a message, splitting its content in data
+// fields so the client gets it back exactly as it was logged
+func writeEvent(w http.ResponseWriter, line logs.Line) {
+	fmt.Fprintf(w, "id: %d\n", line.Sequence)
+	for _, data := range strings.Split(line.Content, "\n") {
+		fmt.Fprintf(w, "data: %s\n", data)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func writeEnd(w http.ResponseWriter, status string) {
+	fmt.Fprintf(w, "event: end\ndata: %s\n\n", status)
+}
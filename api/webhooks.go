@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+)
+
+// WebhooksPath is the path under which the webhooks are served
+const WebhooksPath = "/webhooks"
+
+// MaxWebhookPayload is the largest payload a webhook accepts
+const MaxWebhookPayload = 1 << 20
+
+// Ways in which the webhook requests are verified
+const (
+	// WebhookGitHub verifies the HMAC SHA-256 of the payload sent by GitHub in
+	// the X-Hub-Signature-256 header
+	WebhookGitHub = "github"
+	// WebhookGitLab verifies the secret token sent by GitLab in the
+	// X-Gitlab-Token header
+	WebhookGitLab = "gitlab"
+	// WebhookBasicAuth verifies the username and password of the request, as
+	// sent by Alertmanager
+	WebhookBasicAuth = "basic"
+)
+
+// Headers used to verify the webhook requests
+const (
+	GitHubSignatureHeader = "X-Hub-Signature-256"
+	GitLabTokenHeader     = "X-Gitlab-Token"
+)
+
+// ErrWebhookNotVerified is returned when a webhook request fails verification
+var ErrWebhookNotVerified = errors.New("webhook request could not be verified")
+
+// WebhookOpts are the options used to register a webhook
+//
+// The args are templates rendered with the JSON payload, as in
+// {{ .commonLabels.alertname }}, which are appended as they are to the
+// command, which runs as the user in the channel.
+type WebhookOpts struct {
+	Name     string
+	Path     string
+	Verify   string
+	Secret   string
+	Username string
+	Password string
+	Command  string
+	Args     []string
+	Channel  string
+	User     string
+}
+
+// URLPath returns the path in which the webhook is served, which defaults to
+// its name
+func (o WebhookOpts) URLPath() string {
+	path := o.Path
+	if path == "" {
+		path = o.Name
+	}
+	return WebhooksPath + "/" + strings.Trim(path, "/")
+}
+
+type webhook struct {
+	WebhookOpts
+	args      []*template.Template
+	channelID string
+	userID    string
+}
+
+// RegisterWebhook serves the webhook under the webhooks path, it returns an
+// error when the webhook is invalid or its path is taken
+func (s *Server) RegisterWebhook(opts WebhookOpts) error {
+	path := opts.URLPath()
+	if s.webhooks[path] {
+		return fmt.Errorf("invalid webhook %s: path %s is already taken", opts.Name, path)
+	}
+	w, err := newWebhook(opts, s.listener.metadata)
+	if err != nil {
+		return fmt.Errorf("invalid webhook %s: %s", opts.Name, err)
+	}
+
+	s.webhooks[path] = true
+	s.mux.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+		s.handleWebhook(w, rw, r)
+	})
+	logrus.Infof("Registered webhook %s on %s", opts.Name, path)
+	return nil
+}
+
+func newWebhook(opts WebhookOpts, metadata MetadataClient) (webhook, error) {
+	switch opts.Verify {
+	case WebhookGitHub, WebhookGitLab:
+		if opts.Secret == "" {
+			return webhook{}, fmt.Errorf("%s verification requires a secret", opts.Verify)
+		}
+	case WebhookBasicAuth:
+		if opts.Username == "" || opts.Password == "" {
+			return webhook{}, fmt.Errorf("basic verification requires a username and a password")
+		}
+	default:
+		return webhook{}, fmt.Errorf("unknown verification %q, it should be one of %s, %s or %s",
+			opts.Verify, WebhookGitHub, WebhookGitLab, WebhookBasicAuth)
+	}
+	if opts.Command == "" {
+		return webhook{}, fmt.Errorf("no command to run")
+	}
+
+	w := webhook{WebhookOpts: opts}
+	for i, arg := range opts.Args {
+		t, err := template.New(fmt.Sprintf("%s arg %d", opts.Name, i+1)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return webhook{}, fmt.Errorf("could not parse arg %q: %s", arg, err)
+		}
+		w.args = append(w.args, t)
+	}
+
+	var err error
+	if w.channelID, err = metadata.ParseChannelLink(opts.Channel); err != nil {
+		return webhook{}, fmt.Errorf("failed to parse channel link %s: %s", opts.Channel, err)
+	}
+	if w.userID, err = auth.ResolveUser(opts.User); err != nil {
+		return webhook{}, err
+	}
+	return w, nil
+}
+
+// verify checks that the request comes from the sender of the webhook
+func (w webhook) verify(r *http.Request, body []byte) error {
+	var ok bool
+	switch w.Verify {
+	case WebhookGitHub:
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		ok = hmac.Equal([]byte(expected), []byte(r.Header.Get(GitHubSignatureHeader)))
+	case WebhookGitLab:
+		ok = subtle.ConstantTimeCompare([]byte(w.Secret), []byte(r.Header.Get(GitLabTokenHeader))) == 1
+	case WebhookBasicAuth:
+		username, password, found := r.BasicAuth()
+		ok = found &&
+			subtle.ConstantTimeCompare([]byte(w.Username), []byte(username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(w.Password), []byte(password)) == 1
+	}
+	if !ok {
+		return ErrWebhookNotVerified
+	}
+	return nil
+}
+
+// render renders the args with the payload
+func (w webhook) render(payload interface{}) ([]string, error) {
+	args := make([]string, 0, len(w.args))
+	for _, t := range w.args {
+		b := bytes.NewBuffer([]byte{})
+		if err := t.Execute(b, payload); err != nil {
+			return nil, err
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// handleWebhook verifies the request and sends the command with the args
+// rendered from the payload to the pipeline, replying with the started job
+func (s *Server) handleWebhook(w webhook, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, MaxWebhookPayload))
+	if err != nil {
+		writeError(rw, http.StatusRequestEntityTooLarge, fmt.Errorf("could not read payload: %s", err))
+		return
+	}
+	if err = w.verify(r, body); err != nil {
+		logrus.Debugf("Webhook %s request from %s could not be verified", w.Name, r.RemoteAddr)
+		writeError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	var payload interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err = d.Decode(&payload); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid JSON payload: %s", err))
+		return
+	}
+	args, err := w.render(payload)
+	if err != nil {
+		writeError(rw, http.StatusUnprocessableEntity, fmt.Errorf("could not map the payload to args: %s", err))
+		return
+	}
+
+	logrus.Debugf("Webhook %s runs %s with args %#v", w.Name, w.Command, args)
+	tracker := s.listener.send(w.channelID, w.userID, w.Command, Payload{Args: args})
+	s.replyWithJob(rw, tracker, false, time.After(DefaultWaitTimeout))
+}
@@ -0,0 +1,243 @@
+package api_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gomeeseeks/meeseeks-box/api"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+)
+
+func TestAPIServerWebhooks(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(dbpath string) {
+		stubs.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		s := api.NewServer(stubs.MetadataStub{}, ":0")
+		defer s.Shutdown()
+
+		for _, opts := range []api.WebhookOpts{
+			{
+				Name:     "alertmanager",
+				Verify:   api.WebhookBasicAuth,
+				Username: "alertmanager",
+				Password: "hunter2",
+				Command:  "echo",
+				Args:     []string{"{{ .commonLabels.alertname }}", "{{ (index .alerts 0).labels.instance }}"},
+				Channel:  "alertsLink",
+				User:     "remediator",
+			},
+			{
+				Name:    "github",
+				Path:    "/github/push/",
+				Verify:  api.WebhookGitHub,
+				Secret:  "secret",
+				Command: "echo",
+				Args:    []string{"{{ .after }}"},
+				Channel: "deploysLink",
+				User:    "<@deployer>",
+			},
+			{
+				Name:    "gitlab",
+				Verify:  api.WebhookGitLab,
+				Secret:  "secret",
+				Command: "echo pipeline",
+				Channel: "deploysLink",
+				User:    "deployer",
+			},
+		} {
+			stubs.Must(t, "failed to register webhook", s.RegisterWebhook(opts))
+		}
+
+		for _, tc := range []struct {
+			name     string
+			opts     api.WebhookOpts
+			expected string
+		}{
+			{
+				name:     "taken path",
+				opts:     api.WebhookOpts{Name: "other", Path: "gitlab"},
+				expected: "invalid webhook other: path /webhooks/gitlab is already taken",
+			},
+			{
+				name:     "unknown verification",
+				opts:     api.WebhookOpts{Name: "other", Verify: "none"},
+				expected: `invalid webhook other: unknown verification "none", it should be one of github, gitlab or basic`,
+			},
+			{
+				name:     "missing secret",
+				opts:     api.WebhookOpts{Name: "other", Verify: api.WebhookGitHub},
+				expected: "invalid webhook other: github verification requires a secret",
+			},
+			{
+				name: "invalid template",
+				opts: api.WebhookOpts{Name: "other", Verify: api.WebhookGitLab, Secret: "secret", Command: "echo",
+					Args: []string{"{{ .unclosed"}},
+				expected: `invalid webhook other: could not parse arg "{{ .unclosed": template: other arg 1:1: unclosed action`,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				stubs.AssertEquals(t, tc.expected, s.RegisterWebhook(tc.opts).Error())
+			})
+		}
+
+		ch := make(chan message.Message)
+		go s.GetListener().ListenMessages(ch)
+
+		testSrv := httptest.NewServer(s)
+		defer testSrv.Close()
+
+		alert := `{"commonLabels":{"alertname":"DiskFull"},"alerts":[{"labels":{"instance":"db-1; rm -rf /"}}]}`
+		push := `{"after":"abc123"}`
+		sign := func(body string) string {
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(body))
+			return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+
+		tt := []struct {
+			name            string
+			method          string
+			path            string
+			body            string
+			setup           func(*http.Request)
+			expectedStatus  int
+			expectedError   string
+			expectedRequest request.Request
+		}{
+			{
+				name: "alertmanager",
+				path: "/webhooks/alertmanager",
+				body: alert,
+				setup: func(r *http.Request) {
+					r.SetBasicAuth("alertmanager", "hunter2")
+				},
+				expectedStatus: http.StatusAccepted,
+				expectedRequest: request.Request{
+					Command:   "echo",
+					Args:      []string{"DiskFull", "db-1; rm -rf /"},
+					UserID:    "remediator",
+					ChannelID: "alerts",
+				},
+			},
+			{
+				name: "alertmanager with the wrong password",
+				path: "/webhooks/alertmanager",
+				body: alert,
+				setup: func(r *http.Request) {
+					r.SetBasicAuth("alertmanager", "wrong")
+				},
+				expectedStatus: http.StatusUnauthorized,
+				expectedError:  "webhook request could not be verified",
+			},
+			{
+				name: "alertmanager payload missing a key",
+				path: "/webhooks/alertmanager",
+				body: `{"alerts":[]}`,
+				setup: func(r *http.Request) {
+					r.SetBasicAuth("alertmanager", "hunter2")
+				},
+				expectedStatus: http.StatusUnprocessableEntity,
+				expectedError: `could not map the payload to args: template: alertmanager arg 1:1:16: ` +
+					`executing "alertmanager arg 1" at <.commonLabels.alertname>: map has no entry for key "commonLabels"`,
+			},
+			{
+				name: "github",
+				path: "/webhooks/github/push",
+				body: push,
+				setup: func(r *http.Request) {
+					r.Header.Set(api.GitHubSignatureHeader, sign(push))
+				},
+				expectedStatus: http.StatusAccepted,
+				expectedRequest: request.Request{
+					Command:   "echo",
+					Args:      []string{"abc123"},
+					UserID:    "deployer",
+					ChannelID: "deploys",
+				},
+			},
+			{
+				name: "github with a tampered payload",
+				path: "/webhooks/github/push",
+				body: `{"after":"evil"}`,
+				setup: func(r *http.Request) {
+					r.Header.Set(api.GitHubSignatureHeader, sign(push))
+				},
+				expectedStatus: http.StatusUnauthorized,
+				expectedError:  "webhook request could not be verified",
+			},
+			{
+				name: "gitlab",
+				path: "/webhooks/gitlab",
+				body: `{}`,
+				setup: func(r *http.Request) {
+					r.Header.Set(api.GitLabTokenHeader, "secret")
+				},
+				expectedStatus: http.StatusAccepted,
+				expectedRequest: request.Request{
+					Command:   "echo",
+					Args:      []string{"pipeline"},
+					UserID:    "deployer",
+					ChannelID: "deploys",
+				},
+			},
+			{
+				name: "gitlab with an invalid payload",
+				path: "/webhooks/gitlab",
+				body: `not json`,
+				setup: func(r *http.Request) {
+					r.Header.Set(api.GitLabTokenHeader, "secret")
+				},
+				expectedStatus: http.StatusBadRequest,
+				expectedError:  "invalid JSON payload: invalid character 'o' in literal null (expecting 'u')",
+			},
+			{
+				name:           "wrong method",
+				method:         "GET",
+				path:           "/webhooks/gitlab",
+				setup:          func(r *http.Request) {},
+				expectedStatus: http.StatusMethodNotAllowed,
+				expectedError:  "method GET not allowed",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				method := tc.method
+				if method == "" {
+					method = "POST"
+				}
+				req, err := http.NewRequest(method, testSrv.URL+tc.path, strings.NewReader(tc.body))
+				stubs.Must(t, "Could not create request", err)
+				tc.setup(req)
+
+				respCh := do(testSrv, req)
+				if tc.expectedStatus == http.StatusAccepted {
+					msg := <-ch
+					startJob(msg)
+					r, err := request.FromMessage(msg)
+					stubs.Must(t, "failed to build the request", err)
+					stubs.AssertEquals(t, tc.expectedRequest.Command, r.Command)
+					stubs.AssertEquals(t, tc.expectedRequest.Args, r.Args)
+					stubs.AssertEquals(t, tc.expectedRequest.UserID, r.UserID)
+					stubs.AssertEquals(t, tc.expectedRequest.ChannelID, r.ChannelID)
+				}
+				resp := <-respCh
+				stubs.Must(t, "failed to do request", resp.err)
+				stubs.AssertEquals(t, tc.expectedStatus, resp.StatusCode)
+				if tc.expectedError != "" {
+					body := map[string]string{}
+					stubs.Must(t, "failed to read the response", json.NewDecoder(resp.Body).Decode(&body))
+					stubs.AssertEquals(t, tc.expectedError, body["error"])
+				}
+			})
+		}
+	}))
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ArgRule overrides the command authorization for requests whose arguments
+// match the rule
+type ArgRule struct {
+	argsMatcher
+
+	Strategy string
+	Groups   []string
+}
+
+// NewArgRule validates the matchers and returns a new argument rule, when no
+// strategy is provided it defaults to group if there are groups, or none
+func NewArgRule(args []string, regex, strategy string, groups []string) (ArgRule, error) {
+	m, err := newArgsMatcher(args, regex)
+	if err != nil {
+		return ArgRule{}, err
+	}
+
+	if strategy == "" {
+		strategy = AuthStrategyNone
+		if len(groups) > 0 {
+			strategy = AuthStrategyAllowedGroup
+		}
+	}
+	if !isValidStrategy(strategy) {
+		return ArgRule{}, fmt.Errorf("invalid auth strategy %s", strategy)
+	}
+
+	return ArgRule{
+		argsMatcher: m,
+		Strategy:    strategy,
+		Groups:      groups,
+	}, nil
+}
+
+// AuthStrategy implements CommandAuthorization.AuthStrategy
+func (r ArgRule) AuthStrategy() string {
+	return r.Strategy
+}
+
+// AllowedGroups implements CommandAuthorization.AllowedGroups
+func (r ArgRule) AllowedGroups() []string {
+	if r.Groups == nil {
+		return []string{}
+	}
+	return r.Groups
+}
+
+// ChannelRestrictions implements CommandAuthorization.ChannelRestrictions,
+// channel restrictions are always enforced at the command level
+func (r ArgRule) ChannelRestrictions() ChannelRestrictions {
+	return ChannelRestrictions{}
+}
+
+// ArgRules implements CommandAuthorization.ArgRules
+func (r ArgRule) ArgRules() []ArgRule {
+	return []ArgRule{}
+}
+
+type argsMatcher struct {
+	// Args is a list of glob patterns matched positionally against the
+	// request arguments, a request needs to have at least as many arguments
+	Args []string
+	// Regex is matched against all the request arguments joined by spaces
+	Regex string
+
+	regex *regexp.Regexp
+}
+
+func newArgsMatcher(args []string, regex string) (argsMatcher, error) {
+	for _, pattern := range args {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return argsMatcher{}, fmt.Errorf("invalid argument pattern %s: %s", pattern, err)
+		}
+	}
+
+	var r *regexp.Regexp
+	if regex != "" {
+		var err error
+		if r, err = regexp.Compile(regex); err != nil {
+			return argsMatcher{}, fmt.Errorf("invalid arguments regex %s: %s", regex, err)
+		}
+	}
+	return argsMatcher{
+		Args:  args,
+		Regex: regex,
+		regex: r,
+	}, nil
+}
+
+// Matches returns true when the passed arguments match all the matchers
+func (m argsMatcher) Matches(args []string) bool {
+	if len(args) < len(m.Args) {
+		return false
+	}
+	for i, pattern := range m.Args {
+		if ok, _ := path.Match(pattern, args[i]); !ok {
+			return false
+		}
+	}
+	if m.regex != nil && !m.regex.MatchString(strings.Join(args, " ")) {
+		return false
+	}
+	return true
+}
+
+func (m argsMatcher) isEmpty() bool {
+	return len(m.Args) == 0 && m.regex == nil
+}
+
+func (m argsMatcher) String() string {
+	matchers := make([]string, 0)
+	if len(m.Args) > 0 {
+		matchers = append(matchers, fmt.Sprintf("%s", m.Args))
+	}
+	if m.regex != nil {
+		matchers = append(matchers, fmt.Sprintf("/%s/", m.Regex))
+	}
+	return strings.Join(matchers, " and ")
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
+)
+
+var groupsAuditBucketKey = []byte("groups_audit")
+
+// Group audit actions
+const (
+	GroupSeeded  = "seeded"
+	GroupCreated = "created"
+	GroupDeleted = "deleted"
+	UsersAdded   = "added"
+	UsersRemoved = "removed"
+)
+
+// GroupChange is an entry in the groups audit trail, the username is the ID of
+// the user that changed the group, or ConfiguredBy
+type GroupChange struct {
+	ID        uint64    `json:"ID"`
+	Time      time.Time `json:"Time"`
+	Username  string    `json:"Username"`
+	Action    string    `json:"Action"`
+	Group     string    `json:"Group"`
+	Usernames []string  `json:"Usernames"`
+}
+
+// ByUser returns whether the group was changed by a user, as opposed to the
+// configuration
+func (c GroupChange) ByUser() bool {
+	return c.Username != ConfiguredBy
+}
+
+func recordChange(tx *bolt.Tx, by, action, group string, usernames ...string) error {
+	id, bucket, err := db.NextSequenceFor(groupsAuditBucketKey, tx)
+	if err != nil {
+		return fmt.Errorf("could not get next sequence for groups audit: %s", err)
+	}
+	if usernames == nil {
+		usernames = []string{}
+	}
+	payload, err := json.Marshal(GroupChange{
+		ID:        id,
+		Time:      time.Now().UTC(),
+		Username:  by,
+		Action:    action,
+		Group:     group,
+		Usernames: usernames,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal group change: %s", err)
+	}
+	return bucket.Put(db.IDToBytes(id), payload)
+}
+
+// FindGroupChanges returns the last changes on groups in descending order
+func FindGroupChanges(limit int) ([]GroupChange, error) {
+	changes := make([]GroupChange, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(groupsAuditBucketKey)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for _, payload := c.Last(); payload != nil && len(changes) < limit; _, payload = c.Prev() {
+			change := GroupChange{}
+			if err := json.Unmarshal(payload, &change); err != nil {
+				return fmt.Errorf("failed to load group change: %s", err)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, err
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"errors"
 
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -11,72 +12,50 @@ const AdminGroup = "admin"
 type CommandAuthorization interface {
 	AuthStrategy() string
 	AllowedGroups() []string
+	ChannelRestrictions() ChannelRestrictions
+	ArgRules() []ArgRule
 }
 
-// Authorizer is the interface used to check if a user is allowed to run a command
-type Authorizer interface {
-	Check(string, CommandAuthorization) error
+// AdminOnly is implemented by the commands that can only be run by the members
+// of the admin group whatever the policy says, like the admin builtins
+type AdminOnly interface {
+	AdminOnly() bool
 }
 
 // ErrUserNotAllowed is the error returned when the auth check fails
 var ErrUserNotAllowed = errors.New("User no allower")
 
+// Errors returned when a command is not allowed in the channel it was requested from
+var (
+	ErrChannelNotAllowed = errors.New("this command is not allowed in this channel")
+	ErrIMOnly            = errors.New("this command can only be used over an IM conversation")
+	ErrChannelsOnly      = errors.New("this command can't be used over an IM conversation")
+)
+
 // Authorization Strategies determine who has access to what
 const (
 	AuthStrategyAny          = "any"
 	AuthStrategyAllowedGroup = "group"
 	AuthStrategyNone         = "none"
+	AuthStrategyExternal     = "external"
 )
 
-var authStrategies = map[string]Authorizer{
-	AuthStrategyAny:          anyUserAllowed{},
-	AuthStrategyAllowedGroup: userInGroupAllowed{},
-	AuthStrategyNone:         noUserAllowed{},
-}
-
-// Check checks if a user is allowed to run a command given the command authorization strategy
-func Check(username string, cmd CommandAuthorization) error {
-	strategy, ok := authStrategies[cmd.AuthStrategy()]
-	if !ok {
-		log.Errorf("Command does not have a valid auth strategy, falling back to none: %+v", cmd)
-		strategy = authStrategies[AuthStrategyNone]
+func isValidStrategy(strategy string) bool {
+	switch strategy {
+	case AuthStrategyAny, AuthStrategyAllowedGroup, AuthStrategyNone, AuthStrategyExternal:
+		return true
 	}
-	return strategy.Check(username, cmd)
-}
-
-type anyUserAllowed struct {
-}
-
-// Check implements Authorizer.Check
-func (a anyUserAllowed) Check(_ string, _ CommandAuthorization) error {
-	return nil
-}
-
-type noUserAllowed struct {
-}
-
-// Check implements Authorizer.Check
-func (a noUserAllowed) Check(_ string, _ CommandAuthorization) error {
-	return ErrUserNotAllowed
-}
-
-type userInGroupAllowed struct {
+	return false
 }
 
-func (a userInGroupAllowed) Check(username string, cmd CommandAuthorization) error {
-	for _, group := range cmd.AllowedGroups() {
-		err := groups.CheckUserInGroup(username, group)
-		switch err {
-		case nil:
-			log.Debugf("User %s found in group %s", username, group)
-			return nil
-		case ErrUserNotInGroup:
-			log.Debugf("User %s is not in group %s", username, group)
-		case ErrGroupNotFound:
-			log.Errorf("Could not found group %s", group)
-		default:
-			log.Errorf("Unexpected error %s", err)
-		}
+// Check checks if a request is allowed to run a command, returning nil when it
+// is, or the reason why it's not, see Explain for how the decision is taken
+func Check(req request.Request, cmd CommandAuthorization) error {
+	d := Explain(req, cmd)
+	if d.Allowed {
+		log.Debugf("User %s is allowed to run command %s by %s: %s", req.Username, req.Command, d.Rule, d.Reason)
+	} else {
+		log.Debugf("User %s is not allowed to run command %s by %s: %s", req.Username, req.Command, d.Rule, d.Reason)
 	}
-	return ErrUserNotAllowed
+	return d.Err()
 }
@@ -1,18 +1,29 @@
 package auth_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/commands"
 	"github.com/gomeeseeks/meeseeks-box/commands/shell"
+	"github.com/gomeeseeks/meeseeks-box/db"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
 )
 
 func Test_Auth(t *testing.T) {
-	auth.Configure(map[string][]string{
-		auth.AdminGroup: []string{"admin_user"},
-	})
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+		}))
+	}))
 	commands.Add("any", shell.New(shell.CommandOpts{
 		Cmd:          "any",
 		AuthStrategy: auth.AuthStrategyAny,
@@ -26,12 +37,53 @@ func Test_Auth(t *testing.T) {
 		AuthStrategy:  auth.AuthStrategyAllowedGroup,
 		AllowedGroups: []string{auth.AdminGroup},
 	}))
+	commands.Add("deploys", shell.New(shell.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyAny,
+		Channels: auth.ChannelRestrictions{
+			AllowedChannels: []string{"#deploys"},
+		},
+	}))
+	commands.Add("not-general", shell.New(shell.CommandOpts{
+		Cmd:          "any",
+		AuthStrategy: auth.AuthStrategyAny,
+		Channels: auth.ChannelRestrictions{
+			DeniedChannels: []string{"generalID"},
+		},
+	}))
+	commands.Add("im-only", shell.New(shell.CommandOpts{
+		Cmd:          "any",
+		AuthStrategy: auth.AuthStrategyAny,
+		Channels: auth.ChannelRestrictions{
+			IMOnly: true,
+		},
+	}))
+	commands.Add("channels-only", shell.New(shell.CommandOpts{
+		Cmd:          "any",
+		AuthStrategy: auth.AuthStrategyAny,
+		Channels: auth.ChannelRestrictions{
+			ChannelsOnly: true,
+		},
+	}))
+	prodRule, err := auth.NewArgRule([]string{"prod*"}, "", "", []string{auth.AdminGroup})
+	stubs.Must(t, "failed to build arg rule", err)
+	forceRule, err := auth.NewArgRule(nil, "--force", auth.AuthStrategyNone, nil)
+	stubs.Must(t, "failed to build arg rule", err)
+	commands.Add("release", shell.New(shell.CommandOpts{
+		Cmd:          "release",
+		AuthStrategy: auth.AuthStrategyAny,
+		ArgRules:     []auth.ArgRule{forceRule, prodRule},
+	}))
 
 	tt := []struct {
-		name     string
-		username string
-		cmd      string
-		expected error
+		name      string
+		username  string
+		channel   string
+		im        bool
+		noChannel bool
+		cmd       string
+		args      []string
+		expected  error
 	}{
 		{
 			name:     "any",
@@ -57,13 +109,135 @@ func Test_Auth(t *testing.T) {
 			cmd:      "admins",
 			expected: auth.ErrUserNotAllowed,
 		},
+		{
+			name:     "allowed channel",
+			username: "myself",
+			channel:  "deploys",
+			cmd:      "deploys",
+			expected: nil,
+		},
+		{
+			name:     "not allowed channel",
+			username: "myself",
+			channel:  "general",
+			cmd:      "deploys",
+			expected: auth.ErrChannelNotAllowed,
+		},
+		{
+			name:     "IM with allowed channels",
+			username: "myself",
+			im:       true,
+			cmd:      "deploys",
+			expected: auth.ErrChannelNotAllowed,
+		},
+		{
+			name:     "denied channel by ID",
+			username: "myself",
+			channel:  "general",
+			cmd:      "not-general",
+			expected: auth.ErrChannelNotAllowed,
+		},
+		{
+			name:     "not denied channel",
+			username: "myself",
+			channel:  "random",
+			cmd:      "not-general",
+			expected: nil,
+		},
+		{
+			name:     "IM only from a channel",
+			username: "myself",
+			channel:  "general",
+			cmd:      "im-only",
+			expected: auth.ErrIMOnly,
+		},
+		{
+			name:     "IM only from an IM",
+			username: "myself",
+			im:       true,
+			cmd:      "im-only",
+			expected: nil,
+		},
+		{
+			name:     "channels only from an IM",
+			username: "myself",
+			im:       true,
+			cmd:      "channels-only",
+			expected: auth.ErrChannelsOnly,
+		},
+		{
+			name:      "IM only from no channel",
+			username:  "myself",
+			noChannel: true,
+			cmd:       "im-only",
+			expected:  nil,
+		},
+		{
+			name:      "channels only from no channel",
+			username:  "myself",
+			noChannel: true,
+			cmd:       "channels-only",
+			expected:  auth.ErrChannelsOnly,
+		},
+		{
+			name:      "allowed channels from no channel",
+			username:  "myself",
+			noChannel: true,
+			cmd:       "deploys",
+			expected:  auth.ErrChannelNotAllowed,
+		},
+		{
+			name:      "denied channels from no channel",
+			username:  "myself",
+			noChannel: true,
+			cmd:       "not-general",
+			expected:  auth.ErrChannelNotAllowed,
+		},
+		{
+			name:     "arguments without matching rule",
+			username: "normal_user",
+			cmd:      "release",
+			args:     []string{"staging"},
+			expected: nil,
+		},
+		{
+			name:     "arguments matching a group rule",
+			username: "normal_user",
+			cmd:      "release",
+			args:     []string{"production", "v1"},
+			expected: auth.ErrUserNotAllowed,
+		},
+		{
+			name:     "arguments matching a group rule by an allowed user",
+			username: "admin_user",
+			cmd:      "release",
+			args:     []string{"production", "v1"},
+			expected: nil,
+		},
+		{
+			name:     "arguments matching a regex rule first",
+			username: "admin_user",
+			cmd:      "release",
+			args:     []string{"production", "--force"},
+			expected: auth.ErrUserNotAllowed,
+		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			cmd, ok := commands.Find(tc.cmd)
 			stubs.AssertEquals(t, true, ok)
-			if actual := auth.Check(tc.username, cmd); actual != tc.expected {
+			req := request.Request{
+				Command:   tc.cmd,
+				Args:      tc.args,
+				Username:  tc.username,
+				UserID:    tc.username,
+				Channel:   tc.channel,
+				ChannelID: tc.channel + "ID",
+				IsIM:      tc.im,
+				NoChannel: tc.noChannel,
+			}
+			if actual := auth.Check(req, cmd); actual != tc.expected {
 				t.Fatalf("Check failed with %s", actual)
 			}
 		})
@@ -71,16 +245,707 @@ func Test_Auth(t *testing.T) {
 }
 
 func Test_Groups(t *testing.T) {
-	auth.Configure(
-		map[string][]string{
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(
+			map[string][]string{
+				auth.AdminGroup: []string{"user1", "user2"},
+				"developer":     []string{"user1"},
+			},
+		))
+		stubs.AssertEquals(t,
+			map[string][]string{
+				"developer":     []string{"user1"},
+				auth.AdminGroup: []string{"user1", "user2"},
+			},
+			auth.GetGroups())
+	}))
+}
+
+func Test_GroupsAreOnlySeededOnce(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"user1"},
+		}))
+		stubs.Must(t, "failed to add user", auth.AddUsersToGroup("user1", auth.AdminGroup, "user2"))
+
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"user3"},
+		}))
+		stubs.AssertEquals(t, map[string][]string{
 			auth.AdminGroup: []string{"user1", "user2"},
-			"developer":     []string{"user1"},
+		}, auth.GetGroups())
+	}))
+}
+
+func Test_GroupsManagement(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+		}))
+
+		stubs.Must(t, "failed to create group", auth.CreateGroup("admin_user", "oncall"))
+		stubs.AssertEquals(t, auth.ErrGroupAlreadyExists, auth.CreateGroup("admin_user", "oncall"))
+
+		stubs.Must(t, "failed to add users", auth.AddUsersToGroup("admin_user", "oncall", "user1", "user2"))
+		stubs.Must(t, "failed to remove user", auth.RemoveUsersFromGroup("admin_user", "oncall", "user1"))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+			"oncall":        []string{"user2"},
+		}, auth.GetGroups())
+
+		stubs.AssertEquals(t, auth.ErrGroupNotFound, auth.AddUsersToGroup("admin_user", "unknown", "user1"))
+		stubs.AssertEquals(t, auth.ErrAdminGroupIsProtected, auth.DeleteGroup("admin_user", auth.AdminGroup))
+		stubs.AssertEquals(t, auth.ErrAdminGroupIsProtected,
+			auth.RemoveUsersFromGroup("admin_user", auth.AdminGroup, "admin_user"))
+
+		stubs.Must(t, "failed to delete group", auth.DeleteGroup("admin_user", "oncall"))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+		}, auth.GetGroups())
+
+		changes, err := auth.FindGroupChanges(10)
+		stubs.Must(t, "failed to find group changes", err)
+		actions := make([]string, 0)
+		for _, c := range changes {
+			actions = append(actions, fmt.Sprintf("%s %s %s %v", c.Username, c.Action, c.Group, c.Usernames))
+		}
+		stubs.AssertEquals(t, []string{
+			"admin_user deleted oncall []",
+			"admin_user removed oncall [user1]",
+			"admin_user added oncall [user1 user2]",
+			"admin_user created oncall []",
+			"configuration seeded admin [admin_user]",
+		}, actions)
+	}))
+}
+
+func Test_InvalidArgRules(t *testing.T) {
+	_, err := auth.NewArgRule([]string{"[prod"}, "", "", nil)
+	stubs.AssertMatches(t, "invalid argument pattern \\[prod: .*", err.Error())
+
+	_, err = auth.NewArgRule(nil, "(", "", nil)
+	stubs.AssertMatches(t, "invalid arguments regex \\(: .*", err.Error())
+
+	_, err = auth.NewArgRule(nil, "", "whatever", nil)
+	stubs.AssertEquals(t, "invalid auth strategy whatever", err.Error())
+}
+
+func Test_Policy(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+			"oncall":        []string{"oncall_user"},
+		}))
+	}))
+
+	mustRule := func(opts auth.RuleOpts) auth.Rule {
+		rule, err := auth.NewRule(opts)
+		stubs.Must(t, "failed to build rule", err)
+		return rule
+	}
+	auth.ConfigurePolicy([]auth.Rule{
+		mustRule(auth.RuleOpts{Name: "no deploys by bob", Effect: auth.EffectDeny, Users: []string{"bob"}, Commands: []string{"deploy*"}}),
+		mustRule(auth.RuleOpts{Effect: auth.EffectAllow, Groups: []string{"oncall"}, Commands: []string{"deploy"}, Channels: []string{"#ops"}}),
+		mustRule(auth.RuleOpts{Effect: auth.EffectDeny, Commands: []string{"deploy"}, Regex: "--force"}),
+		mustRule(auth.RuleOpts{Name: "no deploys in prod", Effect: auth.EffectDeny, Commands: []string{"deploy"}, Channels: []string{"#prod"}}),
+	})
+	defer auth.ConfigurePolicy(nil)
+
+	cmd := shell.New(shell.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyAny,
+	})
+
+	tt := []struct {
+		name      string
+		username  string
+		channel   string
+		noChannel bool
+		args      []string
+		rule      string
+		expected  error
+	}{
+		{
+			name:     "explicit deny",
+			username: "bob",
+			channel:  "ops",
+			rule:     "no deploys by bob",
+			expected: auth.ErrUserNotAllowed,
 		},
-	)
-	stubs.AssertEquals(t,
-		map[string][]string{
-			"developer":     []string{"user1"},
-			auth.AdminGroup: []string{"user1", "user2"},
+		{
+			name:     "allowed by a policy rule before a deny",
+			username: "oncall_user",
+			channel:  "ops",
+			args:     []string{"--force"},
+			rule:     "policy rule 2",
+			expected: nil,
+		},
+		{
+			name:     "denied by a policy rule",
+			username: "someone",
+			channel:  "general",
+			args:     []string{"prod", "--force"},
+			rule:     "policy rule 3",
+			expected: auth.ErrUserNotAllowed,
+		},
+		{
+			name:     "allowed by the command auth strategy",
+			username: "someone",
+			channel:  "general",
+			args:     []string{"prod"},
+			rule:     "command deploy auth strategy any",
+			expected: nil,
+		},
+		{
+			name:     "denied in a channel",
+			username: "someone",
+			channel:  "prod",
+			rule:     "no deploys in prod",
+			expected: auth.ErrUserNotAllowed,
+		},
+		{
+			name:      "denied in any channel from no channel",
+			username:  "oncall_user",
+			noChannel: true,
+			rule:      "no deploys in prod",
+			expected:  auth.ErrUserNotAllowed,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			d := auth.Explain(request.Request{
+				Command:   "deploy",
+				Args:      tc.args,
+				Username:  tc.username,
+				UserID:    tc.username,
+				Channel:   tc.channel,
+				NoChannel: tc.noChannel,
+			}, cmd)
+			stubs.AssertEquals(t, tc.rule, d.Rule)
+			stubs.AssertEquals(t, tc.expected, d.Err())
+			stubs.AssertEquals(t, tc.expected == nil, d.Allowed)
+		})
+	}
+}
+
+type adminOnlyCommand struct {
+	auth.CommandAuthorization
+}
+
+func (adminOnlyCommand) AdminOnly() bool {
+	return true
+}
+
+func Test_PolicyCanNotGrantAdminOnlyCommands(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+		}))
+		rule, err := auth.NewRule(auth.RuleOpts{Name: "allow everything", Effect: auth.EffectAllow})
+		stubs.Must(t, "failed to build rule", err)
+		auth.ConfigurePolicy([]auth.Rule{rule})
+		defer auth.ConfigurePolicy(nil)
+
+		cmd := adminOnlyCommand{shell.New(shell.CommandOpts{
+			Cmd:           "kill-job",
+			AuthStrategy:  auth.AuthStrategyAllowedGroup,
+			AllowedGroups: []string{auth.AdminGroup},
+		})}
+
+		d := auth.Explain(request.Request{Command: "kill-job", Username: "someone", UserID: "someone"}, cmd)
+		stubs.AssertEquals(t, "command kill-job is admin only", d.Rule)
+		stubs.AssertEquals(t, "user someone is not in group admin", d.Reason)
+		stubs.AssertEquals(t, auth.ErrUserNotAllowed, d.Err())
+
+		d = auth.Explain(request.Request{Command: "kill-job", Username: "admin_user", UserID: "admin_user"}, cmd)
+		stubs.AssertEquals(t, "allow everything", d.Rule)
+		stubs.AssertEquals(t, true, d.Allowed)
+	}))
+}
+
+func Test_PolicyDefaultDeny(t *testing.T) {
+	d := auth.Explain(request.Request{Command: "nobody", Username: "someone"}, shell.New(shell.CommandOpts{
+		Cmd:           "nobody",
+		AuthStrategy:  auth.AuthStrategyAllowedGroup,
+		AllowedGroups: []string{},
+	}))
+	stubs.AssertEquals(t, auth.DefaultDenyRule, d.Rule)
+	stubs.AssertEquals(t, auth.ErrUserNotAllowed, d.Err())
+
+	d = auth.Explain(request.Request{Command: "none", Username: "someone"}, shell.New(shell.CommandOpts{
+		Cmd:          "none",
+		AuthStrategy: "invalid",
+	}))
+	stubs.AssertEquals(t, auth.DefaultDenyRule, d.Rule)
+	stubs.AssertEquals(t, auth.ErrUserNotAllowed, d.Err())
+}
+
+func Test_InvalidPolicyRules(t *testing.T) {
+	_, err := auth.NewRule(auth.RuleOpts{Effect: "maybe"})
+	stubs.AssertEquals(t, "invalid rule effect \"maybe\", it should be either allow or deny", err.Error())
+
+	_, err = auth.NewRule(auth.RuleOpts{Effect: auth.EffectAllow, Commands: []string{"[deploy"}})
+	stubs.AssertMatches(t, "invalid command pattern \\[deploy: .*", err.Error())
+}
+
+func Test_NestedGroups(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user", "group:sre"},
+			"sre":           []string{"sre_user", "group:oncall"},
+			"oncall":        []string{"oncall_user"},
+		}))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"admin_user", "oncall_user", "sre_user"},
+			"sre":           []string{"oncall_user", "sre_user"},
+			"oncall":        []string{"oncall_user"},
+		}, auth.GetEffectiveGroups())
+
+		d := auth.Explain(request.Request{Command: "admins", UserID: "oncall_user"}, shell.New(shell.CommandOpts{
+			Cmd:           "admins",
+			AuthStrategy:  auth.AuthStrategyAllowedGroup,
+			AllowedGroups: []string{auth.AdminGroup},
+		}))
+		stubs.AssertEquals(t, true, d.Allowed)
+
+		err := auth.AddUsersToGroup("admin_user", "oncall", "group:admin")
+		stubs.AssertEquals(t, "Groups can't include themselves: admin -> sre -> oncall -> admin", err.Error())
+
+		err = auth.DeleteGroup("admin_user", "oncall")
+		stubs.AssertEquals(t, "group sre includes unknown group oncall", err.Error())
+	}))
+}
+
+func Test_InvalidNestedGroups(t *testing.T) {
+	tt := []struct {
+		name     string
+		groups   map[string][]string
+		expected string
+	}{
+		{
+			name: "cycle",
+			groups: map[string][]string{
+				auth.AdminGroup: []string{"admin_user", "group:sre"},
+				"sre":           []string{"group:oncall"},
+				"oncall":        []string{"group:sre"},
+			},
+			expected: "could not configure groups: Groups can't include themselves: sre -> oncall -> sre",
 		},
-		auth.GetGroups())
+		{
+			name: "self inclusion",
+			groups: map[string][]string{
+				auth.AdminGroup: []string{"admin_user", "group:admin"},
+			},
+			expected: "could not configure groups: Groups can't include themselves: admin -> admin",
+		},
+		{
+			name: "unknown group",
+			groups: map[string][]string{
+				auth.AdminGroup: []string{"admin_user", "group:sre"},
+			},
+			expected: "could not configure groups: group admin includes unknown group sre",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+				stubs.AssertEquals(t, tc.expected, auth.Configure(tc.groups).Error())
+			}))
+		})
+	}
+}
+
+func Test_UsersAreResolvedToIDs(t *testing.T) {
+	auth.SetUserResolver(stubs.UserResolverStub{
+		"alice": "U01",
+		"bob":   "U02",
+	})
+	defer auth.SetUserResolver(nil)
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"@alice", "<@U03|carol>", "U04"},
+		}))
+		stubs.Must(t, "failed to add users", auth.AddUsersToGroup("U01", auth.AdminGroup, "@bob"))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"U01", "U02", "U03", "U04"},
+		}, auth.GetGroups())
+
+		err := auth.AddUsersToGroup("U01", auth.AdminGroup, "@mallory")
+		stubs.AssertEquals(t, "could not resolve user mallory: user not found", err.Error())
+
+		rule, err := auth.NewRule(auth.RuleOpts{Effect: auth.EffectDeny, Users: []string{"@bob"}})
+		stubs.Must(t, "failed to build rule", err)
+		auth.ConfigurePolicy([]auth.Rule{rule})
+		defer auth.ConfigurePolicy(nil)
+
+		cmd := shell.New(shell.CommandOpts{
+			Cmd:           "admins",
+			AuthStrategy:  auth.AuthStrategyAllowedGroup,
+			AllowedGroups: []string{auth.AdminGroup},
+		})
+		stubs.AssertEquals(t, nil, auth.Check(request.Request{Command: "admins", Username: "bob", UserID: "U01"}, cmd))
+		stubs.AssertEquals(t, auth.ErrUserNotAllowed,
+			auth.Check(request.Request{Command: "admins", Username: "alice", UserID: "U02"}, cmd))
+		stubs.AssertEquals(t, auth.ErrUserNotAllowed,
+			auth.Check(request.Request{Command: "admins", Username: "alice", UserID: "U05"}, cmd))
+	}))
+}
+
+func Test_ConfiguredBareUserNamesAreResolvedToIDs(t *testing.T) {
+	auth.SetUserResolver(stubs.UserResolverStub{"pablo": "U01"})
+	defer auth.SetUserResolver(nil)
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"pablo", "U02", "group:sre"},
+			"sre":           []string{"W03"},
+		}))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"U01", "U02", "group:sre"},
+			"sre":           []string{"W03"},
+		}, auth.GetGroups())
+	}))
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		err := auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"mallory"},
+		})
+		stubs.AssertEquals(t, "could not configure groups: invalid group admin: "+
+			"could not resolve user mallory: user not found", err.Error())
+	}))
+}
+
+func Test_ManagedBareUserNamesAreResolvedToIDs(t *testing.T) {
+	auth.SetUserResolver(stubs.UserResolverStub{"pablo": "U01"})
+	defer auth.SetUserResolver(nil)
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"U01"},
+		}))
+		stubs.Must(t, "failed to create group", auth.CreateGroup("U01", "oncall"))
+
+		stubs.Must(t, "failed to add users", auth.AddUsersToGroup("U01", "oncall", "pablo", "U02"))
+		err := auth.AddUsersToGroup("U01", "oncall", "pabol")
+		stubs.AssertEquals(t, "could not resolve user pabol: user not found", err.Error())
+		stubs.Must(t, "failed to remove user", auth.RemoveUsersFromGroup("U01", "oncall", "pablo"))
+
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"U01"},
+			"oncall":        []string{"U02"},
+		}, auth.GetGroups())
+	}))
+}
+
+func Test_GroupMembersAreMigratedToIDs(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to store legacy groups", db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucket([]byte("groups"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(auth.AdminGroup), []byte(`["alice","U02","group:sre"]`))
+		}))
+		stubs.Must(t, "failed to store legacy groups", db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("groups")).Put([]byte("sre"), []byte(`["bob"]`))
+		}))
+
+		auth.SetUserResolver(stubs.UserResolverStub{"alice": "U01", "bob": "U03"})
+		defer auth.SetUserResolver(nil)
+
+		stubs.Must(t, "failed to configure groups", auth.Configure(nil))
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"U01", "U02", "group:sre"},
+			"sre":           []string{"U03"},
+		}, auth.GetGroups())
+	}))
+}
+
+func Test_ConfiguringGroupsByNameRequiresAResolver(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		err := auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"@alice"},
+		})
+		stubs.AssertEquals(t, "could not configure groups: invalid group admin: "+
+			"could not resolve user alice: no user resolver is configured", err.Error())
+	}))
+}
+
+func Test_Elevations(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+			"sre":           []string{"sre_user", "group:admin"},
+			"oncall":        []string{"oncall_user", "other_oncall_user"},
+			"dba":           []string{"dba_user"},
+		}))
+		stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+			auth.AdminGroup: {
+				Eligible:    []string{"group:oncall"},
+				MaxDuration: 2 * time.Hour,
+			},
+			"dba": {
+				Eligible:         []string{"group:oncall"},
+				RequiresApproval: true,
+			},
+		}))
+		defer auth.ConfigureElevations(nil)
+
+		_, err := auth.Elevate("sre_user", "sre_user", auth.AdminGroup, time.Hour, "incident")
+		stubs.AssertEquals(t, auth.ErrNotEligible, err)
+
+		_, err = auth.Elevate("oncall_user", "oncall_user", auth.AdminGroup, 3*time.Hour, "incident")
+		stubs.AssertEquals(t, "elevations to group admin should last more than 0s and up to 2h0m0s", err.Error())
+
+		_, err = auth.Elevate("oncall_user", "oncall_user", auth.AdminGroup, time.Hour, " ")
+		stubs.AssertEquals(t, "a reason is required to elevate", err.Error())
+
+		stubs.AssertEquals(t, false, inGroup("oncall_user", "sre"))
+		e, err := auth.Elevate("oncall_user", "oncall_user", auth.AdminGroup, time.Hour, "incident")
+		stubs.Must(t, "failed to elevate", err)
+		stubs.AssertEquals(t, false, e.IsPending())
+		stubs.AssertEquals(t, true, inGroup("oncall_user", auth.AdminGroup))
+		stubs.AssertEquals(t, true, inGroup("oncall_user", "sre"))
+		stubs.AssertEquals(t, 1, len(auth.GetActiveElevations()[auth.AdminGroup]))
+
+		e, err = auth.Elevate("oncall_user", "oncall_user", "dba", time.Minute, "slow queries")
+		stubs.Must(t, "failed to request elevation", err)
+		stubs.AssertEquals(t, true, e.IsPending())
+		stubs.AssertEquals(t, false, inGroup("oncall_user", "dba"))
+
+		_, err = auth.ApproveElevation("oncall_user", "oncall_user", e.ID)
+		stubs.AssertEquals(t, auth.ErrSelfApproval, err)
+		_, err = auth.ApproveElevation("other_oncall_user", "other_oncall_user", e.ID)
+		stubs.AssertEquals(t, auth.ErrNotApprover, err)
+		_, err = auth.ApproveElevation("dba_user", "dba_user", 42)
+		stubs.AssertEquals(t, auth.ErrElevationNotFound, err)
+
+		e, err = auth.ApproveElevation("dba_user", "dba", e.ID)
+		stubs.Must(t, "failed to approve elevation", err)
+		stubs.AssertEquals(t, "dba", e.ApprovedBy)
+		stubs.AssertEquals(t, true, inGroup("oncall_user", "dba"))
+
+		_, err = auth.ApproveElevation("dba_user", "dba_user", e.ID)
+		stubs.AssertEquals(t, auth.ErrElevationNotPending, err)
+
+		e, err = auth.Elevate("other_oncall_user", "other_oncall_user", "dba", time.Minute, "slow queries")
+		stubs.Must(t, "failed to request elevation", err)
+		_, err = auth.ApproveElevation("oncall_user", "oncall_user", e.ID)
+		stubs.AssertEquals(t, auth.ErrNotApprover, err)
+		_, err = auth.ApproveElevation("dba_user", "dba", e.ID)
+		stubs.Must(t, "failed to approve elevation", err)
+
+		stubs.Must(t, "failed to reload elevations", auth.ConfigureElevations(nil))
+		stubs.AssertEquals(t, true, inGroup("oncall_user", "dba"))
+
+		changes, err := auth.FindGroupChanges(3)
+		stubs.Must(t, "failed to list group changes", err)
+		stubs.AssertEquals(t, []string{auth.UserElevated, auth.ElevationRequested, auth.UserElevated},
+			[]string{changes[0].Action, changes[1].Action, changes[2].Action})
+		stubs.AssertEquals(t, "dba_user", changes[0].Username)
+	}))
+}
+
+func Test_InvalidElevations(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+		}))
+		err := auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+			"unknown": {Eligible: []string{"admin_user"}},
+		})
+		stubs.AssertEquals(t, "invalid elevation to group unknown: Groups does not exists", err.Error())
+	}))
+}
+
+func inGroup(userID, group string) bool {
+	return auth.Explain(request.Request{Command: "cmd", UserID: userID}, shell.New(shell.CommandOpts{
+		Cmd:           "cmd",
+		AuthStrategy:  auth.AuthStrategyAllowedGroup,
+		AllowedGroups: []string{group},
+	})).Allowed
+}
+
+func Test_ExternalAuthorization(t *testing.T) {
+	var requests int
+	var lastInput auth.ExternalInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body := struct {
+			Input auth.ExternalInput `json:"input"`
+		}{}
+		stubs.Must(t, "could not decode decision request", json.NewDecoder(r.Body).Decode(&body))
+		lastInput = body.Input
+
+		switch body.Input.Command {
+		case "allowed":
+			fmt.Fprint(w, `{"result": true}`)
+		case "denied":
+			fmt.Fprint(w, `{"result": {"allowed": false, "reason": "not on call"}}`)
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, `{"result": true}`)
+		case "huge":
+			fmt.Fprintf(w, `{"result": true, "padding": %q}`, strings.Repeat("x", 1<<20))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	externalCommand := func(name string) auth.CommandAuthorization {
+		return shell.New(shell.CommandOpts{
+			Cmd:          name,
+			AuthStrategy: auth.AuthStrategyExternal,
+		})
+	}
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+			"oncall":        []string{"user_one"},
+		}))
+		stubs.Must(t, "failed to configure external authorization", auth.ConfigureExternal(auth.ExternalConfig{
+			URL:      server.URL,
+			Timeout:  50 * time.Millisecond,
+			CacheTTL: time.Minute,
+		}))
+		defer auth.ConfigureExternal(auth.ExternalConfig{})
+
+		req := request.Request{Command: "allowed", UserID: "user_one", Username: "one", Channel: "general", Args: []string{"arg"}}
+		d := auth.Explain(req, externalCommand("allowed"))
+		stubs.AssertEquals(t, true, d.Allowed)
+		stubs.AssertEquals(t, "external authorization allowed the request: no reason given", d.Reason)
+		stubs.AssertEquals(t, auth.ExternalInput{
+			User:    "one",
+			UserID:  "user_one",
+			Groups:  []string{"oncall"},
+			Channel: "general",
+			Command: "allowed",
+			Args:    []string{"arg"},
+		}, lastInput)
+
+		d = auth.Explain(req, externalCommand("allowed"))
+		stubs.AssertEquals(t, true, d.Allowed)
+		stubs.AssertEquals(t, 1, requests)
+
+		req.Command = "denied"
+		d = auth.Explain(req, externalCommand("denied"))
+		stubs.AssertEquals(t, false, d.Allowed)
+		stubs.AssertEquals(t, "external authorization denied the request: not on call",
+			d.Trace[0].Reason)
+
+		for _, command := range []string{"failing", "slow", "huge"} {
+			req.Command = command
+			d = auth.Explain(req, externalCommand(command))
+			stubs.AssertEquals(t, false, d.Allowed)
+			stubs.AssertEquals(t, auth.DefaultDenyRule, d.Rule)
+			stubs.AssertMatches(t, "^external authorization failed: ", d.Trace[0].Reason)
+		}
+
+		stubs.Must(t, "failed to configure external authorization", auth.ConfigureExternal(auth.ExternalConfig{}))
+		req.Command = "allowed"
+		d = auth.Explain(req, externalCommand("allowed"))
+		stubs.AssertEquals(t, false, d.Allowed)
+		stubs.AssertEquals(t, "external authorization failed: external authorization endpoint is not configured",
+			d.Trace[0].Reason)
+	}))
+}
+
+func Test_InvalidExternalAuthorization(t *testing.T) {
+	err := auth.ConfigureExternal(auth.ExternalConfig{URL: "unix:///var/run/opa.sock"})
+	stubs.AssertEquals(t, "invalid external authorization url unix:///var/run/opa.sock: scheme should be http or https",
+		err.Error())
+}
+
+type groupProviderStub struct {
+	groups map[string][]string
+	err    error
+}
+
+func (p *groupProviderStub) Name() string {
+	return "stub"
+}
+
+func (p *groupProviderStub) Groups() (map[string][]string, error) {
+	return p.groups, p.err
+}
+
+func Test_GroupProviders(t *testing.T) {
+	provider := &groupProviderStub{
+		groups: map[string][]string{
+			"sre":           []string{"sre_user", "offboarded_user"},
+			auth.AdminGroup: []string{"directory_admin"},
+		},
+	}
+	stubs.Must(t, "failed to configure group providers", auth.ConfigureGroupProviders(auth.RefreshedGroupProvider{GroupProvider: provider}))
+	defer auth.ConfigureGroupProviders()
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: []string{"admin_user"},
+			"oncall":        []string{"oncall_user", "group:sre"},
+		}))
+
+		stubs.AssertEquals(t, map[string][]string{
+			auth.AdminGroup: []string{"admin_user", "directory_admin"},
+			"oncall":        []string{"group:sre", "oncall_user"},
+			"sre":           []string{"offboarded_user", "sre_user"},
+		}, auth.GetGroups())
+		stubs.AssertEquals(t, true, inGroup("offboarded_user", "oncall"))
+		stubs.AssertEquals(t, true, inGroup("directory_admin", auth.AdminGroup))
+
+		stubs.AssertEquals(t, auth.ErrGroupNotFound, auth.AddUsersToGroup("admin_user", "sre", "someone"))
+
+		provider.groups = map[string][]string{
+			"sre": []string{"sre_user"},
+		}
+		auth.RefreshGroupProviders()
+		stubs.AssertEquals(t, false, inGroup("offboarded_user", "oncall"))
+		stubs.AssertEquals(t, false, inGroup("directory_admin", auth.AdminGroup))
+
+		provider.err = fmt.Errorf("directory is down")
+		provider.groups = nil
+		auth.RefreshGroupProviders()
+		stubs.AssertEquals(t, true, inGroup("sre_user", "sre"))
+	}))
+
+	err := auth.ConfigureGroupProviders(auth.RefreshedGroupProvider{GroupProvider: provider})
+	stubs.AssertEquals(t, "could not load groups from provider stub: directory is down", err.Error())
+}
+
+func Test_UserGroupsProvider(t *testing.T) {
+	resolver := stubs.UserGroupResolverStub{
+		UserGroups: map[string][]string{
+			"sre": []string{"U01", "U02"},
+		},
+	}
+	auth.SetUserResolver(resolver)
+	defer auth.SetUserResolver(nil)
+
+	provider := auth.NewUserGroupsProvider(map[string]string{"sre": "@sre"})
+	stubs.Must(t, "failed to configure group providers", auth.ConfigureGroupProviders(
+		auth.RefreshedGroupProvider{GroupProvider: provider, Refresh: time.Hour}))
+	defer auth.ConfigureGroupProviders()
+
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure groups", auth.Configure(map[string][]string{
+			"sre": []string{"U03"},
+		}))
+
+		stubs.AssertEquals(t, []string{"U01", "U02", "U03"}, auth.GetGroups()["sre"])
+
+		resolver.UserGroups["sre"] = []string{"U02"}
+		auth.RefreshGroupProviders()
+		stubs.AssertEquals(t, false, inGroup("U01", "sre"))
+		stubs.AssertEquals(t, true, inGroup("U03", "sre"))
+	}))
+
+	err := auth.ConfigureGroupProviders(auth.RefreshedGroupProvider{
+		GroupProvider: auth.NewUserGroupsProvider(map[string]string{"dba": "@dba"})})
+	stubs.AssertEquals(t, "could not load groups from provider chat user groups: "+
+		"could not get members of user group @dba for group dba: user group @dba not found", err.Error())
 }
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+)
+
+// ChannelRestrictions determine from where a command can be requested
+//
+// Channels can be referenced by name, with or without the leading #, or by ID.
+type ChannelRestrictions struct {
+	// AllowedChannels is the list of the only channels in which the command can
+	// be requested, when it's not empty IM conversations are not allowed
+	AllowedChannels []string
+	// DeniedChannels is a list of channels in which the command can't be requested
+	DeniedChannels []string
+	// IMOnly only allows requesting the command over an IM conversation
+	IMOnly bool
+	// ChannelsOnly does not allow requesting the command over an IM conversation
+	ChannelsOnly bool
+}
+
+// Check returns nil if the request comes from an allowed channel, else, an error
+//
+// Requests sent from no channel are only seen by the caller, so they can use
+// the IM only commands, but they are never in an allowed channel and they are
+// considered to be in any denied one.
+func (c ChannelRestrictions) Check(req request.Request) error {
+	if c.IMOnly && !req.IsIM && !req.NoChannel {
+		return ErrIMOnly
+	}
+	if c.ChannelsOnly && (req.IsIM || req.NoChannel) {
+		return ErrChannelsOnly
+	}
+	if len(c.DeniedChannels) > 0 && (req.NoChannel || matchesChannel(c.DeniedChannels, req)) {
+		return ErrChannelNotAllowed
+	}
+	if len(c.AllowedChannels) > 0 && (req.IsIM || req.NoChannel || !matchesChannel(c.AllowedChannels, req)) {
+		return ErrChannelNotAllowed
+	}
+	return nil
+}
+
+func matchesChannel(channels []string, req request.Request) bool {
+	for _, channel := range channels {
+		channel = strings.TrimPrefix(channel, "#")
+		if channel == req.Channel || channel == req.ChannelID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
+	log "github.com/sirupsen/logrus"
+)
+
+var elevationsBucketKey = []byte("elevations")
+
+// DefaultMaxElevation is the longest an elevation can last when the group does
+// not configure it
+const DefaultMaxElevation = time.Hour
+
+// Elevation audit actions
+const (
+	ElevationRequested = "requested elevation to"
+	UserElevated       = "elevated"
+)
+
+// Elevation errors
+var (
+	ErrNotEligible         = errors.New("User is not eligible for elevation to this group")
+	ErrElevationNotFound   = errors.New("Elevation could not be found")
+	ErrElevationNotPending = errors.New("Elevation is not pending approval")
+	ErrSelfApproval        = errors.New("Elevations can't be approved by the user that requested them")
+	ErrNotApprover         = errors.New("User can't approve elevations to this group")
+)
+
+// ElevationPolicy determines who can be temporarily elevated into a group
+type ElevationPolicy struct {
+	// Eligible are the users and groups, as in group:oncall, that can request
+	// an elevation
+	Eligible []string
+	// MaxDuration is the longest an elevation can last
+	MaxDuration time.Duration
+	// RequiresApproval makes elevations wait for a second person approval
+	RequiresApproval bool
+	// Approvers are the users and groups that can approve elevations, when it
+	// is empty any member of the group can approve them
+	//
+	// Only permanent members count, users that are elevated to a group can't
+	// approve elevations on its behalf.
+	Approvers []string
+}
+
+func (p ElevationPolicy) canApprove(userID, group string) bool {
+	if len(p.Approvers) == 0 {
+		return groups.checkPermanentMember(userID, group) == nil
+	}
+	return isMember(p.Approvers, userID, groups.checkPermanentMember)
+}
+
+// Elevation is a temporary membership of a group
+//
+// Elevations that require approval are pending until they are approved, and
+// they start counting their duration from then. Pending elevations that are
+// not approved within their duration expire.
+type Elevation struct {
+	ID          uint64        `json:"ID"`
+	UserID      string        `json:"UserID"`
+	Username    string        `json:"Username"`
+	Group       string        `json:"Group"`
+	Reason      string        `json:"Reason"`
+	Duration    time.Duration `json:"Duration"`
+	RequestedAt time.Time     `json:"RequestedAt"`
+	ApprovedBy  string        `json:"ApprovedBy"`
+	ExpiresAt   time.Time     `json:"ExpiresAt"`
+}
+
+// IsPending returns true when the elevation is waiting for approval
+func (e Elevation) IsPending() bool {
+	return e.ExpiresAt.IsZero()
+}
+
+// IsActive returns true when the elevation currently grants the membership
+func (e Elevation) IsActive(now time.Time) bool {
+	return !e.IsPending() && now.Before(e.ExpiresAt)
+}
+
+func (e Elevation) isExpired(now time.Time) bool {
+	if e.IsPending() {
+		return !now.Before(e.RequestedAt.Add(e.Duration))
+	}
+	return !now.Before(e.ExpiresAt)
+}
+
+type elevationsState struct {
+	policies   map[string]ElevationPolicy
+	elevations map[uint64]Elevation
+	notify     func(string)
+	m          sync.RWMutex
+}
+
+var elevations = &elevationsState{
+	policies:   map[string]ElevationPolicy{},
+	elevations: map[uint64]Elevation{},
+	notify:     func(string) {},
+}
+
+// ConfigureElevations sets the elevation policies per group and loads the
+// elevations that are still pending or active from the database
+func ConfigureElevations(policies map[string]ElevationPolicy) error {
+	configuredGroups := GetGroups()
+	resolved := make(map[string]ElevationPolicy, len(policies))
+	for group, policy := range policies {
+		if _, ok := configuredGroups[group]; !ok {
+			return fmt.Errorf("invalid elevation to group %s: %s", group, ErrGroupNotFound)
+		}
+		eligible, err := resolveMembers(policy.Eligible)
+		if err != nil {
+			return fmt.Errorf("invalid elevation to group %s: %s", group, err)
+		}
+		approvers, err := resolveMembers(policy.Approvers)
+		if err != nil {
+			return fmt.Errorf("invalid elevation to group %s: %s", group, err)
+		}
+		if policy.MaxDuration <= 0 {
+			policy.MaxDuration = DefaultMaxElevation
+		}
+		policy.Eligible, policy.Approvers = eligible, approvers
+		resolved[group] = policy
+	}
+
+	now := time.Now().UTC()
+	current := make(map[uint64]Elevation)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(elevationsBucketKey)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, payload []byte) error {
+			e := Elevation{}
+			if err := json.Unmarshal(payload, &e); err != nil {
+				return fmt.Errorf("could not load elevation: %s", err)
+			}
+			if !e.isExpired(now) {
+				current[e.ID] = e
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("could not configure elevations: %s", err)
+	}
+
+	elevations.m.Lock()
+	defer elevations.m.Unlock()
+
+	elevations.policies = resolved
+	elevations.elevations = current
+	return nil
+}
+
+// prune drops the expired elevations, which are kept in the database for the
+// record, it has to be called holding the lock
+func (s *elevationsState) prune(now time.Time) {
+	for id, e := range s.elevations {
+		if e.isExpired(now) {
+			delete(s.elevations, id)
+		}
+	}
+}
+
+// SetElevationNotifier sets the function used to announce elevations
+func SetElevationNotifier(notify func(message string)) {
+	elevations.m.Lock()
+	defer elevations.m.Unlock()
+
+	if notify == nil {
+		notify = func(string) {}
+	}
+	elevations.notify = notify
+}
+
+// Elevate requests a temporary membership of a group for the user, which is
+// granted right away unless the group requires approval
+func Elevate(userID, username, group string, d time.Duration, reason string) (Elevation, error) {
+	elevations.m.RLock()
+	policy, ok := elevations.policies[group]
+	elevations.m.RUnlock()
+
+	if !ok || !isMember(policy.Eligible, userID, groups.CheckUserInGroup) {
+		return Elevation{}, ErrNotEligible
+	}
+	if d <= 0 || d > policy.MaxDuration {
+		return Elevation{}, fmt.Errorf("elevations to group %s should last more than 0s and up to %s",
+			group, policy.MaxDuration)
+	}
+	if strings.TrimSpace(reason) == "" {
+		return Elevation{}, fmt.Errorf("a reason is required to elevate")
+	}
+
+	now := time.Now().UTC()
+	e := Elevation{
+		UserID:      userID,
+		Username:    username,
+		Group:       group,
+		Reason:      reason,
+		Duration:    d,
+		RequestedAt: now,
+	}
+	action := ElevationRequested
+	if !policy.RequiresApproval {
+		e.ExpiresAt = now.Add(d)
+		action = UserElevated
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		id, bucket, err := db.NextSequenceFor(elevationsBucketKey, tx)
+		if err != nil {
+			return fmt.Errorf("could not get next sequence for elevations: %s", err)
+		}
+		e.ID = id
+		if err = saveElevation(bucket, e); err != nil {
+			return err
+		}
+		return recordChange(tx, userID, action, group, userID)
+	})
+	if err != nil {
+		return Elevation{}, fmt.Errorf("could not elevate to group %s: %s", group, err)
+	}
+
+	elevations.m.Lock()
+	elevations.prune(now)
+	elevations.elevations[e.ID] = e
+	notify := elevations.notify
+	elevations.m.Unlock()
+
+	if e.IsPending() {
+		log.Infof("User %s requested elevation %d to group %s for %s: %s", username, e.ID, group, d, reason)
+		notify(fmt.Sprintf("*%s* requested elevation *%d* to group *%s* for %s: %s",
+			username, e.ID, group, d, reason))
+	} else {
+		log.Infof("User %s elevated to group %s for %s: %s", username, group, d, reason)
+		notify(fmt.Sprintf("*%s* has been elevated to group *%s* for %s: %s",
+			username, group, d, reason))
+	}
+	return e, nil
+}
+
+// ApproveElevation approves a pending elevation, which can't be approved by
+// the user that requested it
+func ApproveElevation(approverID, approverName string, id uint64) (Elevation, error) {
+	now := time.Now().UTC()
+
+	elevations.m.RLock()
+	e, ok := elevations.elevations[id]
+	policy := elevations.policies[e.Group]
+	elevations.m.RUnlock()
+
+	if !ok || e.isExpired(now) {
+		return Elevation{}, ErrElevationNotFound
+	}
+	if !e.IsPending() {
+		return Elevation{}, ErrElevationNotPending
+	}
+	if e.UserID == approverID {
+		return Elevation{}, ErrSelfApproval
+	}
+	if !policy.canApprove(approverID, e.Group) {
+		return Elevation{}, ErrNotApprover
+	}
+
+	e.ApprovedBy = approverName
+	e.ExpiresAt = now.Add(e.Duration)
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(elevationsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get elevations bucket: %s", err)
+		}
+		if err = saveElevation(bucket, e); err != nil {
+			return err
+		}
+		return recordChange(tx, approverID, UserElevated, e.Group, e.UserID)
+	})
+	if err != nil {
+		return Elevation{}, fmt.Errorf("could not approve elevation %d: %s", id, err)
+	}
+
+	elevations.m.Lock()
+	elevations.prune(now)
+	elevations.elevations[e.ID] = e
+	notify := elevations.notify
+	elevations.m.Unlock()
+
+	log.Infof("User %s approved elevation %d of user %s to group %s", approverName, id, e.Username, e.Group)
+	notify(fmt.Sprintf("*%s* has been elevated to group *%s* for %s, approved by *%s*: %s",
+		e.Username, e.Group, e.Duration, approverName, e.Reason))
+	return e, nil
+}
+
+// GetActiveElevations returns the elevations that are currently active by group
+func GetActiveElevations() map[string][]Elevation {
+	now := time.Now().UTC()
+
+	elevations.m.RLock()
+	defer elevations.m.RUnlock()
+
+	active := make(map[string][]Elevation)
+	for _, e := range elevations.elevations {
+		if e.IsActive(now) {
+			active[e.Group] = append(active[e.Group], e)
+		}
+	}
+	for _, es := range active {
+		sort.Slice(es, func(i, j int) bool { return es[i].ID < es[j].ID })
+	}
+	return active
+}
+
+// elevatedGroups returns the groups the user is currently elevated to
+func elevatedGroups(userID string) []string {
+	now := time.Now().UTC()
+
+	elevations.m.RLock()
+	defer elevations.m.RUnlock()
+
+	elevated := make([]string, 0)
+	for _, e := range elevations.elevations {
+		if e.UserID == userID && e.IsActive(now) {
+			elevated = append(elevated, e.Group)
+		}
+	}
+	return elevated
+}
+
+// isMember returns true when the user ID is one of the members or belongs to
+// any of the groups among them, as checked by inGroup
+func isMember(members []string, userID string, inGroup func(userID, group string) error) bool {
+	for _, member := range members {
+		if strings.HasPrefix(member, GroupMemberPrefix) {
+			if inGroup(userID, strings.TrimPrefix(member, GroupMemberPrefix)) == nil {
+				return true
+			}
+		} else if member == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func saveElevation(bucket *bolt.Bucket, e Elevation) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal elevation: %s", err)
+	}
+	return bucket.Put(db.IDToBytes(e.ID), payload)
+}
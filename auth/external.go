@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults for the external authorization
+const (
+	DefaultExternalTimeout  = 2 * time.Second
+	DefaultExternalCacheTTL = 30 * time.Second
+)
+
+// maxCachedDecisions bounds the decisions cache, decisions are not cached when
+// it's full of unexpired ones
+const maxCachedDecisions = 1000
+
+// maxDecisionSize is the largest decision read from the external endpoint
+const maxDecisionSize = 1 << 20
+
+// ErrExternalNotConfigured is returned when a command uses the external auth
+// strategy but there is no decision endpoint configured
+var ErrExternalNotConfigured = errors.New("external authorization endpoint is not configured")
+
+// ExternalConfig configures the endpoint that takes the decisions for the
+// commands that use the external auth strategy
+type ExternalConfig struct {
+	URL      string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+// ExternalInput is the decision request sent to the external endpoint
+//
+// It is posted wrapped as {"input": {...}}, and the endpoint is expected to
+// reply with {"result": true} or {"result": {"allowed": true, "reason": "..."}},
+// which is the shape used by the OPA data API.
+type ExternalInput struct {
+	User    string   `json:"user"`
+	UserID  string   `json:"user_id"`
+	Groups  []string `json:"groups"`
+	Channel string   `json:"channel"`
+	IsIM    bool     `json:"is_im"`
+	// NoChannel is set when the request is not sent from any channel or IM
+	NoChannel bool     `json:"no_channel"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+}
+
+// ExternalDecision is the decision taken by the external endpoint
+type ExternalDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+type externalDecider struct {
+	config ExternalConfig
+	client *http.Client
+
+	cache map[string]cachedDecision
+	m     sync.Mutex
+}
+
+type cachedDecision struct {
+	decision  ExternalDecision
+	expiresAt time.Time
+}
+
+var external = &externalDecider{
+	cache: map[string]cachedDecision{},
+}
+
+// ConfigureExternal sets the external authorization endpoint, applying the
+// default timeout when it's not set, and flushes the decisions cache
+//
+// A negative cache TTL disables the cache.
+func ConfigureExternal(c ExternalConfig) error {
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return fmt.Errorf("invalid external authorization url %s: %s", c.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid external authorization url %s: scheme should be http or https", c.URL)
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultExternalTimeout
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = DefaultExternalCacheTTL
+	}
+
+	external.m.Lock()
+	defer external.m.Unlock()
+
+	external.config = c
+	external.client = &http.Client{Timeout: c.Timeout}
+	external.cache = map[string]cachedDecision{}
+	return nil
+}
+
+// decide asks the external endpoint whether the request is allowed, any
+// failure to get an answer is returned as an error so the request is denied
+func (e *externalDecider) decide(req request.Request) (ExternalDecision, error) {
+	e.m.Lock()
+	config, client := e.config, e.client
+	e.m.Unlock()
+
+	if config.URL == "" {
+		return ExternalDecision{}, ErrExternalNotConfigured
+	}
+
+	input := ExternalInput{
+		User:      req.Username,
+		UserID:    req.UserID,
+		Groups:    userGroups(req.UserID),
+		Channel:   req.Channel,
+		IsIM:      req.IsIM,
+		NoChannel: req.NoChannel,
+		Command:   req.Command,
+		Args:      req.Args,
+	}
+	if input.Args == nil {
+		input.Args = []string{}
+	}
+	payload, err := json.Marshal(map[string]ExternalInput{"input": input})
+	if err != nil {
+		return ExternalDecision{}, fmt.Errorf("could not marshal decision request: %s", err)
+	}
+
+	key := string(payload)
+	now := time.Now()
+	if d, ok := e.cached(key, now); ok {
+		return d, nil
+	}
+
+	resp, err := client.Post(config.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return ExternalDecision{}, fmt.Errorf("decision request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDecisionSize+1))
+	if err != nil {
+		return ExternalDecision{}, fmt.Errorf("could not read decision: %s", err)
+	}
+	if len(body) > maxDecisionSize {
+		return ExternalDecision{}, fmt.Errorf("decision is larger than %d bytes", maxDecisionSize)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ExternalDecision{}, fmt.Errorf("decision endpoint replied with status %d", resp.StatusCode)
+	}
+	d, err := parseExternalDecision(body)
+	if err != nil {
+		return ExternalDecision{}, err
+	}
+
+	if config.CacheTTL > 0 {
+		e.store(key, cachedDecision{decision: d, expiresAt: now.Add(config.CacheTTL)}, now)
+	}
+	return d, nil
+}
+
+// store caches a decision, sweeping the expired ones when the cache is full
+func (e *externalDecider) store(key string, c cachedDecision, now time.Time) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if len(e.cache) >= maxCachedDecisions {
+		for k, cached := range e.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(e.cache, k)
+			}
+		}
+	}
+	if len(e.cache) >= maxCachedDecisions {
+		log.Debugf("External decisions cache is full, not caching decision")
+		return
+	}
+	e.cache[key] = c
+}
+
+func (e *externalDecider) cached(key string, now time.Time) (ExternalDecision, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	c, ok := e.cache[key]
+	if !ok {
+		return ExternalDecision{}, false
+	}
+	if !now.Before(c.expiresAt) {
+		delete(e.cache, key)
+		return ExternalDecision{}, false
+	}
+	return c.decision, true
+}
+
+func parseExternalDecision(body []byte) (ExternalDecision, error) {
+	r := struct {
+		Result *json.RawMessage `json:"result"`
+	}{}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return ExternalDecision{}, fmt.Errorf("could not parse decision: %s", err)
+	}
+	if r.Result == nil {
+		return ExternalDecision{}, fmt.Errorf("decision has no result")
+	}
+
+	allowed := false
+	if err := json.Unmarshal(*r.Result, &allowed); err == nil {
+		return ExternalDecision{Allowed: allowed}, nil
+	}
+	d := ExternalDecision{}
+	if err := json.Unmarshal(*r.Result, &d); err != nil {
+		return ExternalDecision{}, fmt.Errorf("could not parse decision result: %s", err)
+	}
+	return d, nil
+}
+
+// userGroups returns the sorted names of all the groups the user belongs to
+func userGroups(userID string) []string {
+	names := make([]string, 0)
+	for group := range GetGroups() {
+		if groups.CheckUserInGroup(userID, group) == nil {
+			names = append(names, group)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchExternal matches the requests allowed by the external endpoint
+func matchExternal(req request.Request) (bool, string) {
+	d, err := external.decide(req)
+	if err != nil {
+		log.Errorf("External authorization of command %s for user %s failed, denying it: %s",
+			req.Command, who(req), err)
+		return false, fmt.Sprintf("external authorization failed: %s", err)
+	}
+	reason := d.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+	if !d.Allowed {
+		return false, fmt.Sprintf("external authorization denied the request: %s", reason)
+	}
+	return true, fmt.Sprintf("external authorization allowed the request: %s", reason)
+}
@@ -1,64 +1,560 @@
 package auth
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
+	log "github.com/sirupsen/logrus"
 )
 
+var groupsBucketKey = []byte("groups")
+
+// groupsUserIDsMigration translates the user names stored as group members
+// into user IDs
+const groupsUserIDsMigration = "groups-user-ids"
+
+// GroupMemberPrefix is used to include all the members of a group in another
+// group, as in "group:oncall"
+const GroupMemberPrefix = "group:"
+
 // Groups is used to keep configured groups
+//
+// Groups can include other groups as members, users then belong to a group when
+// they are a direct member of it or of any of the groups it includes.
 type Groups struct {
 	groups map[string]map[string]bool
+	m      sync.RWMutex
 }
 
-var groups *Groups
+var groups = &Groups{
+	groups: map[string]map[string]bool{},
+}
 
 // Errors
 var (
-	ErrGroupNotFound  = fmt.Errorf("Groups does not exists")
-	ErrUserNotInGroup = fmt.Errorf("User does not belong to group")
+	ErrGroupNotFound         = fmt.Errorf("Groups does not exists")
+	ErrUserNotInGroup        = fmt.Errorf("User does not belong to group")
+	ErrGroupAlreadyExists    = fmt.Errorf("Group already exists")
+	ErrUserAlreadyInGroup    = fmt.Errorf("User already belongs to group")
+	ErrAdminGroupIsProtected = fmt.Errorf("The admin group can't be deleted or left without users")
+	ErrGroupCycle            = fmt.Errorf("Groups can't include themselves")
 )
 
-// Configure loads all the configured groups
+// ConfiguredBy is the name used in the audit trail for changes that come from
+// the configuration file
+const ConfiguredBy = "configuration"
+
+// Configure loads the groups from the database
 //
-// This should go away the moment we start storing groups in some storage
-func Configure(configuredGroups map[string][]string) {
-	g := Groups{
+// The configured groups are only used to seed the database the first time,
+// from then on groups are managed with the group builtin commands and a warning
+// is logged when the configured groups differ from the stored ones. Group
+// members are user IDs, users configured by name are resolved on seeding, and
+// seeding fails when any of them can't be found.
+func Configure(configuredGroups map[string][]string) error {
+	g := &Groups{
 		groups: map[string]map[string]bool{},
 	}
 
-	for name, users := range configuredGroups {
-		group := make(map[string]bool)
-		for _, user := range users {
-			group[user] = true
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(groupsBucketKey)
+		if bucket != nil {
+			err := db.Migrate(tx, groupsUserIDsMigration, func() error {
+				return migrateMembersToIDs(bucket)
+			})
+			if err != nil {
+				return err
+			}
+			err = bucket.ForEach(func(name, payload []byte) error {
+				users := make([]string, 0)
+				if err := json.Unmarshal(payload, &users); err != nil {
+					return fmt.Errorf("could not load group %s: %s", name, err)
+				}
+				g.groups[string(name)] = toSet(users)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if differ := g.differingGroups(configuredGroups); len(differ) > 0 {
+				log.Warnf("Configured groups %s differ from the ones stored in the database, "+
+					"the stored ones are used, change them with the group commands", strings.Join(differ, ", "))
+			} else {
+				log.Info("Loading groups from the database")
+			}
+			return g.validate()
+		}
+
+		log.Info("Seeding groups in the database from the configuration")
+		bucket, err := tx.CreateBucket(groupsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not create groups bucket: %s", err)
+		}
+		for name, members := range configuredGroups {
+			users, err := resolveBareMembers(members)
+			if err != nil {
+				return fmt.Errorf("invalid group %s: %s", name, err)
+			}
+			g.groups[name] = toSet(users)
+			if err := saveGroup(bucket, name, g.groups[name]); err != nil {
+				return err
+			}
+			if err := recordChange(tx, ConfiguredBy, GroupSeeded, name, users...); err != nil {
+				return err
+			}
 		}
-		g.groups[name] = group
+		if err := db.Migrate(tx, groupsUserIDsMigration, func() error { return nil }); err != nil {
+			return err
+		}
+		return g.validate()
+	})
+	if err != nil {
+		return fmt.Errorf("could not configure groups: %s", err)
 	}
 
-	groups = &g
+	groups = g
+	return nil
 }
 
-// CheckUserInGroup returns nil if the user belongs to the given group, else, an error
-func (g *Groups) CheckUserInGroup(username, group string) error {
-	users, ok := g.groups[group]
-	if !ok {
+// CheckUserInGroup returns nil if the user ID belongs to the given group,
+// directly or through any of the groups it includes, or if the user is
+// currently elevated to any of them, else, an error
+func (g *Groups) CheckUserInGroup(userID, group string) error {
+	g.m.RLock()
+	defer g.m.RUnlock()
+
+	if !g.exists(group) {
 		return ErrGroupNotFound
 	}
-	if _, ok := users[username]; !ok {
-		return ErrUserNotInGroup
+	if g.effectiveUsers(group, map[string]bool{})[userID] {
+		return nil
 	}
-	return nil
+	for _, elevated := range elevatedGroups(userID) {
+		if elevated == group || g.includesGroup(group, elevated, map[string]bool{}) {
+			return nil
+		}
+	}
+	return ErrUserNotInGroup
+}
+
+// checkPermanentMember returns nil if the user ID belongs to the given group,
+// directly or through any of the groups it includes, regardless of elevations,
+// else, an error
+func (g *Groups) checkPermanentMember(userID, group string) error {
+	g.m.RLock()
+	defer g.m.RUnlock()
+
+	if !g.exists(group) {
+		return ErrGroupNotFound
+	}
+	if g.effectiveUsers(group, map[string]bool{})[userID] {
+		return nil
+	}
+	return ErrUserNotInGroup
 }
 
-// GetGroups returns the groups and users that are setup
+// GetGroups returns the groups that are setup with their direct members, which
+// are users and included groups, along with the provided groups
 func GetGroups() map[string][]string {
+	groups.m.RLock()
+	defer groups.m.RUnlock()
+
 	g := make(map[string][]string)
-	for group, users := range groups.groups {
-		groupUsers := make([]string, 0)
-		for user := range users {
-			groupUsers = append(groupUsers, user)
-		}
-		sort.Strings(groupUsers) // Sort them to be stable
-		g[group] = groupUsers
+	for group := range groups.names() {
+		g[group] = groups.users(group)
 	}
 	return g
 }
+
+// GetEffectiveGroups returns the groups that are setup with all the users that
+// belong to them, directly or through included groups
+func GetEffectiveGroups() map[string][]string {
+	groups.m.RLock()
+	defer groups.m.RUnlock()
+
+	g := make(map[string][]string)
+	for group := range groups.names() {
+		g[group] = setToSlice(groups.effectiveUsers(group, map[string]bool{}))
+	}
+	return g
+}
+
+// CreateGroup creates a new empty group
+func CreateGroup(by, group string) error {
+	return groups.change(by, GroupCreated, group, nil, func(users map[string]bool) (map[string]bool, error) {
+		if users != nil {
+			return nil, ErrGroupAlreadyExists
+		}
+		return map[string]bool{}, nil
+	})
+}
+
+// DeleteGroup deletes a group and all its memberships
+func DeleteGroup(by, group string) error {
+	if group == AdminGroup {
+		return ErrAdminGroupIsProtected
+	}
+	return groups.change(by, GroupDeleted, group, nil, func(users map[string]bool) (map[string]bool, error) {
+		if users == nil {
+			return nil, ErrGroupNotFound
+		}
+		return nil, nil
+	})
+}
+
+// AddUsersToGroup adds the users to an existing group, users can be referenced
+// in any of the ways accepted by ResolveUser, or by bare name or ID
+func AddUsersToGroup(by, group string, members ...string) error {
+	usernames, err := resolveBareMembers(members)
+	if err != nil {
+		return err
+	}
+	return groups.change(by, UsersAdded, group, usernames, func(users map[string]bool) (map[string]bool, error) {
+		if users == nil {
+			return nil, ErrGroupNotFound
+		}
+		for _, username := range usernames {
+			if users[username] {
+				return nil, fmt.Errorf("%s: %s", ErrUserAlreadyInGroup, username)
+			}
+			users[username] = true
+		}
+		return users, nil
+	})
+}
+
+// RemoveUsersFromGroup removes the users from an existing group, users can be
+// referenced in any of the ways accepted by ResolveUser, or by bare name or ID
+func RemoveUsersFromGroup(by, group string, members ...string) error {
+	usernames, err := resolveBareMembers(members)
+	if err != nil {
+		return err
+	}
+	return groups.change(by, UsersRemoved, group, usernames, func(users map[string]bool) (map[string]bool, error) {
+		if users == nil {
+			return nil, ErrGroupNotFound
+		}
+		for _, username := range usernames {
+			if !users[username] {
+				return nil, fmt.Errorf("%s: %s", ErrUserNotInGroup, username)
+			}
+			delete(users, username)
+		}
+		if group == AdminGroup && len(users) == 0 {
+			return nil, ErrAdminGroupIsProtected
+		}
+		return users, nil
+	})
+}
+
+// change applies the passed function to a copy of the group users, which is
+// nil when the group does not exist. The resulting set of users is then
+// persisted and recorded in the audit trail, a nil set deletes the group.
+func (g *Groups) change(by, action, group string, usernames []string,
+	f func(map[string]bool) (map[string]bool, error)) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	var users map[string]bool
+	if current, ok := g.groups[group]; ok {
+		users = toSet(setToSlice(current))
+	}
+
+	users, err := f(users)
+	if err != nil {
+		return err
+	}
+
+	changed := &Groups{
+		groups: make(map[string]map[string]bool, len(g.groups)),
+	}
+	for name, members := range g.groups {
+		changed.groups[name] = members
+	}
+	if users == nil {
+		delete(changed.groups, group)
+	} else {
+		changed.groups[group] = users
+	}
+	if err = changed.validate(); err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(groupsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get groups bucket: %s", err)
+		}
+
+		if users == nil {
+			err = bucket.Delete([]byte(group))
+		} else {
+			err = saveGroup(bucket, group, users)
+		}
+		if err != nil {
+			return fmt.Errorf("could not persist group %s: %s", group, err)
+		}
+		return recordChange(tx, by, action, group, usernames...)
+	})
+	if err != nil {
+		log.Errorf("Failed to persist change on group %s: %s", group, err)
+		return fmt.Errorf("could not change group %s: %s", group, err)
+	}
+
+	if users == nil {
+		delete(g.groups, group)
+	} else {
+		g.groups[group] = users
+	}
+
+	log.Infof("User %s changed group %s: %s %s", by, group, action, usernames)
+	return nil
+}
+
+// resolveMembers resolves the users among the group members into user IDs
+func resolveMembers(members []string) ([]string, error) {
+	return resolveMembersWith(members, ResolveUser)
+}
+
+// resolveBareMembers resolves the users among the group members into user IDs,
+// including the ones referenced by bare name
+func resolveBareMembers(members []string) ([]string, error) {
+	return resolveMembersWith(members, resolveBareUser)
+}
+
+func resolveMembersWith(members []string, resolve func(string) (string, error)) ([]string, error) {
+	resolved := make([]string, 0, len(members))
+	for _, member := range members {
+		if strings.HasPrefix(member, GroupMemberPrefix) {
+			resolved = append(resolved, member)
+			continue
+		}
+		id, err := resolve(member)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, id)
+	}
+	return resolved, nil
+}
+
+// differingGroups returns the sorted names of the configured groups whose
+// members are not the stored ones, along with the stored groups that are not
+// configured. Configured members that can't be resolved are taken as different.
+func (g *Groups) differingGroups(configuredGroups map[string][]string) []string {
+	if len(configuredGroups) == 0 {
+		return nil
+	}
+	differ := make([]string, 0)
+	for name, members := range configuredGroups {
+		users, err := resolveBareMembers(members)
+		if err != nil {
+			log.Debugf("Could not resolve the configured members of group %s: %s", name, err)
+			differ = append(differ, name)
+			continue
+		}
+		stored, ok := g.groups[name]
+		if !ok || !reflect.DeepEqual(toSet(users), stored) {
+			differ = append(differ, name)
+		}
+	}
+	for name := range g.groups {
+		if _, ok := configuredGroups[name]; !ok {
+			differ = append(differ, name)
+		}
+	}
+	sort.Strings(differ)
+	return differ
+}
+
+// migrateMembersToIDs replaces the user names stored as members of the groups
+// with the user IDs, members that can't be found by name are kept as they are
+func migrateMembersToIDs(bucket *bolt.Bucket) error {
+	migrated := make(map[string][]string)
+	err := bucket.ForEach(func(name, payload []byte) error {
+		members := make([]string, 0)
+		if err := json.Unmarshal(payload, &members); err != nil {
+			return fmt.Errorf("could not load group %s: %s", name, err)
+		}
+		for i, member := range members {
+			if strings.HasPrefix(member, GroupMemberPrefix) {
+				continue
+			}
+			id, err := FindUserID(member)
+			switch err {
+			case nil:
+				log.Infof("Migrating member %s of group %s to user ID %s", member, name, id)
+				members[i] = id
+			case ErrUserNotFound:
+				log.Debugf("Could not find user %s of group %s by name, keeping it as an ID", member, name)
+			default:
+				return fmt.Errorf("could not resolve user %s of group %s: %s", member, name, err)
+			}
+		}
+		migrated[string(name)] = members
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name, members := range migrated {
+		if err := saveGroup(bucket, name, toSet(members)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveGroup(bucket *bolt.Bucket, group string, users map[string]bool) error {
+	payload, err := json.Marshal(setToSlice(users))
+	if err != nil {
+		return fmt.Errorf("could not marshal group %s: %s", group, err)
+	}
+	return bucket.Put([]byte(group), payload)
+}
+
+// users returns the direct members of a group, including the ones provided
+func (g *Groups) users(group string) []string {
+	users, _ := provided.members(group)
+	for member := range g.groups[group] {
+		users[member] = true
+	}
+	return setToSlice(users)
+}
+
+// exists returns true when the group is in the database or it is provided
+func (g *Groups) exists(group string) bool {
+	if _, ok := g.groups[group]; ok {
+		return true
+	}
+	_, ok := provided.members(group)
+	return ok
+}
+
+// names returns the names of all the groups, including the provided ones
+func (g *Groups) names() map[string]bool {
+	names := provided.names()
+	for name := range g.groups {
+		names[name] = true
+	}
+	return names
+}
+
+// includes returns the names of the groups directly included in a group
+func (g *Groups) includes(group string) []string {
+	included := make([]string, 0)
+	for _, member := range setToSlice(g.groups[group]) {
+		if strings.HasPrefix(member, GroupMemberPrefix) {
+			included = append(included, strings.TrimPrefix(member, GroupMemberPrefix))
+		}
+	}
+	return included
+}
+
+// effectiveUsers returns the users that belong to a group directly or through
+// included groups, visited protects against cycles
+func (g *Groups) effectiveUsers(group string, visited map[string]bool) map[string]bool {
+	users := make(map[string]bool)
+	if visited[group] {
+		return users
+	}
+	visited[group] = true
+
+	for _, member := range g.users(group) {
+		if !strings.HasPrefix(member, GroupMemberPrefix) {
+			users[member] = true
+		}
+	}
+	for _, included := range g.includes(group) {
+		for user := range g.effectiveUsers(included, visited) {
+			users[user] = true
+		}
+	}
+	return users
+}
+
+// includesGroup returns true when the group includes the other one, directly
+// or through any of the groups it includes
+func (g *Groups) includesGroup(group, other string, visited map[string]bool) bool {
+	if visited[group] {
+		return false
+	}
+	visited[group] = true
+
+	for _, included := range g.includes(group) {
+		if included == other || g.includesGroup(included, other, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that all the included groups exist and that no group ends up
+// including itself
+func (g *Groups) validate() error {
+	names := make([]string, 0, len(g.groups))
+	for name := range g.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, included := range g.includes(name) {
+			if !g.exists(included) {
+				return fmt.Errorf("group %s includes unknown group %s", name, included)
+			}
+		}
+	}
+
+	checked := make(map[string]bool)
+	for _, name := range names {
+		if err := g.checkCycle(name, []string{}, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Groups) checkCycle(group string, path []string, checked map[string]bool) error {
+	for i, name := range path {
+		if name == group {
+			cycle := append(append([]string{}, path[i:]...), group)
+			return fmt.Errorf("%s: %s", ErrGroupCycle, strings.Join(cycle, " -> "))
+		}
+	}
+	if checked[group] {
+		return nil
+	}
+
+	path = append(path[:len(path):len(path)], group)
+	for _, included := range g.includes(group) {
+		if err := g.checkCycle(included, path, checked); err != nil {
+			return err
+		}
+	}
+	checked[group] = true
+	return nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func setToSlice(set map[string]bool) []string {
+	values := make([]string, 0)
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values) // Sort them to be stable
+	return values
+}
@@ -0,0 +1,233 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+	log "github.com/sirupsen/logrus"
+	goldap "gopkg.in/ldap.v3"
+)
+
+// Ways of matching directory users with chat users
+const (
+	// MatchByEmail finds the chat user that has the same email as the user
+	// attribute value
+	MatchByEmail = "email"
+	// MatchByUsername finds the chat user whose name is the user attribute
+	// value
+	MatchByUsername = "username"
+)
+
+// Defaults applied to the provider configuration
+const (
+	DefaultMemberAttribute = "member"
+	DefaultUserAttribute   = "mail"
+	DefaultTimeout         = 5 * time.Second
+)
+
+// Config is the configuration of the LDAP group provider
+type Config struct {
+	// URL of the directory, as in ldaps://ldap.example.com
+	URL string
+	// BindDN and BindPassword are used to authenticate, anonymous binds are
+	// used when BindDN is empty
+	BindDN       string
+	BindPassword string
+	// Groups maps group names to the DN of the directory group
+	Groups map[string]string
+	// MemberAttribute is the directory group attribute that lists the DNs of
+	// its members
+	MemberAttribute string
+	// UserAttribute is the directory user attribute that is matched with the
+	// chat users as configured in MatchBy
+	UserAttribute string
+	MatchBy       string
+	Timeout       time.Duration
+}
+
+// Provider resolves the members of groups from an LDAP directory
+type Provider struct {
+	config Config
+}
+
+// New validates the configuration, applies the defaults, and returns a new
+// LDAP group provider
+func New(c Config) (*Provider, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url %s: %s", c.URL, err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("invalid ldap url %s: scheme should be ldap or ldaps", c.URL)
+	}
+	if len(c.Groups) == 0 {
+		return nil, fmt.Errorf("no ldap groups configured")
+	}
+	if c.MemberAttribute == "" {
+		c.MemberAttribute = DefaultMemberAttribute
+	}
+	if c.UserAttribute == "" {
+		c.UserAttribute = DefaultUserAttribute
+	}
+	switch c.MatchBy {
+	case "":
+		c.MatchBy = MatchByEmail
+	case MatchByEmail, MatchByUsername:
+	default:
+		return nil, fmt.Errorf("invalid ldap match_by %s, it should be either %s or %s",
+			c.MatchBy, MatchByEmail, MatchByUsername)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	return &Provider{config: c}, nil
+}
+
+// Config returns the provider configuration with the defaults applied
+func (p *Provider) Config() Config {
+	return p.config
+}
+
+// Name implements the auth.GroupProvider interface
+func (p *Provider) Name() string {
+	return fmt.Sprintf("ldap %s", p.config.URL)
+}
+
+// Groups implements the auth.GroupProvider interface
+//
+// Members that can't be found in the directory, or that have no matching chat
+// user, are left out of the groups.
+func (p *Provider) Groups() (map[string][]string, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(p.config.Timeout)
+
+	if p.config.BindDN != "" {
+		if err = conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("could not bind as %s: %s", p.config.BindDN, err)
+		}
+	}
+
+	// emails are the chat user IDs by email, which are listed once per refresh
+	// when the first member is matched
+	var emails map[string]string
+	// users caches the chat user ID of each member DN, it's empty for the
+	// members that have no chat user
+	users := make(map[string]string)
+	groups := make(map[string][]string, len(p.config.Groups))
+	for group, dn := range p.config.Groups {
+		entry, err := p.lookup(conn, dn, p.config.MemberAttribute)
+		if err != nil {
+			return nil, fmt.Errorf("could not find group %s: %s", group, err)
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("could not find group %s: %s does not exist", group, dn)
+		}
+
+		members := make([]string, 0)
+		for _, member := range entry.GetAttributeValues(p.config.MemberAttribute) {
+			userID, ok := users[member]
+			if !ok {
+				if emails == nil && p.config.MatchBy == MatchByEmail {
+					if emails, err = auth.FindUserIDsByEmail(); err != nil {
+						return nil, fmt.Errorf("could not list chat users by email: %s", err)
+					}
+				}
+				if userID, err = p.userID(conn, member, emails); err != nil {
+					return nil, fmt.Errorf("could not resolve member %s of group %s: %s", member, group, err)
+				}
+				users[member] = userID
+			}
+			if userID != "" {
+				members = append(members, userID)
+			}
+		}
+		groups[group] = members
+	}
+	return groups, nil
+}
+
+// dial connects to the directory within the timeout, ldap.DialURL does not take
+// one
+func (p *Provider) dial() (*goldap.Conn, error) {
+	u, err := url.Parse(p.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, goldap.DefaultLdapPort
+		if u.Scheme == "ldaps" {
+			port = goldap.DefaultLdapsPort
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: p.config.Timeout}
+	var c net.Conn
+	if u.Scheme == "ldaps" {
+		c, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+	} else {
+		c, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := goldap.NewConn(c, u.Scheme == "ldaps")
+	conn.Start()
+	return conn, nil
+}
+
+// userID returns the chat user ID of the directory user, or an empty string
+// when the user doesn't exist in the directory or in the chat, users matched by
+// email are looked up in the emails map
+func (p *Provider) userID(conn *goldap.Conn, dn string, emails map[string]string) (string, error) {
+	entry, err := p.lookup(conn, dn, p.config.UserAttribute)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		log.Debugf("LDAP user %s does not exist", dn)
+		return "", nil
+	}
+	value := entry.GetAttributeValue(p.config.UserAttribute)
+	if value == "" {
+		log.Debugf("LDAP user %s has no %s", dn, p.config.UserAttribute)
+		return "", nil
+	}
+
+	userID, ok := emails[strings.ToLower(value)]
+	if p.config.MatchBy != MatchByEmail {
+		userID, err = auth.FindUserID(value)
+		ok = err != auth.ErrUserNotFound
+	}
+	if !ok {
+		log.Debugf("LDAP user %s has no chat user matching %s %s", dn, p.config.MatchBy, value)
+		return "", nil
+	}
+	return userID, err
+}
+
+// lookup reads the attribute of an entry by DN, it returns a nil entry when it
+// does not exist
+func (p *Provider) lookup(conn *goldap.Conn, dn, attribute string) (*goldap.Entry, error) {
+	result, err := conn.Search(goldap.NewSearchRequest(dn, goldap.ScopeBaseObject, goldap.NeverDerefAliases,
+		0, int(p.config.Timeout.Seconds()), false, "(objectClass=*)", []string{attribute}, nil))
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return result.Entries[0], nil
+}
@@ -0,0 +1,154 @@
+package ldap_test
+
+import (
+	"testing"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+	"github.com/gomeeseeks/meeseeks-box/auth/ldap"
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+)
+
+var entries = map[string]map[string][]string{
+	"cn=sre,ou=groups,dc=example,dc=com": {
+		"member": []string{
+			"uid=alice,ou=people,dc=example,dc=com",
+			"uid=bob,ou=people,dc=example,dc=com",
+			"uid=carol,ou=people,dc=example,dc=com",
+			"uid=gone,ou=people,dc=example,dc=com",
+		},
+	},
+	"cn=dba,ou=groups,dc=example,dc=com": {
+		"member": []string{
+			"uid=alice,ou=people,dc=example,dc=com",
+		},
+	},
+	"uid=alice,ou=people,dc=example,dc=com": {
+		"mail": []string{"alice@example.com"},
+		"uid":  []string{"alice"},
+	},
+	"uid=bob,ou=people,dc=example,dc=com": {
+		"mail": []string{"bob@example.com"},
+		"uid":  []string{"bob"},
+	},
+	"uid=carol,ou=people,dc=example,dc=com": {
+		"uid": []string{"carol"},
+	},
+}
+
+func Test_LDAPGroups(t *testing.T) {
+	server, err := NewLDAPServerStub(entries)
+	stubs.Must(t, "could not start ldap server", err)
+	defer server.Close()
+	server.BindDN, server.BindPassword = "cn=meeseeks,dc=example,dc=com", "secret"
+
+	auth.SetUserResolver(stubs.UserResolverStub{
+		"alice@example.com": "U_ALICE",
+		"bob@example.com":   "U_BOB",
+		"alice":             "U_ALICE",
+		"carol":             "U_CAROL",
+	})
+	defer auth.SetUserResolver(nil)
+
+	tt := []struct {
+		name     string
+		config   ldap.Config
+		expected map[string][]string
+	}{
+		{
+			name: "match by email",
+			config: ldap.Config{
+				URL:          server.URL(),
+				BindDN:       "cn=meeseeks,dc=example,dc=com",
+				BindPassword: "secret",
+				Groups: map[string]string{
+					"sre": "cn=sre,ou=groups,dc=example,dc=com",
+					"dba": "cn=dba,ou=groups,dc=example,dc=com",
+				},
+			},
+			expected: map[string][]string{
+				"sre": []string{"U_ALICE", "U_BOB"},
+				"dba": []string{"U_ALICE"},
+			},
+		},
+		{
+			name: "match by username",
+			config: ldap.Config{
+				URL:           server.URL(),
+				BindDN:        "cn=meeseeks,dc=example,dc=com",
+				BindPassword:  "secret",
+				Groups:        map[string]string{"sre": "cn=sre,ou=groups,dc=example,dc=com"},
+				UserAttribute: "uid",
+				MatchBy:       ldap.MatchByUsername,
+			},
+			expected: map[string][]string{
+				"sre": []string{"U_ALICE", "U_CAROL"},
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ldap.New(tc.config)
+			stubs.Must(t, "could not create provider", err)
+			groups, err := p.Groups()
+			stubs.Must(t, "could not load groups", err)
+			stubs.AssertEquals(t, tc.expected, groups)
+		})
+	}
+}
+
+func Test_LDAPGroupsErrors(t *testing.T) {
+	server, err := NewLDAPServerStub(entries)
+	stubs.Must(t, "could not start ldap server", err)
+	defer server.Close()
+	server.BindDN, server.BindPassword = "cn=meeseeks,dc=example,dc=com", "secret"
+
+	p, err := ldap.New(ldap.Config{
+		URL:          server.URL(),
+		BindDN:       "cn=meeseeks,dc=example,dc=com",
+		BindPassword: "wrong",
+		Groups:       map[string]string{"sre": "cn=sre,ou=groups,dc=example,dc=com"},
+	})
+	stubs.Must(t, "could not create provider", err)
+	_, err = p.Groups()
+	stubs.AssertMatches(t, "^could not bind as cn=meeseeks,dc=example,dc=com: .*Invalid Credentials", err.Error())
+
+	p, err = ldap.New(ldap.Config{
+		URL:          server.URL(),
+		BindDN:       "cn=meeseeks,dc=example,dc=com",
+		BindPassword: "secret",
+		Groups:       map[string]string{"sre": "cn=missing,ou=groups,dc=example,dc=com"},
+	})
+	stubs.Must(t, "could not create provider", err)
+	_, err = p.Groups()
+	stubs.AssertEquals(t, "could not find group sre: cn=missing,ou=groups,dc=example,dc=com does not exist", err.Error())
+}
+
+func Test_InvalidLDAPConfiguration(t *testing.T) {
+	tc := []struct {
+		name     string
+		config   ldap.Config
+		expected string
+	}{
+		{
+			name:     "invalid scheme",
+			config:   ldap.Config{URL: "http://ldap.example.com", Groups: map[string]string{"sre": "cn=sre"}},
+			expected: "invalid ldap url http://ldap.example.com: scheme should be ldap or ldaps",
+		},
+		{
+			name:     "no groups",
+			config:   ldap.Config{URL: "ldaps://ldap.example.com"},
+			expected: "no ldap groups configured",
+		},
+		{
+			name:     "invalid match",
+			config:   ldap.Config{URL: "ldaps://ldap.example.com", Groups: map[string]string{"sre": "cn=sre"}, MatchBy: "phone"},
+			expected: "invalid ldap match_by phone, it should be either email or username",
+		},
+	}
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ldap.New(tc.config)
+			stubs.AssertEquals(t, tc.expected, err.Error())
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package ldap_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// LDAP protocol operations and result codes used by the LDAP server stub
+const (
+	ldapBindRequest      = 0
+	ldapBindResponse     = 1
+	ldapUnbindRequest    = 2
+	ldapSearchRequest    = 3
+	ldapSearchResultItem = 4
+	ldapSearchResultDone = 5
+
+	ldapSuccess            = 0
+	ldapNoSuchObject       = 32
+	ldapInvalidCredentials = 49
+	ldapUnwillingToPerform = 53
+)
+
+// LDAPServerStub is an in-process LDAP server that accepts simple binds and
+// base object searches over a fixed set of entries, search filters are ignored
+type LDAPServerStub struct {
+	// Entries are the attributes of each entry by DN
+	Entries map[string]map[string][]string
+	// BindDN and BindPassword are the only accepted credentials when set
+	BindDN       string
+	BindPassword string
+
+	listener net.Listener
+	searches int
+	m        sync.Mutex
+}
+
+// NewLDAPServerStub starts a new LDAP server stub on a random local port
+func NewLDAPServerStub(entries map[string]map[string][]string) (*LDAPServerStub, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %s", err)
+	}
+	s := &LDAPServerStub{
+		Entries:  entries,
+		listener: l,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap URL in which the server is listening
+func (s *LDAPServerStub) URL() string {
+	return fmt.Sprintf("ldap://%s", s.listener.Addr())
+}
+
+// Searches returns how many searches the server has received
+func (s *LDAPServerStub) Searches() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.searches
+}
+
+// SetEntries replaces the entries returned by the server
+func (s *LDAPServerStub) SetEntries(entries map[string]map[string][]string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Entries = entries
+}
+
+// Close stops the server
+func (s *LDAPServerStub) Close() error {
+	return s.listener.Close()
+}
+
+func (s *LDAPServerStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *LDAPServerStub) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldapBindRequest:
+			responses = []*ber.Packet{s.bind(op)}
+		case ldapSearchRequest:
+			responses = s.search(op)
+		case ldapUnbindRequest:
+			return
+		default:
+			responses = []*ber.Packet{ldapResult(ber.Tag(op.Tag+1), ldapUnwillingToPerform)}
+		}
+
+		for _, response := range responses {
+			envelope := ber.NewSequence("LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+			envelope.AppendChild(response)
+			if _, err = conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *LDAPServerStub) bind(op *ber.Packet) *ber.Packet {
+	if s.BindDN == "" {
+		return ldapResult(ldapBindResponse, ldapSuccess)
+	}
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	if dn != s.BindDN || password != s.BindPassword {
+		return ldapResult(ldapBindResponse, ldapInvalidCredentials)
+	}
+	return ldapResult(ldapBindResponse, ldapSuccess)
+}
+
+func (s *LDAPServerStub) search(op *ber.Packet) []*ber.Packet {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.searches++
+
+	dn, _ := op.Children[0].Value.(string)
+	attributes, ok := s.Entries[dn]
+	if !ok {
+		return []*ber.Packet{ldapResult(ldapSearchResultDone, ldapNoSuchObject)}
+	}
+
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultItem, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	attrs := ber.NewSequence("Attributes")
+	for _, requested := range op.Children[7].Children {
+		name, _ := requested.Value.(string)
+		values, ok := attributes[name]
+		if !ok {
+			continue
+		}
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	entry.AppendChild(attrs)
+	return []*ber.Packet{entry, ldapResult(ldapSearchResultDone, ldapSuccess)}
+}
+
+func ldapResult(op ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
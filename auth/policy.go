@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule effects
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// DefaultDenyRule is the name of the implicit last rule that denies every
+// request that was not matched by any other rule
+const DefaultDenyRule = "default deny"
+
+var policy = []Rule{}
+
+// RuleOpts are the options used to build a policy rule, matchers that are left
+// empty match any request
+type RuleOpts struct {
+	Name   string
+	Effect string
+
+	// Users are user IDs, or any other reference accepted by ResolveUser
+	Users    []string
+	Groups   []string
+	Channels []string
+	// Commands is a list of glob patterns matched against the command name
+	Commands []string
+	// Args is a list of glob patterns matched positionally against the
+	// request arguments
+	Args []string
+	// Regex is matched against all the request arguments joined by spaces
+	Regex string
+}
+
+// Rule allows or denies the requests that match all of its matchers
+type Rule struct {
+	name   string
+	effect string
+
+	users    []string
+	groups   []string
+	channels []string
+	commands []string
+	args     argsMatcher
+	// external delegates the decision to the external authorization endpoint
+	external bool
+}
+
+// NewRule validates the options and returns a new policy rule
+func NewRule(opts RuleOpts) (Rule, error) {
+	switch opts.Effect {
+	case EffectAllow, EffectDeny:
+	default:
+		return Rule{}, fmt.Errorf("invalid rule effect %q, it should be either %s or %s",
+			opts.Effect, EffectAllow, EffectDeny)
+	}
+	for _, pattern := range opts.Commands {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Rule{}, fmt.Errorf("invalid command pattern %s: %s", pattern, err)
+		}
+	}
+	args, err := newArgsMatcher(opts.Args, opts.Regex)
+	if err != nil {
+		return Rule{}, err
+	}
+	users, err := resolveUsers(opts.Users)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	return Rule{
+		name:     opts.Name,
+		effect:   opts.Effect,
+		users:    users,
+		groups:   opts.Groups,
+		channels: opts.Channels,
+		commands: opts.Commands,
+		args:     args,
+	}, nil
+}
+
+// Name returns the rule name
+func (r Rule) Name() string {
+	return r.name
+}
+
+// Effect returns whether the rule allows or denies the requests it matches
+func (r Rule) Effect() string {
+	return r.effect
+}
+
+// match returns true when the request matches all the rule matchers, along with
+// the reason why it matches, or the first reason why it doesn't
+func (r Rule) match(req request.Request) (bool, string) {
+	reasons := make([]string, 0)
+	if len(r.users) > 0 {
+		if !contains(r.users, req.UserID) {
+			return false, fmt.Sprintf("user %s is not one of %s", who(req), r.users)
+		}
+		reasons = append(reasons, fmt.Sprintf("user is %s", who(req)))
+	}
+	if len(r.groups) > 0 {
+		group, ok := findUserGroup(req.UserID, r.groups)
+		if !ok {
+			return false, fmt.Sprintf("user %s is not in any of the groups %s", who(req), r.groups)
+		}
+		reasons = append(reasons, fmt.Sprintf("user %s is in group %s", who(req), group))
+	}
+	if len(r.channels) > 0 {
+		switch {
+		case req.NoChannel && r.effect == EffectDeny:
+			// a request from no channel could be from any of them, so it can't
+			// skip the rules that deny them
+			reasons = append(reasons, fmt.Sprintf("requested from %s, which may be any of the channels %s", where(req), r.channels))
+		case req.IsIM || req.NoChannel || !matchesChannel(r.channels, req):
+			return false, fmt.Sprintf("%s is not one of the channels %s", where(req), r.channels)
+		default:
+			reasons = append(reasons, fmt.Sprintf("requested from %s", where(req)))
+		}
+	}
+	if len(r.commands) > 0 {
+		if !matchesCommand(r.commands, req.Command) {
+			return false, fmt.Sprintf("command %s is not one of %s", req.Command, r.commands)
+		}
+		reasons = append(reasons, fmt.Sprintf("command is %s", req.Command))
+	}
+	if !r.args.isEmpty() {
+		if !r.args.Matches(req.Args) {
+			return false, fmt.Sprintf("arguments %s do not match %s", req.Args, r.args)
+		}
+		reasons = append(reasons, fmt.Sprintf("arguments %s match %s", req.Args, r.args))
+	}
+	if r.external {
+		matched, reason := matchExternal(req)
+		if !matched {
+			return false, reason
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) == 0 {
+		return true, "the rule matches any request"
+	}
+	return true, strings.Join(reasons, ", ")
+}
+
+// ConfigurePolicy sets the policy rules, which are evaluated in order before
+// the rules derived from the command configuration
+//
+// Rules without a name are named after their position in the policy.
+func ConfigurePolicy(rules []Rule) {
+	p := make([]Rule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("policy rule %d", i+1)
+		}
+		p = append(p, rule)
+	}
+	policy = p
+}
+
+// Decision is the result of evaluating if a request can run a command
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the rule that took the decision
+	Rule string
+	// Reason is why the rule matched the request
+	Reason string
+	// Trace contains all the evaluated rules in order
+	Trace []Evaluation
+
+	err error
+}
+
+// Err returns nil when the request is allowed, else, the reason why it's not
+func (d Decision) Err() error {
+	return d.err
+}
+
+// Evaluation is the outcome of matching a single rule against a request
+type Evaluation struct {
+	Rule    string
+	Effect  string
+	Matched bool
+	Reason  string
+}
+
+// Explain evaluates if a request can run a command and returns the decision
+// along with the trace of all the evaluated rules
+//
+// The command channel restrictions are checked first, along with the admin
+// group for the admin only commands so no policy rule can grant them to anyone
+// else, then the configured policy rules, and last the rules derived from the
+// command argument rules and auth strategy. The first rule that matches the
+// request decides, and when no rule matches the request is denied.
+func Explain(req request.Request, cmd CommandAuthorization) Decision {
+	if err := cmd.ChannelRestrictions().Check(req); err != nil {
+		return denied(fmt.Sprintf("command %s channel restrictions", req.Command), err.Error(), err)
+	}
+	if a, ok := cmd.(AdminOnly); ok && a.AdminOnly() {
+		if _, ok := findUserGroup(req.UserID, []string{AdminGroup}); !ok {
+			return denied(fmt.Sprintf("command %s is admin only", req.Command),
+				fmt.Sprintf("user %s is not in group %s", who(req), AdminGroup), ErrUserNotAllowed)
+		}
+	}
+
+	d := Decision{
+		Trace: make([]Evaluation, 0),
+	}
+	rules := append(append([]Rule{}, policy...), commandRules(req.Command, cmd)...)
+	for _, rule := range rules {
+		matched, reason := rule.match(req)
+		d.Trace = append(d.Trace, Evaluation{
+			Rule:    rule.name,
+			Effect:  rule.effect,
+			Matched: matched,
+			Reason:  reason,
+		})
+		if !matched {
+			continue
+		}
+
+		d.Rule, d.Reason = rule.name, reason
+		if rule.effect == EffectAllow {
+			d.Allowed = true
+		} else {
+			d.err = ErrUserNotAllowed
+		}
+		return d
+	}
+
+	d.Rule, d.Reason, d.err = DefaultDenyRule, "no rule matched the request", ErrUserNotAllowed
+	return d
+}
+
+// denied returns the decision of a constraint that is checked before the rules
+func denied(name, reason string, err error) Decision {
+	return Decision{
+		Rule:   name,
+		Reason: reason,
+		Trace: []Evaluation{{
+			Rule:    name,
+			Effect:  EffectDeny,
+			Matched: true,
+			Reason:  reason,
+		}},
+		err: err,
+	}
+}
+
+// commandRules translates the command argument rules and auth strategy into
+// policy rules
+func commandRules(command string, cmd CommandAuthorization) []Rule {
+	rules := make([]Rule, 0)
+	for i, argRule := range cmd.ArgRules() {
+		name := fmt.Sprintf("command %s argument rule %d", command, i+1)
+		rules = append(rules, strategyRules(name, argRule.argsMatcher,
+			argRule.AuthStrategy(), argRule.AllowedGroups())...)
+	}
+	name := fmt.Sprintf("command %s auth strategy %s", command, cmd.AuthStrategy())
+	return append(rules, strategyRules(name, argsMatcher{}, cmd.AuthStrategy(), cmd.AllowedGroups())...)
+}
+
+// strategyRules returns the rules that implement an auth strategy for the
+// requests matching the arguments matcher
+//
+// Requests that are not allowed by the strategy are left to the default deny,
+// unless there is an arguments matcher, in which case they are explicitly
+// denied so they are not evaluated against the following rules.
+func strategyRules(name string, args argsMatcher, strategy string, groups []string) []Rule {
+	rules := make([]Rule, 0)
+	switch strategy {
+	case AuthStrategyAny:
+		rules = append(rules, Rule{name: name, effect: EffectAllow, args: args})
+	case AuthStrategyAllowedGroup:
+		if len(groups) > 0 {
+			rules = append(rules, Rule{name: name, effect: EffectAllow, groups: groups, args: args})
+		}
+	case AuthStrategyExternal:
+		rules = append(rules, Rule{name: name, effect: EffectAllow, args: args, external: true})
+	case AuthStrategyNone:
+	default:
+		log.Errorf("Invalid auth strategy %s in %s, falling back to none", strategy, name)
+	}
+
+	if !args.isEmpty() {
+		rules = append(rules, Rule{name: name, effect: EffectDeny, args: args})
+	}
+	return rules
+}
+
+func findUserGroup(userID string, groupNames []string) (string, bool) {
+	for _, group := range groupNames {
+		err := groups.CheckUserInGroup(userID, group)
+		switch err {
+		case nil:
+			return group, true
+		case ErrUserNotInGroup:
+		case ErrGroupNotFound:
+			log.Errorf("Could not found group %s", group)
+		default:
+			log.Errorf("Unexpected error %s", err)
+		}
+	}
+	return "", false
+}
+
+func matchesCommand(patterns []string, command string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, command); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func who(req request.Request) string {
+	if req.UserID == "" {
+		return req.Username
+	}
+	if req.Username == "" || req.Username == req.UserID {
+		return req.UserID
+	}
+	return fmt.Sprintf("%s (%s)", req.Username, req.UserID)
+}
+
+func where(req request.Request) string {
+	if req.IsIM {
+		return "an IM conversation"
+	}
+	if req.NoChannel {
+		return "no channel"
+	}
+	return fmt.Sprintf("channel #%s", req.Channel)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GroupProvider resolves groups from a source other than the database, like a
+// directory, so their memberships are kept in sync with it
+//
+// Provided groups can't be changed with the group builtin commands. They can be
+// used as any other group, and when a group with the same name also exists in
+// the database, its users are the members of both.
+type GroupProvider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+	// Groups returns the provided groups with the user IDs of their members
+	Groups() (map[string][]string, error)
+}
+
+// RefreshedGroupProvider is a group provider along with how often its groups
+// are refreshed, a refresh interval of 0 disables the periodic refresh
+type RefreshedGroupProvider struct {
+	GroupProvider
+	Refresh time.Duration
+}
+
+type providedGroups struct {
+	providers []GroupProvider
+	groups    map[string]map[string]map[string]bool
+	stop      chan bool
+	m         sync.RWMutex
+}
+
+var provided = &providedGroups{
+	groups: map[string]map[string]map[string]bool{},
+}
+
+// ConfigureGroupProviders loads the groups from the providers, failing if any
+// of them can't be loaded, and refreshes each one of them periodically from
+// then on
+//
+// When a refresh fails the provider keeps the groups from the last successful
+// load. Configuring the providers again stops refreshing the previous ones.
+func ConfigureGroupProviders(providers ...RefreshedGroupProvider) error {
+	loaded := make(map[string]map[string]map[string]bool, len(providers))
+	configured := make([]GroupProvider, 0, len(providers))
+	for _, p := range providers {
+		if _, ok := loaded[p.Name()]; ok {
+			return fmt.Errorf("group provider %s is configured twice", p.Name())
+		}
+		g, err := loadProvidedGroups(p)
+		if err != nil {
+			return err
+		}
+		loaded[p.Name()] = g
+		configured = append(configured, p.GroupProvider)
+	}
+
+	provided.m.Lock()
+	defer provided.m.Unlock()
+
+	if provided.stop != nil {
+		close(provided.stop)
+		provided.stop = nil
+	}
+	provided.providers = configured
+	provided.groups = loaded
+
+	provided.stop = make(chan bool)
+	for _, p := range providers {
+		if p.Refresh > 0 {
+			go provided.refreshEvery(p.GroupProvider, p.Refresh, provided.stop)
+		}
+	}
+	return nil
+}
+
+// RefreshGroupProviders loads the groups of all the providers right away
+func RefreshGroupProviders() {
+	provided.m.RLock()
+	providers := provided.providers
+	provided.m.RUnlock()
+
+	for _, p := range providers {
+		provided.refresh(p)
+	}
+}
+
+func (p *providedGroups) refreshEvery(provider GroupProvider, interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.refresh(provider)
+		}
+	}
+}
+
+func (p *providedGroups) refresh(provider GroupProvider) {
+	g, err := loadProvidedGroups(provider)
+	if err != nil {
+		log.Errorf("Could not refresh groups, keeping the last known ones: %s", err)
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if _, ok := p.groups[provider.Name()]; !ok {
+		log.Debugf("Provider %s is not configured anymore, discarding its groups", provider.Name())
+		return
+	}
+	p.groups[provider.Name()] = g
+	log.Debugf("Refreshed %d groups from provider %s", len(g), provider.Name())
+}
+
+func loadProvidedGroups(p GroupProvider) (map[string]map[string]bool, error) {
+	g, err := p.Groups()
+	if err != nil {
+		return nil, fmt.Errorf("could not load groups from provider %s: %s", p.Name(), err)
+	}
+	loaded := make(map[string]map[string]bool, len(g))
+	for name, users := range g {
+		loaded[name] = toSet(users)
+	}
+	return loaded, nil
+}
+
+// members returns the users of a group from all the providers, and whether any
+// of them provides the group
+func (p *providedGroups) members(group string) (map[string]bool, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	users := make(map[string]bool)
+	found := false
+	for _, groups := range p.groups {
+		members, ok := groups[group]
+		if !ok {
+			continue
+		}
+		found = true
+		for user := range members {
+			users[user] = true
+		}
+	}
+	return users, found
+}
+
+// names returns the names of all the provided groups
+func (p *providedGroups) names() map[string]bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	names := make(map[string]bool)
+	for _, groups := range p.groups {
+		for name := range groups {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// UserGroupsProvider provides groups whose members are the members of chat
+// user groups, which are listed with the user resolver
+type UserGroupsProvider struct {
+	groups map[string]string
+}
+
+// NewUserGroupsProvider returns a provider for the groups, which are mapped to
+// the handle of a chat user group, as in @sre
+func NewUserGroupsProvider(groups map[string]string) UserGroupsProvider {
+	return UserGroupsProvider{groups: groups}
+}
+
+// Name implements the GroupProvider interface
+func (p UserGroupsProvider) Name() string {
+	return "chat user groups"
+}
+
+// Groups implements the GroupProvider interface
+func (p UserGroupsProvider) Groups() (map[string][]string, error) {
+	groups := make(map[string][]string, len(p.groups))
+	for group, handle := range p.groups {
+		members, err := FindUserGroupMembers(handle)
+		if err != nil {
+			return nil, fmt.Errorf("could not get members of user group %s for group %s: %s", handle, group, err)
+		}
+		groups[group] = members
+	}
+	return groups, nil
+}
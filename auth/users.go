@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UserNamePrefix is used to reference users by name instead of by ID, as in
+// "@alice", names are resolved to the user ID when they are loaded
+const UserNamePrefix = "@"
+
+// Errors returned when resolving users
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrNoUserResolver = errors.New("no user resolver is configured")
+)
+
+// UserResolver translates user names into stable user IDs
+type UserResolver interface {
+	GetUserID(username string) (string, error)
+}
+
+// UserEmailResolver is implemented by the user resolvers that can also find
+// users by their email, it returns the IDs of all the users by lowercased email
+// so they are listed once no matter how many are looked up
+type UserEmailResolver interface {
+	GetUserIDsByEmail() (map[string]string, error)
+}
+
+// UserGroupResolver is implemented by the user resolvers that can list the
+// members of chat user groups, as in @sre
+type UserGroupResolver interface {
+	GetUserGroupMembers(handle string) ([]string, error)
+}
+
+var userResolver UserResolver = noUserResolver{}
+
+// SetUserResolver sets the resolver used to translate user names into IDs,
+// passing nil removes the current resolver
+func SetUserResolver(r UserResolver) {
+	if r == nil {
+		r = noUserResolver{}
+	}
+	userResolver = r
+}
+
+var userLinkRegex = regexp.MustCompile("^<@([^|>]+)(\\|[^>]*)?>$")
+
+var userIDRegex = regexp.MustCompile("^[UW][A-Z0-9]{2,}$")
+
+// ResolveUser returns the ID of the referenced user, which can be a user ID, a
+// user link as in <@U012AB3CD>, or a user name prefixed with @
+//
+// Users are always authorized by ID because names can be changed by the users
+// themselves.
+func ResolveUser(user string) (string, error) {
+	if m := userLinkRegex.FindStringSubmatch(user); m != nil {
+		return m[1], nil
+	}
+	if !strings.HasPrefix(user, UserNamePrefix) {
+		return user, nil
+	}
+
+	username := strings.TrimPrefix(user, UserNamePrefix)
+	id, err := userResolver.GetUserID(username)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve user %s: %s", username, err)
+	}
+	return id, nil
+}
+
+// FindUserID returns the ID of the user with the given name, or
+// ErrUserNotFound when there is no such user
+func FindUserID(username string) (string, error) {
+	return userResolver.GetUserID(username)
+}
+
+// FindUserIDsByEmail returns the IDs of all the users by lowercased email
+func FindUserIDsByEmail() (map[string]string, error) {
+	r, ok := userResolver.(UserEmailResolver)
+	if !ok {
+		return nil, ErrNoUserResolver
+	}
+	return r.GetUserIDsByEmail()
+}
+
+// FindUserGroupMembers returns the IDs of the members of a chat user group
+func FindUserGroupMembers(handle string) ([]string, error) {
+	r, ok := userResolver.(UserGroupResolver)
+	if !ok {
+		return nil, ErrNoUserResolver
+	}
+	return r.GetUserGroupMembers(handle)
+}
+
+func resolveUsers(users []string) ([]string, error) {
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		id, err := ResolveUser(user)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// resolveBareUser resolves a user like ResolveUser, but bare names, as in
+// "alice", are resolved by name as well, which is how users were configured
+// before being authorized by ID and how they are passed to the group builtins
+//
+// Bare names that are not found are only taken as IDs when they look like one,
+// so a typo is never stored as a user that matches no one. They are kept as
+// they are when there is no user resolver, as there is no way to tell them
+// apart from IDs.
+func resolveBareUser(user string) (string, error) {
+	if userLinkRegex.MatchString(user) || strings.HasPrefix(user, UserNamePrefix) {
+		return ResolveUser(user)
+	}
+	if _, noResolver := userResolver.(noUserResolver); noResolver {
+		return user, nil
+	}
+
+	id, err := userResolver.GetUserID(user)
+	if err == ErrUserNotFound && userIDRegex.MatchString(user) {
+		return user, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not resolve user %s: %s", user, err)
+	}
+	return id, nil
+}
+
+type noUserResolver struct{}
+
+func (noUserResolver) GetUserID(_ string) (string, error) {
+	return "", ErrNoUserResolver
+}
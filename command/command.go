@@ -5,6 +5,7 @@ import (
 
 	"context"
 
+	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/jobs"
 )
 
@@ -21,6 +22,8 @@ type Command interface {
 	Templates() map[string]string
 	AuthStrategy() string
 	AllowedGroups() []string
+	ChannelRestrictions() auth.ChannelRestrictions
+	ArgRules() []auth.ArgRule
 	Args() []string
 	Timeout() time.Duration
 	Help() string
@@ -15,6 +15,7 @@ import (
 
 	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/command"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	"github.com/gomeeseeks/meeseeks-box/template"
 	"github.com/gomeeseeks/meeseeks-box/version"
 	"github.com/renstrom/dedent"
@@ -35,6 +36,16 @@ const (
 	BuiltinLogsCommand      = "logs"
 	BuiltinCancelJobCommand = "cancel"
 	BuiltinKillJobCommand   = "kill"
+	BuiltinConfigCommand    = "config"
+
+	BuiltinCreateGroupCommand         = "group-create"
+	BuiltinDeleteGroupCommand         = "group-delete"
+	BuiltinAddUserToGroupCommand      = "group-add-user"
+	BuiltinRemoveUserFromGroupCommand = "group-remove-user"
+	BuiltinAuditGroupsCommand         = "auditgroups"
+	BuiltinAuthExplainCommand         = "auth-explain"
+	BuiltinElevateCommand             = "elevate"
+	BuiltinApproveElevationCommand    = "elevate-approve"
 
 	BuiltinNewAPITokenCommand    = "token-new"
 	BuiltinListAPITokenCommand   = "tokens"
@@ -51,9 +62,37 @@ var Commands = map[string]command.Command{
 		cmd:  cmd{BuiltinVersionCommand},
 	},
 	BuiltinGroupsCommand: groupsCommand{
-		help: help{"prints the configured groups"},
+		help: help{"prints the configured groups with their direct members and, for nested groups, their effective users"},
 		cmd:  cmd{BuiltinGroupsCommand},
 	},
+	BuiltinCreateGroupCommand: createGroupCommand{
+		help: help{"creates a new empty group (admin only)"},
+		cmd:  cmd{BuiltinCreateGroupCommand},
+	},
+	BuiltinDeleteGroupCommand: deleteGroupCommand{
+		help: help{"deletes a group and all its memberships (admin only)"},
+		cmd:  cmd{BuiltinDeleteGroupCommand},
+	},
+	BuiltinAddUserToGroupCommand: addUserToGroupCommand{
+		help: help{"adds the users passed as arguments to a group, requires the group and at least one user (admin only)"},
+		cmd:  cmd{BuiltinAddUserToGroupCommand},
+	},
+	BuiltinRemoveUserFromGroupCommand: removeUserFromGroupCommand{
+		help: help{"removes the users passed as arguments from a group, requires the group and at least one user (admin only)"},
+		cmd:  cmd{BuiltinRemoveUserFromGroupCommand},
+	},
+	BuiltinAuditGroupsCommand: auditGroupsCommand{
+		help: help{"lists the last changes done to groups, accepts -limit (admin only)"},
+		cmd:  cmd{BuiltinAuditGroupsCommand},
+	},
+	BuiltinElevateCommand: elevateCommand{
+		help: help{"temporarily adds the calling user to a group, requires the group, the duration and a reason"},
+		cmd:  cmd{BuiltinElevateCommand},
+	},
+	BuiltinApproveElevationCommand: approveElevationCommand{
+		help: help{"approves a pending elevation by ID, it can't be approved by the user that requested it"},
+		cmd:  cmd{BuiltinApproveElevationCommand},
+	},
 	BuiltinJobsCommand: jobsCommand{
 		help: help{"shows the last executed jobs for the calling user, accepts -limit"},
 		cmd:  cmd{BuiltinJobsCommand},
@@ -87,7 +126,7 @@ var Commands = map[string]command.Command{
 		cmd:  cmd{BuiltinLogsCommand},
 	},
 	BuiltinNewAPITokenCommand: newAPITokenCommand{
-		help: help{"creates a new API token for the calling user, channel and command with args, requires at least #channel and command"},
+		help: help{"creates a new API token for the user, channel and command with args, without a command the token can only be used for the REST API as the user, accepts -expires, -max-uses, -cidr, -description, -signed, -allow-args, -env, -reply and -callback"},
 		cmd:  cmd{BuiltinNewAPITokenCommand},
 	},
 	BuiltinListAPITokenCommand: listAPITokensCommand{
@@ -95,7 +134,7 @@ var Commands = map[string]command.Command{
 		cmd:  cmd{BuiltinListAPITokenCommand},
 	},
 	BuiltinRevokeAPITokenCommand: revokeAPITokenCommand{
-		help: help{"revokes an API token"},
+		help: help{"revokes an API token by its prefix"},
 		cmd:  cmd{BuiltinRevokeAPITokenCommand},
 	},
 }
@@ -109,6 +148,16 @@ func AddHelpCommand(c map[string]command.Command) {
 	}
 }
 
+// AddAuthExplainCommand creates a new auth-explain command and adds it to the map
+func AddAuthExplainCommand(c map[string]command.Command) {
+	c[BuiltinAuthExplainCommand] = authExplainCommand{
+		commands: c,
+		cmd:      cmd{BuiltinAuthExplainCommand},
+		help: help{"explains which authorization rule allows or denies a user to run a command, " +
+			"requires the user and the command, accepts -channel and -im (admin only)"},
+	}
+}
+
 type plainTemplates struct{}
 
 func (p plainTemplates) Templates() map[string]string {
@@ -152,6 +201,10 @@ func (a allowAll) AllowedGroups() []string {
 	return []string{}
 }
 
+func (a allowAll) ArgRules() []auth.ArgRule {
+	return []auth.ArgRule{}
+}
+
 type allowAdmins struct{}
 
 func (a allowAdmins) AuthStrategy() string {
@@ -162,6 +215,26 @@ func (a allowAdmins) AllowedGroups() []string {
 	return []string{auth.AdminGroup}
 }
 
+func (a allowAdmins) ArgRules() []auth.ArgRule {
+	return []auth.ArgRule{}
+}
+
+func (a allowAdmins) AdminOnly() bool {
+	return true
+}
+
+type anyChannel struct{}
+
+func (a anyChannel) ChannelRestrictions() auth.ChannelRestrictions {
+	return auth.ChannelRestrictions{}
+}
+
+type imOnly struct{}
+
+func (i imOnly) ChannelRestrictions() auth.ChannelRestrictions {
+	return auth.ChannelRestrictions{IMOnly: true}
+}
+
 type noHandshake struct {
 }
 
@@ -191,6 +264,7 @@ type versionCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -207,6 +281,7 @@ type helpCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -234,6 +309,7 @@ type cancelJobCommand struct {
 	noRecord
 	emptyArgs
 	allowAll
+	anyChannel
 	defaultTemplates
 	defaultTimeout
 	cancelFunc func(jobID uint64)
@@ -256,7 +332,7 @@ func (c cancelJobCommand) Execute(_ context.Context, job jobs.Job) (string, erro
 	if err != nil {
 		return "", err
 	}
-	if job.Request.Username != j.Request.Username {
+	if job.Request.UserID != j.Request.UserID {
 		return "", jobs.ErrNoJobWithID
 	}
 	c.cancelFunc(jobID)
@@ -270,6 +346,7 @@ type killJobCommand struct {
 	noRecord
 	emptyArgs
 	allowAdmins
+	anyChannel
 	defaultTemplates
 	defaultTimeout
 	cancelFunc func(jobID uint64)
@@ -296,6 +373,33 @@ func (k killJobCommand) Execute(_ context.Context, job jobs.Job) (string, error)
 	return fmt.Sprintf("Issued command cancellation to job %d", jobID), nil
 }
 
+type configCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	defaultTemplates
+	defaultTimeout
+	dumpFunc func() (string, error)
+}
+
+// NewConfigCommand creates a command that will print the output of the passed
+// configuration dumping function when executed
+func NewConfigCommand(f func() (string, error)) command.Command {
+	return configCommand{
+		cmd:      cmd{BuiltinConfigCommand},
+		help:     help{"prints the effective configuration with secrets redacted (admin only)"},
+		dumpFunc: f,
+	}
+}
+
+func (c configCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	return c.dumpFunc()
+}
+
 type groupsCommand struct {
 	cmd
 	help
@@ -303,6 +407,7 @@ type groupsCommand struct {
 	noRecord
 	emptyArgs
 	allowAdmins
+	anyChannel
 	plainTemplates
 	defaultTimeout
 }
@@ -311,6 +416,14 @@ var groupsTemplate = dedent.Dedent(`
 	{{- range $group, $users := .groups }}
 	- {{ $group }}:
 		{{- range $index, $user := $users }}{{ if ne $index 0 }},{{ end }} {{ $user }}{{ end }}
+		{{- with $effective := index $.effective $group }}
+	  effective:
+		{{- range $index, $user := $effective }}{{ if ne $index 0 }},{{ end }} {{ $user }}{{ end }}
+		{{- end }}
+		{{- with $elevations := index $.elevations $group }}
+	  elevated:
+		{{- range $index, $e := $elevations }}{{ if ne $index 0 }},{{ end }} {{ $e.Username }} (expires {{ HumanizeTime $e.ExpiresAt }}){{ end }}
+		{{- end }}
 	{{- end }}
 	`)
 
@@ -319,8 +432,295 @@ func (g groupsCommand) Execute(_ context.Context, job jobs.Job) (string, error)
 	if err != nil {
 		return "", err
 	}
+
+	// Effective members are only shown for groups that include other groups
+	direct, effective := auth.GetGroups(), auth.GetEffectiveGroups()
+	for group, users := range direct {
+		if strings.Join(users, ",") == strings.Join(effective[group], ",") {
+			delete(effective, group)
+		}
+	}
+	return tmpl.Render(template.Payload{
+		"groups":     direct,
+		"effective":  effective,
+		"elevations": auth.GetActiveElevations(),
+	})
+}
+
+type createGroupCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (c createGroupCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the group name should be passed as an argument")
+	}
+	group := job.Request.Args[0]
+	if err := auth.CreateGroup(job.Request.UserID, group); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Group *%s* has been created", group), nil
+}
+
+type deleteGroupCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (d deleteGroupCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the group name should be passed as an argument")
+	}
+	group := job.Request.Args[0]
+	if err := auth.DeleteGroup(job.Request.UserID, group); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Group *%s* has been deleted", group), nil
+}
+
+type addUserToGroupCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (a addUserToGroupCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) < 2 {
+		return "", fmt.Errorf("not enough arguments passed in, requires the group and at least one user")
+	}
+	group, users := job.Request.Args[0], job.Request.Args[1:]
+	if err := auth.AddUsersToGroup(job.Request.UserID, group, users...); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Added %s to group *%s*", strings.Join(users, ", "), group), nil
+}
+
+type removeUserFromGroupCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (r removeUserFromGroupCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) < 2 {
+		return "", fmt.Errorf("not enough arguments passed in, requires the group and at least one user")
+	}
+	group, users := job.Request.Args[0], job.Request.Args[1:]
+	if err := auth.RemoveUsersFromGroup(job.Request.UserID, group, users...); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Removed %s from group *%s*", strings.Join(users, ", "), group), nil
+}
+
+type elevateCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAll
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (e elevateCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) < 3 {
+		return "", fmt.Errorf("not enough arguments passed in, requires the group, the duration and a reason")
+	}
+	group := job.Request.Args[0]
+	d, err := time.ParseDuration(job.Request.Args[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid duration %s, it should be like 30m or 2h", job.Request.Args[1])
+	}
+	reason := strings.Join(job.Request.Args[2:], " ")
+
+	elevation, err := auth.Elevate(job.Request.UserID, job.Request.Username, group, d, reason)
+	if err != nil {
+		return "", err
+	}
+	if elevation.IsPending() {
+		return fmt.Sprintf("Elevation *%d* to group *%s* is pending approval, it can be approved by someone else with `%s %d`",
+			elevation.ID, group, BuiltinApproveElevationCommand, elevation.ID), nil
+	}
+	return fmt.Sprintf("You have been elevated to group *%s* for %s", group, d), nil
+}
+
+type approveElevationCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAll
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+func (a approveElevationCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the elevation ID should be passed as an argument")
+	}
+	id, err := strconv.ParseUint(job.Request.Args[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid elevation ID %s: %s", job.Request.Args[0], err)
+	}
+
+	elevation, err := auth.ApproveElevation(job.Request.UserID, job.Request.Username, id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Approved elevation *%d*, *%s* has been elevated to group *%s* for %s",
+		elevation.ID, elevation.Username, elevation.Group, elevation.Duration), nil
+}
+
+type auditGroupsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+}
+
+var groupChangesTemplate = strings.Join([]string{
+	"{{- $length := len .changes }}{{- if eq $length 0 }}",
+	"No group changes found\n",
+	"{{ else }}",
+	"{{- range $c := .changes }}",
+	"*{{ $c.ID }}* - {{ HumanizeTime $c.Time }}",
+	" - *{{ if $c.ByUser }}<@{{ $c.Username }}>{{ else }}{{ $c.Username }}{{ end }}* {{ $c.Action }}",
+	"{{ with $users := $c.Usernames }} {{ Join $users \", \" }}{{ end }}",
+	" group *{{ $c.Group }}*\n",
+	"{{ end }}",
+	"{{ end }}",
+}, "")
+
+func (a auditGroupsCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	flags := flag.NewFlagSet("auditgroups", flag.ContinueOnError)
+	limit := flags.Int("limit", 5, "how many changes to return")
+	if err := flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+
+	changes, err := auth.FindGroupChanges(*limit)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New("groupchanges", groupChangesTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(template.Payload{
+		"changes": changes,
+	})
+}
+
+type authExplainCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAdmins
+	anyChannel
+	plainTemplates
+	defaultTimeout
+	commands map[string]command.Command
+}
+
+var authExplainTemplate = strings.Join([]string{
+	"*{{ .user }}* {{ if .decision.Allowed }}can{{ else }}can't{{ end }} run *{{ .command }}*",
+	"{{ with $args := .args }} {{ Join $args \" \" }}{{ end }} from {{ .where }}\n",
+	"Decided by *{{ .decision.Rule }}*: {{ .decision.Reason }}\n",
+	"{{- range $e := .decision.Trace }}\n",
+	"- {{ $e.Rule }} ({{ $e.Effect }}): {{ if $e.Matched }}matched{{ else }}skipped{{ end }}, {{ $e.Reason }}",
+	"{{- end }}",
+}, "")
+
+func (a authExplainCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
+	flags := flag.NewFlagSet("auth-explain", flag.ContinueOnError)
+	channel := flags.String("channel", "", "the channel the command is requested from, the current one by default")
+	im := flags.Bool("im", false, "the command is requested over an IM conversation")
+	if err := flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+	if flags.NArg() < 2 {
+		return "", fmt.Errorf("not enough arguments passed in, requires the user and the command")
+	}
+
+	user, commandName := flags.Arg(0), flags.Arg(1)
+	userID, err := auth.ResolveUser(user)
+	if err != nil {
+		return "", err
+	}
+	cmd, ok := a.commands[commandName]
+	if !ok {
+		return "", fmt.Errorf("command %s not found", commandName)
+	}
+
+	req := request.Request{
+		Command:   commandName,
+		Args:      flags.Args()[2:],
+		Username:  strings.TrimPrefix(user, auth.UserNamePrefix),
+		UserID:    userID,
+		Channel:   job.Request.Channel,
+		ChannelID: job.Request.ChannelID,
+		IsIM:      job.Request.IsIM,
+	}
+	if *channel != "" {
+		req.Channel, req.ChannelID, req.IsIM = strings.TrimPrefix(*channel, "#"), "", false
+	}
+	if *im {
+		req.Channel, req.ChannelID, req.IsIM = "", "", true
+	}
+
+	where := "an IM conversation"
+	if !req.IsIM {
+		where = "#" + req.Channel
+	}
+
+	tmpl, err := template.New("authexplain", authExplainTemplate)
+	if err != nil {
+		return "", err
+	}
 	return tmpl.Render(template.Payload{
-		"groups": auth.GetGroups(),
+		"user":     user,
+		"command":  req.Command,
+		"args":     req.Args,
+		"where":    where,
+		"decision": auth.Explain(req, cmd),
 	})
 }
 
@@ -330,6 +730,7 @@ type jobsCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -357,7 +758,7 @@ func (j jobsCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
 		return "", err
 	}
 
-	callingUser := job.Request.Username
+	callingUser := job.Request.UserID
 	requestedStatus := strings.Title(*status)
 	jobs, err := jobs.Find(jobs.JobFilter{
 		Limit: *limit,
@@ -385,6 +786,7 @@ type auditCommand struct {
 	noHandshake
 	noRecord
 	allowAdmins
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -393,12 +795,17 @@ type auditCommand struct {
 func (j auditCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
 	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
 	limit := flags.Int("limit", 5, "how many jobs to return")
-	user := flags.String("user", "", "the user to audit")
+	user := flags.String("user", "", "the user to audit, by ID, link or @name")
 	status := flags.String("status", "", "filter jobs per status (running, failed or successful)")
 	if err := flags.Parse(job.Request.Args); err != nil {
 		return "", err
 	}
 
+	userID, err := auth.ResolveUser(*user)
+	if err != nil {
+		return "", err
+	}
+
 	requestedStatus := strings.Title(*status)
 
 	jobs, err := jobs.Find(jobs.JobFilter{
@@ -406,10 +813,10 @@ func (j auditCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
 		Match: jobs.MultiMatch(
 			isStatusOrEmpty(requestedStatus),
 			func(j jobs.Job) bool {
-				if *user == "" {
+				if userID == "" {
 					return true
 				}
-				return *user == j.Request.Username
+				return userID == j.Request.UserID
 			},
 		),
 	})
@@ -432,6 +839,7 @@ type lastCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -448,7 +856,7 @@ var jobTemplate = `
 `
 
 func (l lastCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
-	callingUser := job.Request.Username
+	callingUser := job.Request.UserID
 	jobs, err := jobs.Find(jobs.JobFilter{
 		Limit: 1,
 		Match: isUser(callingUser),
@@ -474,6 +882,7 @@ type findJobCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -485,7 +894,7 @@ func (l findJobCommand) Execute(_ context.Context, job jobs.Job) (string, error)
 		return "", err
 	}
 
-	callingUser := job.Request.Username
+	callingUser := job.Request.UserID
 	jobs, err := jobs.Find(jobs.JobFilter{
 		Limit: 1,
 		Match: jobs.MultiMatch(
@@ -514,6 +923,7 @@ type auditJobCommand struct {
 	noHandshake
 	noRecord
 	allowAdmins
+	anyChannel
 	plainTemplates
 	emptyArgs
 	defaultTimeout
@@ -551,6 +961,7 @@ type auditLogsCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	defaultTemplates
 	emptyArgs
 	defaultTimeout
@@ -588,13 +999,14 @@ type tailCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	defaultTemplates
 	emptyArgs
 	defaultTimeout
 }
 
 func (t tailCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
-	callingUser := job.Request.Username
+	callingUser := job.Request.UserID
 	jobs, err := jobs.Find(jobs.JobFilter{
 		Limit: 1,
 		Match: isUser(callingUser),
@@ -620,6 +1032,7 @@ type logsCommand struct {
 	noHandshake
 	noRecord
 	allowAll
+	anyChannel
 	defaultTemplates
 	emptyArgs
 	defaultTimeout
@@ -631,7 +1044,7 @@ func (t logsCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
 		return "", err
 	}
 
-	callingUser := job.Request.Username
+	callingUser := job.Request.UserID
 	jobs, err := jobs.Find(jobs.JobFilter{
 		Limit: 1,
 		Match: jobs.MultiMatch(
@@ -659,25 +1072,68 @@ type newAPITokenCommand struct {
 	noHandshake
 	noRecord
 	allowAdmins
+	imOnly
 	plainTemplates
 	emptyArgs
 	defaultTimeout
 }
 
 func (n newAPITokenCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
-	if !job.Request.IsIM {
-		return "", fmt.Errorf("API tokens can only be managed over an IM conversation, security ffs")
+	flags := flag.NewFlagSet("token-new", flag.ContinueOnError)
+	expires := flags.Duration("expires", 0, "how long the token is valid for, forever when not set")
+	maxUses := flags.Int("max-uses", 0, "how many times the token can be used, unlimited when not set")
+	cidrs := flags.String("cidr", "", "comma separated CIDRs the token can be used from, any when not set")
+	description := flags.String("description", "", "what the token is used for")
+	signed := flags.Bool("signed", false, "whether the token requires signed requests, a signing secret is generated")
+	allowArgs := flags.Bool("allow-args", false, "whether requests can append arguments to the command")
+	env := flags.String("env", "", "comma separated environment variables requests can set, none when not set")
+	reply := flags.String("reply", "", "where the replies go: channel, im, callback or silent, the channel when not set")
+	callback := flags.String("callback", "", "URL the results are posted to when replying to the callback")
+
+	if err := flags.Parse(job.Request.Args); err != nil {
+		return "", err
 	}
-	if len(job.Request.Args) < 3 {
+	args := flags.Args()
+	if len(args) < 2 {
 		return "", fmt.Errorf("not enough arguments passed in")
 	}
+	if *expires < 0 {
+		return "", fmt.Errorf("invalid expiration %s: it can't be negative", *expires)
+	}
 
-	t, err := tokens.Create(tokens.NewTokenRequest{
-		UserLink:    job.Request.Args[0],
-		ChannelLink: job.Request.Args[1],
-		Text:        strings.Join(job.Request.Args[2:], " "),
-	})
-	return fmt.Sprintf("created token %s", t), err
+	r := tokens.NewTokenRequest{
+		UserLink:    args[0],
+		ChannelLink: args[1],
+		Text:        strings.Join(args[2:], " "),
+		Description: *description,
+		MaxUses:     *maxUses,
+		AllowArgs:   *allowArgs,
+		ReplyMode:   *reply,
+		CallbackURL: *callback,
+	}
+	if *expires > 0 {
+		r.ExpiresOn = time.Now().Add(*expires)
+	}
+	if *cidrs != "" {
+		r.AllowedCIDRs = strings.Split(*cidrs, ",")
+	}
+	if *env != "" {
+		r.AllowedEnv = strings.Split(*env, ",")
+	}
+
+	if *signed {
+		t, secret, err := tokens.CreateSigned(r)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("created token %s with signing secret %s", t, secret), nil
+	}
+
+	t, err := tokens.Create(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("created token %s", t), nil
 }
 
 type revokeAPITokenCommand struct {
@@ -686,23 +1142,21 @@ type revokeAPITokenCommand struct {
 	noHandshake
 	noRecord
 	allowAdmins
+	imOnly
 	plainTemplates
 	emptyArgs
 	defaultTimeout
 }
 
 func (r revokeAPITokenCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
-	if !job.Request.IsIM {
-		return "", fmt.Errorf("API tokens can only be managed over an IM conversation, security ffs")
-	}
 	if len(job.Request.Args) != 1 {
-		return "", fmt.Errorf("only one token ID should be passed as an argument")
+		return "", fmt.Errorf("only one token prefix should be passed as an argument")
 	}
-	tokenID := job.Request.Args[0]
-	if err := tokens.Revoke(tokenID); err != nil {
+	prefix := job.Request.Args[0]
+	if err := tokens.Revoke(prefix); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("Token *%s* has been revoked", tokenID), nil
+	return fmt.Sprintf("Token *%s* has been revoked", prefix), nil
 }
 
 type listAPITokensCommand struct {
@@ -711,19 +1165,24 @@ type listAPITokensCommand struct {
 	noHandshake
 	noRecord
 	allowAdmins
+	imOnly
 	plainTemplates
 	emptyArgs
 	defaultTimeout
 }
 
-var listTokensTemplate = `{{ if eq (len .tokens) 0 }}No tokens could be found{{ else }}{{ range $t := .tokens }}- *{{ $t.TokenID }}* {{ $t.UserLink }} at {{ $t.ChannelLink }} _{{ $t.Text}}_
+var listTokensTemplate = `{{ if eq (len .tokens) 0 }}No tokens could be found{{ else }}{{ range $t := .tokens }}- *{{ $t.Prefix }}* {{ $t.UserLink }} at {{ $t.ChannelLink }} _{{ $t.Text}}_
+{{- with $t.Description }} {{ . }}{{ end }}
+{{- if not $t.ExpiresOn.IsZero }} expires {{ HumanizeTime $t.ExpiresOn }}{{ end }}
+{{- if $t.MaxUses }} used {{ $t.Uses }} of {{ $t.MaxUses }} times{{ end }}
+{{- if $t.AllowedCIDRs }} from {{ Join $t.AllowedCIDRs ", " }}{{ end }}
+{{- if $t.Signed }} signed{{ end }}
+{{- if $t.AllowArgs }} allows args{{ end }}
+{{- if $t.AllowedEnv }} sets {{ Join $t.AllowedEnv ", " }}{{ end }}
+{{- with $t.ReplyMode }} reply mode {{ . }}{{ end }}
 {{ end }}{{ end }}`
 
 func (l listAPITokensCommand) Execute(_ context.Context, job jobs.Job) (string, error) {
-	if !job.Request.IsIM {
-		return "", fmt.Errorf("API tokens can only be managed over an IM conversation, security ffs")
-	}
-
 	flags := flag.NewFlagSet("jobs", flag.ContinueOnError)
 	limit := flags.Int("limit", 5, "how many jobs to return")
 	user := flags.String("user", "", "user to filter for")
@@ -779,9 +1238,9 @@ func parseJobID(job jobs.Job) (uint64, error) {
 	return id, nil
 }
 
-func isUser(username string) func(jobs.Job) bool {
+func isUser(userID string) func(jobs.Job) bool {
 	return func(j jobs.Job) bool {
-		return j.Request.Username == username
+		return j.Request.UserID == userID
 	}
 }
 
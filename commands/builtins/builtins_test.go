@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/commands"
@@ -32,8 +33,6 @@ var req = request.Request{
 }
 
 func Test_BuiltinCommands(t *testing.T) {
-	auth.Configure(basicGroups)
-
 	var jobID uint64
 
 	commands.Add(builtins.BuiltinCancelJobCommand, builtins.NewCancelJobCommand(
@@ -44,6 +43,10 @@ func Test_BuiltinCommands(t *testing.T) {
 		func(j uint64) {
 			jobID = j
 		}))
+	commands.Add(builtins.BuiltinConfigCommand, builtins.NewConfigCommand(
+		func() (string, error) {
+			return "pool: 20\n", nil
+		}))
 
 	tt := []struct {
 		name          string
@@ -53,6 +56,7 @@ func Test_BuiltinCommands(t *testing.T) {
 		expected      string
 		expectedMatch string
 		expectedError error
+		expectedJobID uint64
 	}{
 		{
 			name:     "version command",
@@ -66,10 +70,19 @@ func Test_BuiltinCommands(t *testing.T) {
 			job:  jobs.Job{},
 			expected: dedent.Dedent(`
 				- audit: lists jobs from all users or a specific one (admin only), accepts -user and -limit to filter.
+				- auditgroups: lists the last changes done to groups, accepts -limit (admin only)
 				- auditjob: shows a command metadata by job ID from any user (admin only)
 				- auditlogs: shows the logs of any command by job ID (admin only)
+				- auth-explain: explains which authorization rule allows or denies a user to run a command, requires the user and the command, accepts -channel and -im (admin only)
 				- cancel: cancels a jobs owned by the calling user that is currently running
-				- groups: prints the configured groups
+				- config: prints the effective configuration with secrets redacted (admin only)
+				- elevate: temporarily adds the calling user to a group, requires the group, the duration and a reason
+				- elevate-approve: approves a pending elevation by ID, it can't be approved by the user that requested it
+				- group-add-user: adds the users passed as arguments to a group, requires the group and at least one user (admin only)
+				- group-create: creates a new empty group (admin only)
+				- group-delete: deletes a group and all its memberships (admin only)
+				- group-remove-user: removes the users passed as arguments from a group, requires the group and at least one user (admin only)
+				- groups: prints the configured groups with their direct members and, for nested groups, their effective users
 				- help: prints all the kwnown commands and its associated help
 				- job: find one job by id
 				- jobs: shows the last executed jobs for the calling user, accepts -limit
@@ -77,12 +90,47 @@ func Test_BuiltinCommands(t *testing.T) {
 				- last: shows the last executed command by the calling user
 				- logs: returns the logs of the command id passed as argument
 				- tail: returns the last command output or error
-				- token-new: creates a new API token for the calling user, channel and command with args, requires at least #channel and command
-				- token-revoke: revokes an API token
+				- token-new: creates a new API token for the user, channel and command with args, without a command the token can only be used for the REST API as the user, accepts -expires, -max-uses, -cidr, -description, -signed, -allow-args, -env, -reply and -callback
+				- token-revoke: revokes an API token by its prefix
 				- tokens: lists the API tokens
 				- version: prints the running meeseeks version
 				`),
 		},
+		{
+			name: "auth explain command with an allowed user",
+			cmd:  builtins.BuiltinAuthExplainCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Channel: "general", Args: []string{"user_one", "version"}},
+			},
+			expected: "*user_one* can run *version* from #general\n" +
+				"Decided by *command version auth strategy any*: the rule matches any request\n" +
+				"- command version auth strategy any (allow): matched, the rule matches any request",
+		},
+		{
+			name: "auth explain command with a denied user",
+			cmd:  builtins.BuiltinAuthExplainCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Channel: "general",
+					Args: []string{"-im", "user_one", "audit", "-user", "someone"}},
+			},
+			expected: "*user_one* can't run *audit* -user someone from an IM conversation\n" +
+				"Decided by *command audit is admin only*: user user_one is not in group admin\n" +
+				"- command audit is admin only (deny): matched, user user_one is not in group admin",
+		},
+		{
+			name: "auth explain command with an unknown command",
+			cmd:  builtins.BuiltinAuthExplainCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"user_one", "unknown"}},
+			},
+			expectedError: fmt.Errorf("command unknown not found"),
+		},
+		{
+			name:     "config command",
+			cmd:      builtins.BuiltinConfigCommand,
+			job:      jobs.Job{},
+			expected: "pool: 20\n",
+		},
 		{
 			name: "groups command",
 			cmd:  builtins.BuiltinGroupsCommand,
@@ -92,11 +140,148 @@ func Test_BuiltinCommands(t *testing.T) {
 					- other: user_one, user_two
 					`),
 		},
+		{
+			name: "groups command with nested groups",
+			cmd:  builtins.BuiltinGroupsCommand,
+			job:  jobs.Job{},
+			setup: func() {
+				stubs.Must(t, "failed to create group", auth.CreateGroup("admin_user", "all"))
+				stubs.Must(t, "failed to add groups", auth.AddUsersToGroup("admin_user", "all",
+					"user_three", auth.GroupMemberPrefix+"admins", auth.GroupMemberPrefix+"other"))
+			},
+			expected: dedent.Dedent(`
+					- admins: admin_user
+					- all: group:admins, group:other, user_three
+					  effective: admin_user, user_one, user_three, user_two
+					- other: user_one, user_two
+					`),
+		},
+		{
+			name: "groups command with elevations",
+			cmd:  builtins.BuiltinGroupsCommand,
+			job:  jobs.Job{},
+			setup: func() {
+				stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+					"admins": {Eligible: []string{"group:other"}},
+				}))
+				_, err := auth.Elevate("user_one", "user_one", "admins", time.Hour, "incident")
+				stubs.Must(t, "failed to elevate", err)
+			},
+			expected: dedent.Dedent(`
+					- admins: admin_user
+					  elevated: user_one (expires 59 minutes from now)
+					- other: user_one, user_two
+					`),
+		},
+		{
+			name: "elevate command",
+			cmd:  builtins.BuiltinElevateCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "user_one", UserID: "user_one", Args: []string{"admins", "30m", "fixing", "the", "db"}},
+			},
+			setup: func() {
+				stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+					"admins": {Eligible: []string{"group:other"}},
+				}))
+			},
+			expected: "You have been elevated to group *admins* for 30m0s",
+		},
+		{
+			name: "elevate command requiring approval",
+			cmd:  builtins.BuiltinElevateCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "user_one", UserID: "user_one", Args: []string{"admins", "30m", "incident"}},
+			},
+			setup: func() {
+				stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+					"admins": {Eligible: []string{"group:other"}, RequiresApproval: true},
+				}))
+			},
+			expected: "Elevation *1* to group *admins* is pending approval, it can be approved by someone else with `elevate-approve 1`",
+		},
+		{
+			name: "elevate command with an invalid duration",
+			cmd:  builtins.BuiltinElevateCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "user_one", UserID: "user_one", Args: []string{"admins", "soon", "incident"}},
+			},
+			expectedError: fmt.Errorf("invalid duration soon, it should be like 30m or 2h"),
+		},
+		{
+			name: "elevate approve command",
+			cmd:  builtins.BuiltinApproveElevationCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"1"}},
+			},
+			setup: func() {
+				stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(map[string]auth.ElevationPolicy{
+					"admins": {Eligible: []string{"group:other"}, RequiresApproval: true},
+				}))
+				_, err := auth.Elevate("user_one", "user_one", "admins", time.Hour, "incident")
+				stubs.Must(t, "failed to elevate", err)
+			},
+			expected: "Approved elevation *1*, *user_one* has been elevated to group *admins* for 1h0m0s",
+		},
+		{
+			name: "group create command",
+			cmd:  builtins.BuiltinCreateGroupCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"oncall"}},
+			},
+			expected: "Group *oncall* has been created",
+		},
+		{
+			name: "group delete command",
+			cmd:  builtins.BuiltinDeleteGroupCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"other"}},
+			},
+			expected: "Group *other* has been deleted",
+		},
+		{
+			name: "group add user command",
+			cmd:  builtins.BuiltinAddUserToGroupCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"admins", "user_one", "user_two"}},
+			},
+			expected: "Added user_one, user_two to group *admins*",
+		},
+		{
+			name: "group remove user command",
+			cmd:  builtins.BuiltinRemoveUserFromGroupCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"other", "user_one"}},
+			},
+			expected: "Removed user_one from group *other*",
+		},
+		{
+			name: "group remove user command from unknown group",
+			cmd:  builtins.BuiltinRemoveUserFromGroupCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"unknown", "user_one"}},
+			},
+			expectedError: auth.ErrGroupNotFound,
+		},
+		{
+			name: "audit groups command",
+			cmd:  builtins.BuiltinAuditGroupsCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"-limit", "1"}},
+			},
+			setup: func() {
+				cmd, _ := commands.Find(builtins.BuiltinAddUserToGroupCommand)
+				_, err := cmd.Execute(context.Background(), jobs.Job{
+					Request: request.Request{Username: "Admin", UserID: "admin_user", Args: []string{"other", "user_three"}},
+				})
+				stubs.Must(t, "could not add user", err)
+			},
+			expected: "*3* - now - *<@admin_user>* added user_three group *other*\n",
+		},
 		{
 			name: "test jobs command",
 			cmd:  builtins.BuiltinJobsCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone"},
+				Request: request.Request{Username: "someone", UserID: "someoneID"},
 			},
 			setup: func() {
 				j, err := jobs.Create(req)
@@ -122,7 +307,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test jobs command with limit",
 			cmd:  builtins.BuiltinJobsCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"-limit=1"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"-limit=1"}},
 			},
 			setup: func() {
 				jobs.Create(req)
@@ -134,7 +319,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test jobs command on IM",
 			cmd:  builtins.BuiltinJobsCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone"},
+				Request: request.Request{Username: "someone", UserID: "someoneID"},
 			},
 			setup: func() {
 				jobs.Create(request.Request{
@@ -142,6 +327,7 @@ func Test_BuiltinCommands(t *testing.T) {
 					Channel:   "general",
 					ChannelID: "123",
 					Username:  "someone",
+					UserID:    "someoneID",
 					Args:      []string{"arg1", "arg2"},
 					IsIM:      true,
 				})
@@ -152,7 +338,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test last command",
 			cmd:  builtins.BuiltinLastCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone"},
+				Request: request.Request{Username: "someone", UserID: "someoneID"},
 			},
 			setup: func() {
 				jobs.Create(req)
@@ -165,7 +351,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test find command",
 			cmd:  builtins.BuiltinFindJobCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"1"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"1"}},
 			},
 			setup: func() {
 				jobs.Create(req)
@@ -177,7 +363,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test auditjob command",
 			cmd:  builtins.BuiltinAuditJobCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"1"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"1"}},
 			},
 			setup: func() {
 				jobs.Create(req)
@@ -189,7 +375,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test tail command",
 			cmd:  builtins.BuiltinTailCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone"},
+				Request: request.Request{Username: "someone", UserID: "someoneID"},
 			},
 			setup: func() {
 				j, err := jobs.Create(req)
@@ -206,7 +392,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test logs command",
 			cmd:  builtins.BuiltinLogsCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"1"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"1"}},
 			},
 			setup: func() {
 				j, err := jobs.Create(req)
@@ -223,7 +409,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test auditlogs command",
 			cmd:  builtins.BuiltinAuditLogsCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "admin_user", Args: []string{"1"}},
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", Args: []string{"1"}},
 			},
 			setup: func() {
 				j, err := jobs.Create(req)
@@ -240,15 +426,59 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test token-new command",
 			cmd:  builtins.BuiltinNewAPITokenCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "admin_user", IsIM: true, Args: []string{"admin_user", "yolo", "rm", "-rf"}},
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", IsIM: true, Args: []string{"admin_user", "yolo", "rm", "-rf"}},
+			},
+			expectedMatch: "created token .*",
+		},
+		{
+			name: "test token-new command with restrictions",
+			cmd:  builtins.BuiltinNewAPITokenCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", IsIM: true, Args: []string{
+					"-expires", "24h", "-max-uses", "3", "-cidr", "10.0.0.0/8,192.168.1.0/24", "-description", "ci",
+					"-allow-args", "-env", "VERSION,TARGET", "-reply", "callback", "-callback", "https://ci.example.com/done",
+					"admin_user", "yolo", "echo"}},
 			},
 			expectedMatch: "created token .*",
 		},
+		{
+			name: "test token-new command with signing secret",
+			cmd:  builtins.BuiltinNewAPITokenCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", IsIM: true, Args: []string{
+					"-signed", "admin_user", "yolo", "echo"}},
+			},
+			expectedMatch: "created token .* with signing secret [0-9a-f]{64}",
+		},
+		{
+			name: "test tokens command with restrictions",
+			cmd:  builtins.BuiltinListAPITokenCommand,
+			job: jobs.Job{
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", IsIM: true},
+			},
+			setup: func() {
+				_, err := tokens.Create(tokens.NewTokenRequest{
+					ChannelLink:  "channelLink",
+					UserLink:     "userLink",
+					Text:         "something",
+					Description:  "for ci",
+					ExpiresOn:    time.Now().Add(2 * time.Hour),
+					MaxUses:      3,
+					AllowedCIDRs: []string{"10.0.0.0/8"},
+					AllowArgs:    true,
+					AllowedEnv:   []string{"VERSION", "TARGET"},
+					ReplyMode:    "silent",
+				})
+				stubs.Must(t, "create token", err)
+
+			},
+			expectedMatch: "- \\*.*?\\* userLink at channelLink _something_ for ci expires 1 hour from now used 0 of 3 times from 10.0.0.0/8 allows args sets VERSION, TARGET reply mode silent",
+		},
 		{
 			name: "test tokens command",
 			cmd:  builtins.BuiltinListAPITokenCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "admin_user", IsIM: true},
+				Request: request.Request{Username: "admin_user", UserID: "admin_user", IsIM: true},
 			},
 			setup: func() {
 				_, err := tokens.Create(tokens.NewTokenRequest{
@@ -265,7 +495,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			name: "test kill job command",
 			cmd:  builtins.BuiltinKillJobCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"1"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"1"}},
 			},
 			setup: func() {
 				_, err := jobs.Create(req)
@@ -274,13 +504,14 @@ func Test_BuiltinCommands(t *testing.T) {
 				_, err = jobs.Create(req)
 				stubs.Must(t, "create job", err)
 			},
-			expected: "Issued command cancellation to job 1",
+			expected:      "Issued command cancellation to job 1",
+			expectedJobID: 1,
 		},
 		{
 			name: "test cancel job command",
 			cmd:  builtins.BuiltinCancelJobCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone", Args: []string{"2"}},
+				Request: request.Request{Username: "someone", UserID: "someoneID", Args: []string{"2"}},
 			},
 			setup: func() {
 				_, err := jobs.Create(req)
@@ -289,13 +520,14 @@ func Test_BuiltinCommands(t *testing.T) {
 				_, err = jobs.Create(req)
 				stubs.Must(t, "create job", err)
 			},
-			expected: "Issued command cancellation to job 2",
+			expected:      "Issued command cancellation to job 2",
+			expectedJobID: 2,
 		},
 		{
 			name: "test cancel job command with wrong user",
 			cmd:  builtins.BuiltinCancelJobCommand,
 			job: jobs.Job{
-				Request: request.Request{Username: "someone_else", Args: []string{"2"}},
+				Request: request.Request{Username: "someone_else", UserID: "someone_elseID", Args: []string{"2"}},
 			},
 			setup: func() {
 				_, err := jobs.Create(req)
@@ -311,6 +543,8 @@ func Test_BuiltinCommands(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+				stubs.Must(t, "failed to configure groups", auth.Configure(basicGroups))
+				stubs.Must(t, "failed to configure elevations", auth.ConfigureElevations(nil))
 				if tc.setup != nil {
 					tc.setup()
 				}
@@ -332,6 +566,9 @@ func Test_BuiltinCommands(t *testing.T) {
 				if tc.expectedMatch != "" {
 					stubs.AssertMatches(t, tc.expectedMatch, out)
 				}
+				if tc.expectedJobID != 0 {
+					stubs.AssertEquals(t, tc.expectedJobID, jobID)
+				}
 			}))
 		})
 	}
@@ -345,6 +582,7 @@ func Test_FilterJobsAudit(t *testing.T) {
 			ChannelID:   "123",
 			ChannelLink: "<#123>",
 			Username:    "someone",
+			UserID:      "someoneID",
 			Args:        []string{"some", "thing"},
 		}
 		r2 := request.Request{
@@ -353,10 +591,13 @@ func Test_FilterJobsAudit(t *testing.T) {
 			ChannelID:   "123",
 			ChannelLink: "<#123>",
 			Username:    "someoneelse",
+			UserID:      "someoneelseID",
 			Args:        []string{"something", "else"},
 		}
 
-		auth.Configure(basicGroups)
+		stubs.Must(t, "failed to configure groups", auth.Configure(basicGroups))
+		auth.SetUserResolver(stubs.UserResolverStub{"someone": "someoneID"})
+		defer auth.SetUserResolver(nil)
 		jobs.Create(r1)
 		jobs.Create(r2)
 		jobs.Create(r1)
@@ -369,7 +610,7 @@ func Test_FilterJobsAudit(t *testing.T) {
 		}
 
 		audit, err := cmd.Execute(context.Background(), jobs.Job{
-			Request: request.Request{Args: []string{"-user", "someone"}},
+			Request: request.Request{Args: []string{"-user", "@someone"}},
 		})
 		if err != nil {
 			t.Fatalf("Failed to execute audit: %s", err)
@@ -377,7 +618,7 @@ func Test_FilterJobsAudit(t *testing.T) {
 		stubs.AssertEquals(t, "*4* - now - *command* by *someone* in *<#123>* - *Running*\n*3* - now - *command* by *someone* in *<#123>* - *Running*\n*1* - now - *command* by *someone* in *<#123>* - *Running*\n", audit)
 
 		limit, err := cmd.Execute(context.Background(), jobs.Job{
-			Request: request.Request{Args: []string{"-user", "someone", "-limit", "2"}},
+			Request: request.Request{Args: []string{"-user", "<@someoneID>", "-limit", "2"}},
 		})
 		if err != nil {
 			t.Fatalf("Failed to execute audit: %s", err)
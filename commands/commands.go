@@ -25,6 +25,7 @@ func Reset() {
 	}
 
 	builtins.AddHelpCommand(commands)
+	builtins.AddAuthExplainCommand(commands)
 }
 
 // Find looks up the given command by name and returns.
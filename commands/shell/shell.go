@@ -6,9 +6,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"time"
 
+	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/command"
 	"github.com/gomeeseeks/meeseeks-box/jobs"
 	"github.com/gomeeseeks/meeseeks-box/jobs/logs"
@@ -21,6 +23,8 @@ type CommandOpts struct {
 	Args          []string
 	AllowedGroups []string
 	AuthStrategy  string
+	Channels      auth.ChannelRestrictions
+	ArgRules      []auth.ArgRule
 	Timeout       time.Duration
 	Templates     map[string]string
 	Help          string
@@ -59,6 +63,12 @@ func (c shellCommand) Execute(ctx context.Context, job jobs.Job) (string, error)
 	buffer := bytes.NewBufferString("")
 
 	cmd := exec.CommandContext(ctx, c.Cmd(), cmdArgs...)
+	if len(job.Request.Env) > 0 {
+		cmd.Env = os.Environ()
+		for name, value := range job.Request.Env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
 	op, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", SetError(fmt.Errorf("Could not create stdout pipe: %s", err))
@@ -122,6 +132,17 @@ func (c shellCommand) AllowedGroups() []string {
 	return c.opts.AllowedGroups
 }
 
+func (c shellCommand) ChannelRestrictions() auth.ChannelRestrictions {
+	return c.opts.Channels
+}
+
+func (c shellCommand) ArgRules() []auth.ArgRule {
+	if c.opts.ArgRules == nil {
+		return []auth.ArgRule{}
+	}
+	return c.opts.ArgRules
+}
+
 func (c shellCommand) Args() []string {
 	if c.opts.Args == nil {
 		return []string{}
@@ -50,6 +50,20 @@ func TestExecuteEcho(t *testing.T) {
 	})
 }
 
+func TestExecuteWithEnv(t *testing.T) {
+	stubs.WithTmpDB(func(_ string) {
+		out, err := shell.New(shell.CommandOpts{
+			Cmd:  "sh",
+			Args: []string{"-c", "echo $GREETING $HOME"},
+		}).Execute(context.Background(), jobs.Job{
+			ID:      4,
+			Request: request.Request{Env: map[string]string{"GREETING": "hello", "HOME": "/meeseeks"}},
+		})
+		stubs.Must(t, "failed to execute command with env", err)
+		stubs.AssertEquals(t, "hello /meeseeks\n", out)
+	})
+}
+
 func TestExecuteFail(t *testing.T) {
 	stubs.WithTmpDB(func(_ string) {
 		_, err := failCommand.Execute(context.Background(), jobs.Job{
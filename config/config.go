@@ -9,9 +9,14 @@ import (
 
 	"github.com/gomeeseeks/meeseeks-box/commands"
 	"github.com/gomeeseeks/meeseeks-box/commands/shell"
+	"github.com/gomeeseeks/meeseeks-box/duration"
 
 	"github.com/gomeeseeks/meeseeks-box/auth"
+	"github.com/gomeeseeks/meeseeks-box/auth/ldap"
 	"github.com/gomeeseeks/meeseeks-box/db"
+	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/ratelimit"
+	"github.com/gomeeseeks/meeseeks-box/tokens"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -26,17 +31,33 @@ const (
 
 // LoadFile reads the given filename, builds a configuration object and initializes
 // all the required subsystems
+//
+// The filename can either be a single yaml file or a directory, in which case
+// all the yaml files it contains are loaded in lexical order. Any file can also
+// include other files through the include list of globs, which are resolved
+// relative to the including file.
+//
+// Once loaded, secrets are read from files in every string value using the
+// {{ secret "path/to/file" }} syntax, and environment variables are expanded
+// with the ${VAR} syntax in the database settings and the secret fields, like
+// the slack token, where $${ is a literal ${. Secrets and the values of the
+// secret fields are redacted from the dumped configuration.
 func LoadFile(filename string) (Config, error) {
-	f, err := os.Open(filename)
+	files, err := configurationFiles(filename)
 	if err != nil {
-		return Config{}, fmt.Errorf("could not open configuration file %s: %s", filename, err)
+		return Config{}, err
 	}
 
-	cnf, err := New(f)
-	if err != nil {
-		return cnf, fmt.Errorf("configuration is invalid: %s", err)
+	l := newLoader()
+	for _, f := range files {
+		if err := l.load(f); err != nil {
+			return *l.config, fmt.Errorf("configuration is invalid: %s", err)
+		}
+	}
+	if err := interpolate(l.config); err != nil {
+		return *l.config, fmt.Errorf("configuration is invalid: %s", err)
 	}
-	return cnf, nil
+	return *l.config, nil
 }
 
 // LoadConfig loads the configuration in all the dependent subsystems
@@ -44,29 +65,146 @@ func LoadConfig(cnf Config) error {
 	if err := db.Configure(cnf.Database); err != nil {
 		return err
 	}
-	auth.Configure(cnf.Groups)
+	if err := configureGroupProviders(cnf); err != nil {
+		return err
+	}
+	if err := auth.Configure(cnf.Groups); err != nil {
+		return err
+	}
+	err := jobs.MigrateUserIDs(func(username string) (string, error) {
+		id, err := auth.FindUserID(username)
+		if err == auth.ErrUserNotFound {
+			return "", nil
+		}
+		return id, err
+	})
+	if err != nil {
+		return fmt.Errorf("could not migrate jobs: %s", err)
+	}
+	if err := tokens.MigrateHashes(); err != nil {
+		return fmt.Errorf("could not migrate tokens: %s", err)
+	}
+	if err := tokens.MigrateAllowArgs(); err != nil {
+		return fmt.Errorf("could not migrate tokens: %s", err)
+	}
 
+	rules := make([]auth.Rule, 0, len(cnf.Policy))
+	for i, r := range cnf.Policy {
+		rule, err := auth.NewRule(auth.RuleOpts{
+			Name:     r.Name,
+			Effect:   r.Effect,
+			Users:    r.Users,
+			Groups:   r.Groups,
+			Channels: r.Channels,
+			Commands: r.Commands,
+			Args:     r.Args,
+			Regex:    r.Regex,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid policy rule %d: %s", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	auth.ConfigurePolicy(rules)
+
+	elevationPolicies := make(map[string]auth.ElevationPolicy, len(cnf.Elevation.Groups))
+	for group, e := range cnf.Elevation.Groups {
+		elevationPolicies[group] = auth.ElevationPolicy{
+			Eligible:         e.Eligible,
+			MaxDuration:      time.Duration(e.MaxDuration),
+			RequiresApproval: e.RequiresApproval,
+			Approvers:        e.Approvers,
+		}
+	}
+	if err := auth.ConfigureElevations(elevationPolicies); err != nil {
+		return err
+	}
+
+	err = auth.ConfigureExternal(auth.ExternalConfig{
+		URL:      cnf.ExternalAuth.URL,
+		Timeout:  time.Duration(cnf.ExternalAuth.Timeout),
+		CacheTTL: time.Duration(cnf.ExternalAuth.CacheTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	commandLimits := make(map[string]ratelimit.Limits)
 	for name, cmd := range cnf.Commands {
-		commands.Add(name, shell.New(shell.CommandOpts{
-			AllowedGroups: cmd.AllowedGroups,
-			Args:          cmd.Args,
-			AuthStrategy:  cmd.AuthStrategy,
-			Cmd:           cmd.Cmd,
-			Help:          cmd.Help,
-			Templates:     cmd.Templates,
-			Timeout:       cmd.Timeout * time.Second,
-		}))
+		commandLimits[name] = cmd.RateLimits.limits()
+	}
+	if err := ratelimit.Configure(cnf.RateLimits.limits(), commandLimits); err != nil {
+		return fmt.Errorf("invalid rate limits: %s", err)
+	}
+
+	for name, cmd := range cnf.Commands {
+		opts, err := newCommandOpts(cmd)
+		if err != nil {
+			return fmt.Errorf("invalid command %s: %s", name, err)
+		}
+		if cmd.usesExternalAuth() && cnf.ExternalAuth.URL == "" {
+			return fmt.Errorf("invalid command %s: %s", name, auth.ErrExternalNotConfigured)
+		}
+		commands.Add(name, shell.New(opts))
 	}
 	return nil
 }
 
+func newCommandOpts(cmd Command) (shell.CommandOpts, error) {
+	argRules := make([]auth.ArgRule, 0, len(cmd.ArgRules))
+	for _, r := range cmd.ArgRules {
+		rule, err := auth.NewArgRule(r.Args, r.Regex, r.AuthStrategy, r.AllowedGroups)
+		if err != nil {
+			return shell.CommandOpts{}, err
+		}
+		argRules = append(argRules, rule)
+	}
+
+	return shell.CommandOpts{
+		AllowedGroups: cmd.AllowedGroups,
+		Args:          cmd.Args,
+		AuthStrategy:  cmd.AuthStrategy,
+		Channels: auth.ChannelRestrictions{
+			AllowedChannels: cmd.AllowedChannels,
+			DeniedChannels:  cmd.DeniedChannels,
+			IMOnly:          cmd.IMOnly,
+			ChannelsOnly:    cmd.ChannelsOnly,
+		},
+		ArgRules:  argRules,
+		Cmd:       cmd.Cmd,
+		Help:      cmd.Help,
+		Templates: cmd.Templates,
+		Timeout:   time.Duration(cmd.Timeout),
+	}, nil
+}
+
 // New parses the configuration from a reader into an object and returns it
 func New(r io.Reader) (Config, error) {
-	c := Config{
+	c := newDefaultConfig()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, fmt.Errorf("could not read configuration: %s", err)
+	}
+
+	err = yaml.Unmarshal(b, &c)
+	if err != nil {
+		return c, fmt.Errorf("could not parse configuration: %s", err)
+	}
+
+	if err = interpolate(&c); err != nil {
+		return c, fmt.Errorf("could not interpolate configuration: %s", err)
+	}
+
+	return c, nil
+}
+
+func newDefaultConfig() Config {
+	return Config{
 		Database: db.DatabaseConfig{
 			Path:    "meeseeks.db",
 			Mode:    0600,
-			Timeout: 2 * time.Second,
+			Timeout: duration.Duration(2 * time.Second),
 		},
 		Colors: MessageColors{
 			Info:    DefaultInfoColorMessage,
@@ -75,40 +213,250 @@ func New(r io.Reader) (Config, error) {
 		},
 		Pool: 20,
 	}
+}
 
-	b, err := ioutil.ReadAll(r)
+// Config is the struct used to load MrMeeseeks configuration yaml
+type Config struct {
+	Database     db.DatabaseConfig   `yaml:"database" interpolate:"env"`
+	Messages     map[string][]string `yaml:"messages"`
+	Commands     map[string]Command  `yaml:"commands"`
+	Colors       MessageColors       `yaml:"colors"`
+	Groups       map[string][]string `yaml:"groups"`
+	Policy       []PolicyRule        `yaml:"policy,omitempty"`
+	Elevation    Elevation           `yaml:"elevation,omitempty"`
+	RateLimits   RateLimits          `yaml:"rate_limits,omitempty"`
+	ExternalAuth ExternalAuth        `yaml:"external_auth,omitempty"`
+	LDAP         *LDAP               `yaml:"ldap,omitempty"`
+	UserGroups   UserGroups          `yaml:"user_groups,omitempty"`
+	Webhooks     map[string]Webhook  `yaml:"webhooks,omitempty"`
+	API          API                 `yaml:"api,omitempty"`
+	Pool         int                 `yaml:"pool"`
+	Include      []string            `yaml:"include,omitempty"`
+
+	SlackToken string `yaml:"slack_token,omitempty" secret:"true"`
+}
+
+// CommandConfig is the struct that handles a command configuration
+type Command struct {
+	Cmd             string            `yaml:"command"`
+	Args            []string          `yaml:"args"`
+	AllowedGroups   []string          `yaml:"allowed_groups"`
+	AuthStrategy    string            `yaml:"auth_strategy"`
+	AllowedChannels []string          `yaml:"allowed_channels,omitempty"`
+	DeniedChannels  []string          `yaml:"denied_channels,omitempty"`
+	IMOnly          bool              `yaml:"im_only,omitempty"`
+	ChannelsOnly    bool              `yaml:"channels_only,omitempty"`
+	ArgRules        []ArgRule         `yaml:"arg_rules,omitempty"`
+	RateLimits      RateLimits        `yaml:"rate_limits,omitempty"`
+	Timeout         duration.Duration `yaml:"timeout"`
+	Templates       map[string]string `yaml:"templates,omitempty"`
+	Help            string            `yaml:"help"`
+	Type            int               `yaml:"type,omitempty"`
+}
+
+// ArgRule overrides the command authorization when the request arguments match
+// the positional glob patterns in args and the regex, if they are set
+type ArgRule struct {
+	Args          []string `yaml:"args"`
+	Regex         string   `yaml:"regex,omitempty"`
+	AuthStrategy  string   `yaml:"auth_strategy"`
+	AllowedGroups []string `yaml:"allowed_groups"`
+}
+
+// PolicyRule allows or denies the requests that match all of its matchers,
+// rules are evaluated in order and the first one that matches decides
+type PolicyRule struct {
+	Name     string   `yaml:"name,omitempty"`
+	Effect   string   `yaml:"effect"`
+	Users    []string `yaml:"users,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+	Channels []string `yaml:"channels,omitempty"`
+	Commands []string `yaml:"commands,omitempty"`
+	Args     []string `yaml:"args,omitempty"`
+	Regex    string   `yaml:"regex,omitempty"`
+}
+
+// Elevation configures which groups users can be temporarily elevated to, and
+// the channel in which elevations are announced
+type Elevation struct {
+	AuditChannel string                    `yaml:"audit_channel,omitempty"`
+	Groups       map[string]ElevationGroup `yaml:"groups,omitempty"`
+}
+
+// ElevationGroup configures who can be temporarily elevated to a group, for how
+// long, and whether it requires the approval of a second person
+type ElevationGroup struct {
+	Eligible         []string          `yaml:"eligible"`
+	MaxDuration      duration.Duration `yaml:"max_duration"`
+	RequiresApproval bool              `yaml:"requires_approval"`
+	Approvers        []string          `yaml:"approvers,omitempty"`
+}
+
+// LDAP configures the directory from which groups are loaded and refreshed
+type LDAP struct {
+	URL             string            `yaml:"url"`
+	BindDN          string            `yaml:"bind_dn,omitempty"`
+	BindPassword    string            `yaml:"bind_password,omitempty" secret:"true"`
+	Groups          map[string]string `yaml:"groups"`
+	MemberAttribute string            `yaml:"member_attribute"`
+	UserAttribute   string            `yaml:"user_attribute"`
+	MatchBy         string            `yaml:"match_by"`
+	Timeout         duration.Duration `yaml:"timeout"`
+	Refresh         duration.Duration `yaml:"refresh"`
+}
+
+// DefaultGroupsRefresh is how often provided groups are loaded when the
+// refresh is not configured
+const DefaultGroupsRefresh = 5 * time.Minute
+
+func (c LDAP) refresh() time.Duration {
+	return refreshOrDefault(c.Refresh)
+}
+
+func (c LDAP) provider() (*ldap.Provider, error) {
+	p, err := ldap.New(ldap.Config{
+		URL:             c.URL,
+		BindDN:          c.BindDN,
+		BindPassword:    c.BindPassword,
+		Groups:          c.Groups,
+		MemberAttribute: c.MemberAttribute,
+		UserAttribute:   c.UserAttribute,
+		MatchBy:         c.MatchBy,
+		Timeout:         time.Duration(c.Timeout),
+	})
 	if err != nil {
-		return c, fmt.Errorf("could not read configuration: %s", err)
+		return nil, fmt.Errorf("invalid ldap configuration: %s", err)
 	}
+	return p, nil
+}
 
-	err = yaml.Unmarshal(b, &c)
-	if err != nil {
-		return c, fmt.Errorf("could not parse configuration: %s", err)
+// UserGroups maps groups to chat user groups, as in @sre, so their members are
+// kept in sync with the chat
+type UserGroups struct {
+	Groups  map[string]string `yaml:"groups"`
+	Refresh duration.Duration `yaml:"refresh"`
+}
+
+func (c UserGroups) refresh() time.Duration {
+	return refreshOrDefault(c.Refresh)
+}
+
+func refreshOrDefault(refresh duration.Duration) time.Duration {
+	if refresh <= 0 {
+		return DefaultGroupsRefresh
 	}
+	return time.Duration(refresh)
+}
 
-	return c, nil
+func configureGroupProviders(cnf Config) error {
+	providers := make([]auth.RefreshedGroupProvider, 0)
+	if cnf.LDAP != nil {
+		p, err := cnf.LDAP.provider()
+		if err != nil {
+			return err
+		}
+		providers = append(providers, auth.RefreshedGroupProvider{
+			GroupProvider: p,
+			Refresh:       cnf.LDAP.refresh(),
+		})
+	}
+	if len(cnf.UserGroups.Groups) > 0 {
+		providers = append(providers, auth.RefreshedGroupProvider{
+			GroupProvider: auth.NewUserGroupsProvider(cnf.UserGroups.Groups),
+			Refresh:       cnf.UserGroups.refresh(),
+		})
+	}
+	return auth.ConfigureGroupProviders(providers...)
 }
 
-// Config is the struct used to load MrMeeseeks configuration yaml
-type Config struct {
-	Database db.DatabaseConfig   `yaml:"database"`
-	Messages map[string][]string `yaml:"messages"`
-	Commands map[string]Command  `yaml:"commands"`
-	Colors   MessageColors       `yaml:"colors"`
-	Groups   map[string][]string `yaml:"groups"`
-	Pool     int                 `yaml:"pool"`
+// Webhook maps the JSON payloads received on a path to a command that runs as
+// the user in the channel, its path defaults to the name of the webhook
+//
+// Requests are verified with either the github or gitlab secret, or with basic
+// auth, and each arg is a template rendered with the payload.
+type Webhook struct {
+	Path     string   `yaml:"path,omitempty"`
+	Verify   string   `yaml:"verify"`
+	Secret   string   `yaml:"secret,omitempty" secret:"true"`
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty" secret:"true"`
+	Command  string   `yaml:"command"`
+	Args     []string `yaml:"args,omitempty"`
+	Channel  string   `yaml:"channel"`
+	User     string   `yaml:"user"`
 }
 
-// CommandConfig is the struct that handles a command configuration
-type Command struct {
-	Cmd           string            `yaml:"command"`
-	Args          []string          `yaml:"args"`
-	AllowedGroups []string          `yaml:"allowed_groups"`
-	AuthStrategy  string            `yaml:"auth_strategy"`
-	Timeout       time.Duration     `yaml:"timeout"`
-	Templates     map[string]string `yaml:"templates"`
-	Help          string            `yaml:"help"`
-	Type          int
+// API configures how the API server listens besides its address
+type API struct {
+	TLS    *APITLS    `yaml:"tls,omitempty"`
+	Socket *APISocket `yaml:"socket,omitempty"`
+}
+
+// APITLS configures the certificate of the API server, which is reloaded when
+// it changes, and the CA that signs the client certificates whose common names
+// are mapped to users
+type APITLS struct {
+	Cert              string            `yaml:"cert"`
+	Key               string            `yaml:"key"`
+	ClientCA          string            `yaml:"client_ca,omitempty"`
+	RequireClientCert bool              `yaml:"require_client_cert,omitempty"`
+	ClientUsers       map[string]string `yaml:"client_users,omitempty"`
+	Reload            duration.Duration `yaml:"reload,omitempty"`
+}
+
+// APISocket configures the unix socket the API server listens on
+type APISocket struct {
+	Path string      `yaml:"path"`
+	Mode os.FileMode `yaml:"file_mode,omitempty"`
+}
+
+// ExternalAuth configures the endpoint that decides which requests are allowed
+// for the commands that use the external auth strategy
+type ExternalAuth struct {
+	URL      string            `yaml:"url"`
+	Timeout  duration.Duration `yaml:"timeout"`
+	CacheTTL duration.Duration `yaml:"cache_ttl"`
+}
+
+// usesExternalAuth returns true when the command, or any of its argument
+// rules, uses the external auth strategy
+func (c Command) usesExternalAuth() bool {
+	if c.AuthStrategy == auth.AuthStrategyExternal {
+		return true
+	}
+	for _, r := range c.ArgRules {
+		if r.AuthStrategy == auth.AuthStrategyExternal {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimits limits how many requests are accepted from all the users together
+// and from each user separately
+type RateLimits struct {
+	Global  RateLimit `yaml:"global,omitempty"`
+	PerUser RateLimit `yaml:"per_user,omitempty"`
+}
+
+func (r RateLimits) limits() ratelimit.Limits {
+	return ratelimit.Limits{
+		Global:  r.Global.limit(),
+		PerUser: r.PerUser.limit(),
+	}
+}
+
+// RateLimit allows a number of requests per period, as in 3 requests per 1h
+type RateLimit struct {
+	Requests int               `yaml:"requests"`
+	Per      duration.Duration `yaml:"per"`
+}
+
+func (r RateLimit) limit() ratelimit.Limit {
+	return ratelimit.Limit{
+		Requests: r.Requests,
+		Per:      time.Duration(r.Per),
+	}
 }
 
 // MessageColors contains the configured reply message colora
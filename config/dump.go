@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/gomeeseeks/meeseeks-box/auth"
+	"github.com/gomeeseeks/meeseeks-box/commands/shell"
+	"github.com/gomeeseeks/meeseeks-box/duration"
+	"github.com/gomeeseeks/meeseeks-box/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Dump renders the effective configuration as yaml with all the defaults
+// applied and all the secrets redacted
+//
+// The configuration is rendered as it is loaded, so a new setting is dumped as
+// soon as it's added to Config. The values of the fields tagged with
+// secret:"true" are always redacted, along with the secrets and secret values
+// that show up anywhere else.
+func Dump(cnf Config) (string, error) {
+	c, err := withDefaults(cnf)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := yaml.Marshal(dumpValue(reflect.ValueOf(c), false))
+	if err != nil {
+		return "", fmt.Errorf("could not render configuration: %s", err)
+	}
+	return string(b), nil
+}
+
+// DumpLoaded renders the loaded configuration like Dump, but with the groups in
+// use, which are the ones stored in the database once it's seeded along with
+// the provided ones
+func DumpLoaded(cnf Config) (string, error) {
+	cnf.Groups = auth.GetGroups()
+	return Dump(cnf)
+}
+
+// withDefaults returns a copy of the configuration with the defaults that the
+// subsystems apply to it filled in
+func withDefaults(cnf Config) (Config, error) {
+	c := cnf
+
+	c.Messages = make(map[string][]string)
+	for name, messages := range template.GetDefaultMessages() {
+		c.Messages[name] = messages
+	}
+	for name, messages := range cnf.Messages {
+		c.Messages[name] = messages
+	}
+
+	c.Commands = make(map[string]Command, len(cnf.Commands))
+	for name, cmd := range cnf.Commands {
+		opts, err := newCommandOpts(cmd)
+		if err != nil {
+			return c, fmt.Errorf("invalid command %s: %s", name, err)
+		}
+		s := shell.New(opts)
+
+		argRules := make([]ArgRule, 0, len(cmd.ArgRules))
+		for i, rule := range s.ArgRules() {
+			r := cmd.ArgRules[i]
+			r.AuthStrategy = rule.AuthStrategy()
+			r.AllowedGroups = rule.AllowedGroups()
+			argRules = append(argRules, r)
+		}
+		cmd.ArgRules = argRules
+		cmd.Args = s.Args()
+		cmd.AuthStrategy = s.AuthStrategy()
+		cmd.AllowedGroups = s.AllowedGroups()
+		cmd.Timeout = duration.Duration(s.Timeout())
+		cmd.Templates = s.Templates()
+		c.Commands[name] = cmd
+	}
+
+	if c.ExternalAuth.URL != "" {
+		if c.ExternalAuth.Timeout <= 0 {
+			c.ExternalAuth.Timeout = duration.Duration(auth.DefaultExternalTimeout)
+		}
+		if c.ExternalAuth.CacheTTL == 0 {
+			c.ExternalAuth.CacheTTL = duration.Duration(auth.DefaultExternalCacheTTL)
+		}
+	}
+
+	c.Elevation.Groups = make(map[string]ElevationGroup, len(cnf.Elevation.Groups))
+	for group, elevation := range cnf.Elevation.Groups {
+		if elevation.MaxDuration <= 0 {
+			elevation.MaxDuration = duration.Duration(auth.DefaultMaxElevation)
+		}
+		c.Elevation.Groups[group] = elevation
+	}
+
+	if cnf.LDAP != nil {
+		p, err := cnf.LDAP.provider()
+		if err != nil {
+			return c, err
+		}
+		applied := p.Config()
+		c.LDAP = &LDAP{
+			URL:             applied.URL,
+			BindDN:          applied.BindDN,
+			BindPassword:    applied.BindPassword,
+			Groups:          applied.Groups,
+			MemberAttribute: applied.MemberAttribute,
+			UserAttribute:   applied.UserAttribute,
+			MatchBy:         applied.MatchBy,
+			Timeout:         duration.Duration(applied.Timeout),
+			Refresh:         duration.Duration(cnf.LDAP.refresh()),
+		}
+	}
+	if len(c.UserGroups.Groups) > 0 {
+		c.UserGroups.Refresh = duration.Duration(c.UserGroups.refresh())
+	}
+	return c, nil
+}
+
+var (
+	marshalerType = reflect.TypeOf((*yaml.Marshaler)(nil)).Elem()
+	fileModeType  = reflect.TypeOf(os.FileMode(0))
+)
+
+// dumpValue converts the value into plain yaml values following the yaml tags
+// of the structs, redacting the strings on the way
+func dumpValue(v reflect.Value, secret bool) interface{} {
+	if v.Type().Implements(marshalerType) {
+		value, err := v.Interface().(yaml.Marshaler).MarshalYAML()
+		if err != nil {
+			return err.Error()
+		}
+		return value
+	}
+	if v.Type() == fileModeType {
+		return fmt.Sprintf("%#o", v.Uint())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if secret && v.Len() > 0 {
+			return RedactedValue
+		}
+		return Redact(v.String())
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return dumpValue(v.Elem(), secret)
+
+	case reflect.Struct:
+		fields := yaml.MapSlice{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name, opts := yamlName(field)
+			if name == "-" || (strings.Contains(opts, "omitempty") && isEmpty(v.Field(i))) {
+				continue
+			}
+			fields = append(fields, yaml.MapItem{
+				Key:   name,
+				Value: dumpValue(v.Field(i), field.Tag.Get("secret") == "true"),
+			})
+		}
+		return fields
+
+	case reflect.Slice:
+		values := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, dumpValue(v.Index(i), secret))
+		}
+		return values
+
+	case reflect.Map:
+		values := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			values[fmt.Sprint(key.Interface())] = dumpValue(v.MapIndex(key), secret)
+		}
+		return values
+	}
+	return v.Interface()
+}
+
+// yamlName returns the name of the field as yaml marshals it, and the options
+// of its yaml tag
+func yamlName(field reflect.StructField) (string, string) {
+	tag := field.Tag.Get("yaml")
+	name, opts := tag, ""
+	if i := strings.Index(tag, ","); i >= 0 {
+		name, opts = tag[:i], tag[i+1:]
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, opts
+}
+
+// isEmpty returns whether the value is omitted by omitempty
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" && !isEmpty(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
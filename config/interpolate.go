@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue is used to replace secrets when rendering configuration values
+const RedactedValue = "<redacted>"
+
+// references matches the escaped $${, an environment variable reference as in
+// ${VAR}, or a secret reference as in {{ secret "path/to/file" }}
+var references = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\{\{\s*secret\s+"([^"]+)"\s*\}\}`)
+
+// secretReferences only matches the secret references, which are the only ones
+// expanded in the values that don't expand environment variables
+var secretReferences = regexp.MustCompile(`\{\{\s*secret\s+"([^"]+)"\s*\}\}`)
+
+var secrets = secretValues{
+	values: map[string]bool{},
+}
+
+type secretValues struct {
+	values map[string]bool
+	m      sync.Mutex
+}
+
+func (s *secretValues) add(value string) {
+	if value == "" {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.values[value] = true
+}
+
+func (s *secretValues) list() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	values := make([]string, 0, len(s.values))
+	for value := range s.values {
+		values = append(values, value)
+	}
+	// Longest first so a secret that contains another one is fully replaced
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	return values
+}
+
+// Redact replaces every secret value loaded from the configuration with a
+// redacted placeholder, it has to be used whenever configuration values are
+// logged or shown to a user.
+func Redact(s string) string {
+	for _, secret := range secrets.list() {
+		s = strings.Replace(s, secret, RedactedValue, -1)
+	}
+	return s
+}
+
+// Ways in which the strings of a field are interpolated, set with the
+// interpolate tag
+const (
+	// interpolateEnv expands environment variables along with secrets
+	interpolateEnv = "env"
+	// interpolateSecret is used for the fields tagged with secret:"true", which
+	// are interpolated like interpolateEnv and redacted
+	interpolateSecret = "secret"
+)
+
+// interpolate walks through all the string values of the configuration
+// replacing secret references with their values, and environment variables in
+// the fields tagged with interpolate:"env" or secret:"true"
+//
+// Any other value, like commands, templates and messages, keeps any ${VAR} it
+// contains as it is written. The values of the secret fields are redacted
+// along with the secrets.
+func interpolate(c *Config) error {
+	return walkStrings(reflect.ValueOf(c).Elem(), "", expand)
+}
+
+// walkStrings replaces every string contained in the value with the result of
+// invoking the passed function with it and the interpolation of the struct
+// field that contains it
+func walkStrings(v reflect.Value, tag string, f func(s, tag string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := f(v.String(), tag)
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return walkStrings(v.Elem(), tag, f)
+		}
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Field(i); field.CanSet() {
+				if err := walkStrings(field, interpolationOf(v.Type().Field(i), tag), f); err != nil {
+					return err
+				}
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkStrings(v.Index(i), tag, f); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values are not addressable, so they need to be copied over
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := walkStrings(value, tag, f); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	}
+	return nil
+}
+
+// interpolationOf returns how the strings of the field are interpolated, which
+// is set by its tags or else inherited from the field that contains it
+func interpolationOf(field reflect.StructField, parent string) string {
+	if tag := field.Tag.Get("interpolate"); tag != "" {
+		return tag
+	}
+	if field.Tag.Get("secret") == "true" {
+		return interpolateSecret
+	}
+	return parent
+}
+
+// expand replaces the references in the string as the interpolation requires
+func expand(s, interpolation string) (string, error) {
+	switch interpolation {
+	case interpolateEnv:
+		return expandEnv(s)
+	case interpolateSecret:
+		expanded, err := expandEnv(s)
+		secrets.add(expanded)
+		return expanded, err
+	}
+	return expandSecrets(s)
+}
+
+// expandEnv replaces the environment variables and the secret references in
+// the string, $${ is replaced with a literal ${
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := references.ReplaceAllStringFunc(s, func(match string) string {
+		if err != nil {
+			return match
+		}
+		if match == "$${" {
+			return "${"
+		}
+
+		groups := references.FindStringSubmatch(match)
+		if name := groups[1]; name != "" {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+			return value
+		}
+
+		value, e := readSecret(groups[2])
+		if e != nil {
+			err = e
+		}
+		return value
+	})
+	return expanded, err
+}
+
+func expandSecrets(s string) (string, error) {
+	var err error
+	expanded := secretReferences.ReplaceAllStringFunc(s, func(match string) string {
+		if err != nil {
+			return match
+		}
+		value, e := readSecret(secretReferences.FindStringSubmatch(match)[1])
+		if e != nil {
+			err = e
+		}
+		return value
+	})
+	return expanded, err
+}
+
+func readSecret(filename string) (string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret %s: %s", filename, err)
+	}
+	value := strings.TrimRight(string(b), "\r\n")
+	secrets.add(value)
+	return value, nil
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// loader merges multiple configuration files into a single configuration
+//
+// Files are merged in the order in which they are loaded: commands, webhooks
+// and elevation groups can only be defined once, group members are added up,
+// policy rules are appended, messages are overridden one by one, and any other
+// value defined in a later file overrides the previous one, like the rate
+// limits.
+type loader struct {
+	config *Config
+	loaded map[string]bool
+	// sources keeps the file in which each command, webhook and elevation
+	// group was defined
+	sources map[string]string
+}
+
+func newLoader() *loader {
+	c := newDefaultConfig()
+	return &loader{
+		config:  &c,
+		loaded:  map[string]bool{},
+		sources: map[string]string{},
+	}
+}
+
+func (l *loader) load(filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("could not resolve path for %s: %s", filename, err)
+	}
+	if l.loaded[filename] {
+		log.Debugf("Configuration file %s has already been loaded, skipping", filename)
+		return nil
+	}
+	l.loaded[filename] = true
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file %s: %s", filename, err)
+	}
+
+	commands, groups, policy := l.config.Commands, l.config.Groups, l.config.Policy
+	webhooks, elevations := l.config.Webhooks, l.config.Elevation.Groups
+	l.config.Commands, l.config.Groups, l.config.Policy, l.config.Include = nil, nil, nil, nil
+	l.config.Webhooks, l.config.Elevation.Groups = nil, nil
+
+	if err = yaml.Unmarshal(b, l.config); err != nil {
+		return fmt.Errorf("could not parse configuration file %s: %s", filename, err)
+	}
+	log.Debugf("Loaded configuration file %s", filename)
+
+	fileCommands, fileGroups, includes := l.config.Commands, l.config.Groups, l.config.Include
+	fileWebhooks, fileElevations := l.config.Webhooks, l.config.Elevation.Groups
+	l.config.Commands, l.config.Groups, l.config.Include = commands, groups, nil
+	l.config.Webhooks, l.config.Elevation.Groups = webhooks, elevations
+	l.config.Policy = append(policy, l.config.Policy...)
+
+	if err = l.mergeCommands(filename, fileCommands); err != nil {
+		return err
+	}
+	if err = l.mergeWebhooks(filename, fileWebhooks); err != nil {
+		return err
+	}
+	if err = l.mergeElevationGroups(filename, fileElevations); err != nil {
+		return err
+	}
+	l.mergeGroups(fileGroups)
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("invalid include %s in %s: %s", include, filename, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err = l.load(match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *loader) mergeCommands(filename string, commands map[string]Command) error {
+	if len(commands) == 0 {
+		return nil
+	}
+	if l.config.Commands == nil {
+		l.config.Commands = make(map[string]Command)
+	}
+	for name, cmd := range commands {
+		if err := l.define("command", name, filename); err != nil {
+			return err
+		}
+		l.config.Commands[name] = cmd
+	}
+	return nil
+}
+
+func (l *loader) mergeWebhooks(filename string, webhooks map[string]Webhook) error {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	if l.config.Webhooks == nil {
+		l.config.Webhooks = make(map[string]Webhook)
+	}
+	for name, webhook := range webhooks {
+		if err := l.define("webhook", name, filename); err != nil {
+			return err
+		}
+		l.config.Webhooks[name] = webhook
+	}
+	return nil
+}
+
+func (l *loader) mergeElevationGroups(filename string, groups map[string]ElevationGroup) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	if l.config.Elevation.Groups == nil {
+		l.config.Elevation.Groups = make(map[string]ElevationGroup)
+	}
+	for name, group := range groups {
+		if err := l.define("elevation group", name, filename); err != nil {
+			return err
+		}
+		l.config.Elevation.Groups[name] = group
+	}
+	return nil
+}
+
+// define records the file in which the named entry is defined, it fails when
+// it was already defined in another file
+func (l *loader) define(kind, name, filename string) error {
+	key := kind + " " + name
+	if source, ok := l.sources[key]; ok {
+		return fmt.Errorf("%s %s is defined both in %s and %s", kind, name, source, filename)
+	}
+	l.sources[key] = filename
+	return nil
+}
+
+func (l *loader) mergeGroups(groups map[string][]string) {
+	if len(groups) == 0 {
+		return
+	}
+	if l.config.Groups == nil {
+		l.config.Groups = make(map[string][]string)
+	}
+	for name, users := range groups {
+		existing := l.config.Groups[name]
+		for _, user := range users {
+			if !contains(existing, user) {
+				existing = append(existing, user)
+			}
+		}
+		l.config.Groups[name] = existing
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// configurationFiles returns the list of files to load given a path, which is
+// the file itself, or all the yaml files contained when it is a directory
+func configurationFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open configuration file %s: %s", path, err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	// ReadDir returns the entries sorted by name, which makes the load order deterministic
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration directory %s: %s", path, err)
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml":
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
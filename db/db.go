@@ -7,6 +7,7 @@ import (
 	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/duration"
 )
 
 var databaseConfig DatabaseConfig
@@ -14,9 +15,9 @@ var database *bolt.DB
 
 // DatabaseConfig holds the configuration for the BoltDB database
 type DatabaseConfig struct {
-	Path    string        `yaml:"path"`
-	Timeout time.Duration `yaml:"timeout"`
-	Mode    os.FileMode   `yaml:"file_mode"`
+	Path    string            `yaml:"path"`
+	Timeout duration.Duration `yaml:"timeout"`
+	Mode    os.FileMode       `yaml:"file_mode"`
 }
 
 // Configure loads the required configuration to be able of connecting to a database
@@ -37,7 +38,7 @@ func Configure(cnf DatabaseConfig) error {
 // Open opens a new connection to the database
 func open() (*bolt.DB, error) {
 	return bolt.Open(databaseConfig.Path, databaseConfig.Mode, &bolt.Options{
-		Timeout: databaseConfig.Timeout,
+		Timeout: time.Duration(databaseConfig.Timeout),
 	})
 }
 
@@ -105,3 +106,26 @@ func Close() error {
 	}
 	return database.Close()
 }
+
+var migrationsBucketKey = []byte("migrations")
+
+// Migrate runs the migration function within the read-write transaction unless
+// a migration with the same name was already applied, in which case it's
+// skipped. The migration is recorded as applied when the function succeeds.
+func Migrate(tx *bolt.Tx, name string, f func() error) error {
+	bucket, err := tx.CreateBucketIfNotExists(migrationsBucketKey)
+	if err != nil {
+		return fmt.Errorf("could not get migrations bucket: %s", err)
+	}
+	if bucket.Get([]byte(name)) != nil {
+		return nil
+	}
+	if err = f(); err != nil {
+		return fmt.Errorf("migration %s failed: %s", name, err)
+	}
+	appliedAt, err := time.Now().UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(name), appliedAt)
+}
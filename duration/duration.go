@@ -0,0 +1,56 @@
+package duration
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Duration is a time.Duration that can be loaded from the configuration either
+// as a bare number of seconds, for backwards compatibility, or as a duration
+// string like 90s, 5m or 1h30m
+type Duration time.Duration
+
+// Parse parses a duration from a string, bare numbers are interpreted as seconds
+func Parse(s string) (Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		d := Duration(seconds * float64(time.Second))
+		if seconds != 0 {
+			log.Warnf("Duration %s has no unit and is being interpreted as %s, please use \"%s\" instead",
+				s, d, d)
+		}
+		return d, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %s, it should be a number of seconds or a duration like 5m: %s", s, err)
+	}
+	return Duration(d), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// String returns the duration formatted like time.Duration
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
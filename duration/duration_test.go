@@ -0,0 +1,42 @@
+package duration_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/duration"
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func Test_DurationParsing(t *testing.T) {
+	tt := []struct {
+		name     string
+		content  string
+		expected time.Duration
+	}{
+		{"bare seconds", "timeout: 5", 5 * time.Second},
+		{"fractional seconds", "timeout: 1.5", 1500 * time.Millisecond},
+		{"zero", "timeout: 0", 0},
+		{"minutes", "timeout: 5m", 5 * time.Minute},
+		{"composed", "timeout: 1h30m", 90 * time.Minute},
+		{"quoted seconds", "timeout: \"30s\"", 30 * time.Second},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := struct {
+				Timeout duration.Duration `yaml:"timeout"`
+			}{}
+			stubs.Must(t, "failed to parse duration", yaml.Unmarshal([]byte(tc.content), &c))
+			stubs.AssertEquals(t, tc.expected, time.Duration(c.Timeout))
+		})
+	}
+}
+
+func Test_InvalidDuration(t *testing.T) {
+	_, err := duration.Parse("5 minutes")
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid duration 5 minutes, it should be a number of seconds or a duration like 5m") {
+		t.Fatalf("wrong error parsing an invalid duration: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gomeeseeks/meeseeks-box/db"
+	"github.com/gomeeseeks/meeseeks-box/jobs/logs"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 
 	"encoding/json"
@@ -23,6 +24,9 @@ const (
 
 var jobsBucketKey = []byte("jobs")
 
+// userIDsMigration fills in the user ID of jobs recorded without it
+const userIDsMigration = "jobs-user-ids"
+
 // ErrNoJobWithID is returned when we can't find a job with the proposed id
 var ErrNoJobWithID = errors.New("no job could be found")
 
@@ -56,7 +60,7 @@ func Create(req request.Request) (Job, error) {
 			Status:    RunningStatus,
 		}
 
-		log.Debugf("Creating job %#v", job)
+		log.Debugf("Creating job %d running %s with env %s", jobID, req.Command, request.EnvNames(req.Env))
 		return save(job, bucket)
 	})
 	if err != nil {
@@ -93,7 +97,7 @@ func (j Job) Finish(status string) error {
 	if !(status == SuccessStatus || status == FailedStatus) {
 		return fmt.Errorf("invalid status %s", status)
 	}
-	return change(j.ID, func(job *Job) error {
+	err := change(j.ID, func(job *Job) error {
 		if job.Status != RunningStatus {
 			return fmt.Errorf("job is not in running status")
 		}
@@ -101,6 +105,10 @@ func (j Job) Finish(status string) error {
 		job.Status = status
 		return nil
 	})
+	if err == nil {
+		logs.Finish(j.ID)
+	}
+	return err
 }
 
 // JobFilter provides the basic tooling to filter jobs when using Find
@@ -159,6 +167,60 @@ func Find(filter JobFilter) ([]Job, error) {
 	return latest, err
 }
 
+// MigrateUserIDs fills in the user ID of the jobs that were recorded without
+// one, resolving it from the username. The resolve function should return an
+// empty ID when the user can't be found, these jobs are left as they are.
+func MigrateUserIDs(resolve func(username string) (string, error)) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return db.Migrate(tx, userIDsMigration, func() error {
+			bucket := tx.Bucket(jobsBucketKey)
+			if bucket == nil {
+				return nil
+			}
+
+			ids := make(map[string]string)
+			migrated := make([]*Job, 0)
+			err := bucket.ForEach(func(_, payload []byte) error {
+				job := &Job{}
+				if err := json.Unmarshal(payload, job); err != nil {
+					return fmt.Errorf("failed to load Job payload %s", err)
+				}
+				if job.Request.UserID != "" {
+					return nil
+				}
+
+				username := job.Request.Username
+				id, ok := ids[username]
+				if !ok {
+					var err error
+					if id, err = resolve(username); err != nil {
+						return fmt.Errorf("could not resolve user %s: %s", username, err)
+					}
+					ids[username] = id
+				}
+				if id == "" {
+					log.Warnf("Could not find user %s, job %d is left without user ID", username, job.ID)
+					return nil
+				}
+				job.Request.UserID = id
+				migrated = append(migrated, job)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, job := range migrated {
+				if err := save(job, bucket); err != nil {
+					return err
+				}
+			}
+			log.Infof("Migrated %d jobs to user IDs", len(migrated))
+			return nil
+		})
+	})
+}
+
 func change(id uint64, f func(job *Job) error) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(jobsBucketKey)
@@ -1,6 +1,7 @@
 package jobs_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/gomeeseeks/meeseeks-box/jobs"
@@ -46,6 +47,20 @@ func Test_CreatingAndThenGettingAJob(t *testing.T) {
 	}))
 }
 
+func Test_EnvIsNotStored(t *testing.T) {
+	stub.Must(t, "failed to run tests", stub.WithTmpDB(func(_ string) {
+		withEnv := req
+		withEnv.Env = map[string]string{"PASSWORD": "secret"}
+		job, err := jobs.Create(withEnv)
+		stub.Must(t, "Could not store a job: ", err)
+		stub.AssertEquals(t, withEnv.Env, job.Request.Env)
+
+		actual, err := jobs.Get(job.ID)
+		stub.Must(t, "Could not retrieve a job: ", err)
+		stub.AssertEquals(t, map[string]string(nil), actual.Request.Env)
+	}))
+}
+
 func Test_MarkSuccessFul(t *testing.T) {
 	stub.Must(t, "failed to run tests", stub.WithTmpDB(func(_ string) {
 		job, err := jobs.Create(req)
@@ -106,3 +121,41 @@ func Test_FilterReturnsEnough(t *testing.T) {
 		stub.AssertEquals(t, uint64(1), latest[1].ID)
 	}))
 }
+
+func Test_MigrateUserIDs(t *testing.T) {
+	stub.Must(t, "failed to run tests", stub.WithTmpDB(func(_ string) {
+		withID := req
+		withID.UserID = "someoneID"
+		unknown := req
+		unknown.Username = "gone"
+
+		_, err := jobs.Create(req)
+		stub.Must(t, "Could not store a job: ", err)
+		_, err = jobs.Create(withID)
+		stub.Must(t, "Could not store a job: ", err)
+		_, err = jobs.Create(unknown)
+		stub.Must(t, "Could not store a job: ", err)
+
+		resolve := func(username string) (string, error) {
+			if username == "myself" {
+				return "myselfID", nil
+			}
+			return "", nil
+		}
+		stub.Must(t, "could not migrate jobs", jobs.MigrateUserIDs(resolve))
+
+		userIDs := make([]string, 0)
+		for _, id := range []uint64{1, 2, 3} {
+			job, err := jobs.Get(id)
+			stub.Must(t, "Could not retrieve a job: ", err)
+			userIDs = append(userIDs, job.Request.UserID)
+		}
+		stub.AssertEquals(t, []string{"myselfID", "someoneID", ""}, userIDs)
+
+		_, err = jobs.Create(req)
+		stub.Must(t, "Could not store a job: ", err)
+		stub.Must(t, "could not migrate jobs", jobs.MigrateUserIDs(func(_ string) (string, error) {
+			return "", fmt.Errorf("migrations should only run once")
+		}))
+	}))
+}
@@ -29,24 +29,31 @@ func (j JobLog) GetError() error {
 	return errors.New(j.Error)
 }
 
-// Append adds a new line to the logs of the given Job
+// Append adds a new line to the logs of the given Job, and sends it to the
+// subscribers of the job logs
 func Append(jobID uint64, content string) error {
 	if content == "" {
 		return nil
 	}
-	return db.Update(func(tx *bolt.Tx) error {
+	var sequence uint64
+	err := db.Update(func(tx *bolt.Tx) error {
 		jobBucket, err := getJobBucket(jobID, tx)
 		if err != nil {
 			return fmt.Errorf("could not get job %d bucket: %s", jobID, err)
 		}
 
-		sequence, err := jobBucket.NextSequence()
+		sequence, err = jobBucket.NextSequence()
 		if err != nil {
 			return fmt.Errorf("could not get next sequence for job %d: %s", jobID, err)
 		}
 
 		return jobBucket.Put(db.IDToBytes(sequence), []byte(content))
 	})
+	if err != nil {
+		return err
+	}
+	subscribers.publish(jobID, Line{Sequence: sequence, Content: content})
+	return nil
 }
 
 // SetError sets the error message for the given Job
@@ -78,3 +78,52 @@ func Test_ErredOutJobHasError(t *testing.T) {
 		stubs.AssertEquals(t, logs.JobLog{Error: "nasty error"}, l)
 	})
 }
+
+func Test_LogsSubscription(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to append logs", logs.Append(1, "before\n"))
+
+		sub := logs.Subscribe(1)
+		other := logs.Subscribe(2)
+		defer other.Unsubscribe()
+
+		stubs.Must(t, "failed to append logs", logs.Append(1, "after\n"))
+		stubs.Must(t, "failed to set the error", logs.SetError(1, errors.New("failed")))
+
+		lines, err := logs.GetLines(1)
+		stubs.Must(t, "failed to get the lines", err)
+		stubs.AssertEquals(t, []logs.Line{{Sequence: 1, Content: "before\n"}, {Sequence: 2, Content: "after\n"}}, lines)
+
+		stubs.AssertEquals(t, logs.Line{Sequence: 2, Content: "after\n"}, <-sub.Lines)
+
+		logs.Finish(1)
+		_, ok := <-sub.Lines
+		stubs.AssertEquals(t, false, ok)
+		stubs.AssertEquals(t, false, sub.Overflowed())
+		sub.Unsubscribe()
+
+		select {
+		case l := <-other.Lines:
+			t.Fatalf("unexpected line for another job: %#v", l)
+		default:
+		}
+	}))
+}
+
+func Test_LogsSubscriptionOverflow(t *testing.T) {
+	stubs.Must(t, "failed to create a temporary DB", stubs.WithTmpDB(func(_ string) {
+		sub := logs.Subscribe(1)
+		defer sub.Unsubscribe()
+
+		for i := 0; i <= logs.SubscriptionBuffer; i++ {
+			stubs.Must(t, "failed to append logs", logs.Append(1, "line\n"))
+		}
+
+		count := 0
+		for range sub.Lines {
+			count++
+		}
+		stubs.AssertEquals(t, logs.SubscriptionBuffer, count)
+		stubs.AssertEquals(t, true, sub.Overflowed())
+	}))
+}
@@ -0,0 +1,145 @@
+package logs
+
+import (
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
+)
+
+// SubscriptionBuffer is how many lines a subscription can fall behind before
+// it's closed as overflowed
+const SubscriptionBuffer = 256
+
+// Line is a chunk of the output of a job, as it was appended
+type Line struct {
+	Sequence uint64
+	Content  string
+}
+
+// Subscription receives the lines appended to the logs of a job, its Lines
+// channel is closed when the job finishes, when the subscriber falls too far
+// behind, or when it unsubscribes
+type Subscription struct {
+	Lines <-chan Line
+
+	jobID      uint64
+	ch         chan Line
+	overflowed bool
+	closed     bool
+}
+
+type subscriptions struct {
+	byJob map[uint64]map[*Subscription]bool
+	m     sync.Mutex
+}
+
+var subscribers = &subscriptions{
+	byJob: map[uint64]map[*Subscription]bool{},
+}
+
+// Subscribe starts receiving the lines appended to the logs of the job, the
+// subscription should be unsubscribed once it's not needed anymore
+func Subscribe(jobID uint64) *Subscription {
+	ch := make(chan Line, SubscriptionBuffer)
+	s := &Subscription{
+		Lines: ch,
+		jobID: jobID,
+		ch:    ch,
+	}
+
+	subscribers.m.Lock()
+	defer subscribers.m.Unlock()
+
+	subs, ok := subscribers.byJob[jobID]
+	if !ok {
+		subs = make(map[*Subscription]bool)
+		subscribers.byJob[jobID] = subs
+	}
+	subs[s] = true
+	return s
+}
+
+// Unsubscribe stops receiving lines, closing the Lines channel
+func (s *Subscription) Unsubscribe() {
+	subscribers.m.Lock()
+	defer subscribers.m.Unlock()
+
+	subscribers.remove(s)
+}
+
+// Overflowed returns whether the subscription was closed because the
+// subscriber fell too far behind
+func (s *Subscription) Overflowed() bool {
+	subscribers.m.Lock()
+	defer subscribers.m.Unlock()
+
+	return s.overflowed
+}
+
+// Finish closes the subscriptions to the logs of the job as no more lines will
+// be appended
+func Finish(jobID uint64) {
+	subscribers.m.Lock()
+	defer subscribers.m.Unlock()
+
+	for s := range subscribers.byJob[jobID] {
+		subscribers.remove(s)
+	}
+}
+
+// publish sends the line to the subscribers of the job without blocking, the
+// subscribers that can't keep up are dropped
+func (p *subscriptions) publish(jobID uint64, line Line) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for s := range p.byJob[jobID] {
+		select {
+		case s.ch <- line:
+		default:
+			s.overflowed = true
+			p.remove(s)
+		}
+	}
+}
+
+// remove closes and forgets the subscription, it must be called holding the
+// lock
+func (p *subscriptions) remove(s *Subscription) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+
+	subs := p.byJob[s.jobID]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(p.byJob, s.jobID)
+	}
+}
+
+// GetLines returns the lines of the logs of the job along with their sequence,
+// which can be used to skip the lines also received by a subscription
+func GetLines(jobID uint64) ([]Line, error) {
+	lines := make([]Line, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		logsBucket := tx.Bucket(logsBucketKey)
+		if logsBucket == nil {
+			return nil
+		}
+		jobBucket := logsBucket.Bucket(db.IDToBytes(jobID))
+		if jobBucket == nil {
+			return nil
+		}
+		return jobBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil // the error bucket
+			}
+			lines = append(lines, Line{Sequence: db.IDFromBytes(k), Content: string(v)})
+			return nil
+		})
+	})
+	return lines, err
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
+	"time"
 
 	"github.com/gomeeseeks/meeseeks-box/formatter"
 
 	"github.com/gomeeseeks/meeseeks-box/api"
+	"github.com/gomeeseeks/meeseeks-box/auth"
+	"github.com/gomeeseeks/meeseeks-box/commands"
+	"github.com/gomeeseeks/meeseeks-box/commands/builtins"
 	"github.com/gomeeseeks/meeseeks-box/config"
 	"github.com/gomeeseeks/meeseeks-box/messenger"
+	"github.com/gomeeseeks/meeseeks-box/ratelimit"
 	"github.com/gomeeseeks/meeseeks-box/slack"
+	"github.com/gomeeseeks/meeseeks-box/tokens"
 
 	"github.com/gomeeseeks/meeseeks-box/meeseeks"
 	"github.com/gomeeseeks/meeseeks-box/version"
@@ -23,8 +32,9 @@ func main() {
 	debugMode := flag.Bool("debug", false, "enabled debug mode")
 	debugSlack := flag.Bool("debug-slack", false, "enabled debug mode for slack")
 	showVersion := flag.Bool("version", false, "print the version and exit")
-	apiAddress := flag.String("api-endpoint", ":9696", "api endpoint in which to listen for api calls")
+	apiAddress := flag.String("api-endpoint", ":9696", "api endpoint in which to listen for api calls, empty to only listen on the configured socket")
 	apiPath := flag.String("api-path", "/message", "api path in to listen for api calls")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
 
 	flag.Parse()
 
@@ -41,29 +51,71 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := config.LoadConfig(cnf); err != nil {
-		log.Fatalf("Could not load configuration: %s", err)
+
+	if *printConfig {
+		out, err := config.Dump(cnf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(out)
+		os.Exit(0)
 	}
 
-	log.Info("Loaded configuration")
+	slackToken := cnf.SlackToken
+	if slackToken == "" {
+		slackToken = os.Getenv("SLACK_TOKEN")
+	}
 
-	slackClient, err := slack.Connect(*debugSlack, os.Getenv("SLACK_TOKEN"))
+	slackClient, err := slack.Connect(*debugSlack, slackToken)
 	if err != nil {
 		log.Fatalf("Could not connect to slack: %s", err)
 	}
 
 	log.Info("Connected to slack")
 
+	// Users configured by name are resolved to IDs when the configuration is loaded
+	auth.SetUserResolver(slackClient)
+
+	if err := config.LoadConfig(cnf); err != nil {
+		log.Fatalf("Could not load configuration: %s", err)
+	}
+
+	commands.Add(builtins.BuiltinConfigCommand, builtins.NewConfigCommand(func() (string, error) {
+		return config.DumpLoaded(cnf)
+	}))
+
+	log.Info("Loaded configuration")
+
+	if channel := cnf.Elevation.AuditChannel; channel != "" {
+		auth.SetElevationNotifier(func(message string) {
+			if err := slackClient.Reply(message, cnf.Colors.Info, channel); err != nil {
+				log.Errorf("Could not announce elevation in %s: %s", channel, err)
+			}
+		})
+	}
+
 	apiServer := api.NewServer(slackClient, *apiAddress)
+	if err := apiServer.Configure(listenOpts(cnf)); err != nil {
+		log.Fatalf("Could not configure API server: %s", err)
+	}
+	for _, opts := range webhookOpts(cnf) {
+		if err := apiServer.RegisterWebhook(opts); err != nil {
+			log.Fatalf("Could not register webhook: %s", err)
+		}
+	}
 	go func() {
-		err = apiServer.ListenAndServe(*apiPath)
-		if err != nil {
+		err := apiServer.ListenAndServe(*apiPath)
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Could not start API server: %s", err)
 		}
 	}()
 
 	log.Infof("Started api server on %s%s", *apiAddress, *apiPath)
 
+	stopSweeper := make(chan bool)
+	go tokens.SweepEvery(tokens.DefaultSweepInterval, stopSweeper)
+	go ratelimit.SweepEvery(ratelimit.DefaultSweepInterval, stopSweeper)
+
 	msgs, err := messenger.Listen(slackClient, apiServer.GetListener())
 	if err != nil {
 		log.Fatalf("Could not initialize messenger subsystem: %s", err)
@@ -76,16 +128,67 @@ func main() {
 
 	log.Info("Started commands pipeline")
 
-	signalCh := make(chan os.Signal)
+	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 
 	// Listen for a signal forever
 	sig := <-signalCh
 	log.Infof("Got signal %s, trying to gracefully shutdown", sig)
 
+	close(stopSweeper)
 	apiServer.Shutdown()
 	msgs.Shutdown()
 	meeseek.Shutdown()
 
 	log.Infof("All done, quitting")
 }
+
+// webhookOpts returns the options to register the configured webhooks, sorted
+// by name
+func webhookOpts(cnf config.Config) []api.WebhookOpts {
+	names := make([]string, 0, len(cnf.Webhooks))
+	for name := range cnf.Webhooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	opts := make([]api.WebhookOpts, 0, len(names))
+	for _, name := range names {
+		w := cnf.Webhooks[name]
+		opts = append(opts, api.WebhookOpts{
+			Name:     name,
+			Path:     w.Path,
+			Verify:   w.Verify,
+			Secret:   w.Secret,
+			Username: w.Username,
+			Password: w.Password,
+			Command:  w.Command,
+			Args:     w.Args,
+			Channel:  w.Channel,
+			User:     w.User,
+		})
+	}
+	return opts
+}
+
+// listenOpts returns the options for the API server to listen
+func listenOpts(cnf config.Config) api.ListenOpts {
+	opts := api.ListenOpts{}
+	if t := cnf.API.TLS; t != nil {
+		opts.TLS = &api.TLSOpts{
+			Cert:              t.Cert,
+			Key:               t.Key,
+			ClientCA:          t.ClientCA,
+			RequireClientCert: t.RequireClientCert,
+			ClientUsers:       t.ClientUsers,
+			Reload:            time.Duration(t.Reload),
+		}
+	}
+	if s := cnf.API.Socket; s != nil {
+		opts.Socket = &api.SocketOpts{
+			Path: s.Path,
+			Mode: s.Mode,
+		}
+	}
+	return opts
+}
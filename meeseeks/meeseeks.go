@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/gomeeseeks/meeseeks-box/commands/builtins"
 	"github.com/sirupsen/logrus"
@@ -11,7 +12,9 @@ import (
 	"github.com/gomeeseeks/meeseeks-box/command"
 	"github.com/gomeeseeks/meeseeks-box/formatter"
 	"github.com/gomeeseeks/meeseeks-box/jobs"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
 	"github.com/gomeeseeks/meeseeks-box/messenger"
+	"github.com/gomeeseeks/meeseeks-box/ratelimit"
 
 	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/commands"
@@ -36,8 +39,34 @@ type Meeseeks struct {
 }
 
 type task struct {
-	job jobs.Job
-	cmd command.Command
+	job      jobs.Job
+	cmd      command.Command
+	observer JobObserver
+}
+
+// JobObserver is implemented by the messages whose sender wants to know what
+// happens with the requested command, as the API does
+type JobObserver interface {
+	// JobRejected is called when the message doesn't get to start a job
+	JobRejected(err error)
+	// JobStarted is called with the job once it's created
+	JobStarted(job jobs.Job)
+	// JobFinished is called with the finished job, and the output and error of
+	// the command
+	JobFinished(job jobs.Job, output string, err error)
+}
+
+type noObserver struct{}
+
+func (noObserver) JobRejected(_ error)                       {}
+func (noObserver) JobStarted(_ jobs.Job)                     {}
+func (noObserver) JobFinished(_ jobs.Job, _ string, _ error) {}
+
+func observerOf(msg message.Message) JobObserver {
+	if o, ok := msg.(JobObserver); ok {
+		return o
+	}
+	return noObserver{}
 }
 
 // New creates a new Meeseeks service
@@ -45,6 +74,7 @@ func New(client ChatClient, messenger *messenger.Messenger, formatter *formatter
 	ac := newActiveCommands()
 	commands.Add(builtins.BuiltinCancelJobCommand, builtins.NewCancelJobCommand(ac.Cancel))
 	commands.Add(builtins.BuiltinKillJobCommand, builtins.NewKillJobCommand(ac.Cancel))
+	ratelimit.Exempt(builtins.BuiltinCancelJobCommand, builtins.BuiltinKillJobCommand)
 
 	m := Meeseeks{
 		messenger: messenger,
@@ -64,20 +94,37 @@ func New(client ChatClient, messenger *messenger.Messenger, formatter *formatter
 // Start launches the meeseeks to read messages from the MessageCh
 func (m *Meeseeks) Start() {
 	for msg := range m.messenger.MessagesCh() {
+		observer := observerOf(msg)
+
 		req, err := request.FromMessage(msg)
 		if err != nil {
 			logrus.Debugf("Failed to parse message '%s' as a command: %s", msg.GetText(), err)
 			m.replyWithError(msg, err)
+			observer.JobRejected(err)
 			continue
 		}
 
 		cmd, ok := commands.Find(req.Command)
 		if !ok {
 			m.replyWithUnknownCommand(req)
+			observer.JobRejected(fmt.Errorf("unknown command %s", req.Command))
 			continue
 		}
-		if err = auth.Check(req.Username, cmd); err != nil {
-			m.replyWithUnauthorizedCommand(req, cmd)
+		if err = auth.Check(req, cmd); err != nil {
+			m.replyWithUnauthorizedCommand(req, cmd, err)
+			observer.JobRejected(err)
+			continue
+		}
+		limit, err := ratelimit.Take(req.Command, req.UserID)
+		if err != nil {
+			m.replyWithError(msg, err)
+			observer.JobRejected(err)
+			continue
+		}
+		if !limit.Allowed {
+			m.replyWithRateLimitedCommand(req, cmd, limit)
+			observer.JobRejected(fmt.Errorf("rate limit %s exceeded, retry at %s", limit.Limit,
+				limit.RetryAt.UTC().Format(time.RFC3339)))
 			continue
 		}
 
@@ -86,9 +133,13 @@ func (m *Meeseeks) Start() {
 
 		t, err := m.createTask(req, cmd)
 		if err != nil {
-			m.replyWithError(msg, fmt.Errorf("could not create job: %s", err))
+			err = fmt.Errorf("could not create job: %s", err)
+			m.replyWithError(msg, err)
+			observer.JobRejected(err)
 			continue
 		}
+		t.observer = observer
+		observer.JobStarted(t.job)
 
 		m.wg.Add(1)
 		m.tasksCh <- t
@@ -137,12 +188,16 @@ func (m *Meeseeks) loop() {
 					req.Command, req.Username, err)
 				m.replyWithCommandFailed(req, cmd, err, out)
 				job.Finish(jobs.FailedStatus)
+				job.Status = jobs.FailedStatus
 			} else {
 				logrus.Infof("Command '%s' from user '%s' succeeded execution", req.Command,
 					req.Username)
 				m.replyWithSuccess(job.Request, cmd, out)
 				job.Finish(jobs.SuccessStatus)
+				job.Status = jobs.SuccessStatus
 			}
+			job.EndTime = time.Now().UTC()
+			t.observer.JobFinished(job, out, err)
 			m.wg.Done()
 		}(t)
 	}
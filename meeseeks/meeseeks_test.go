@@ -13,6 +13,7 @@ import (
 
 	"regexp"
 
+	"github.com/gomeeseeks/meeseeks-box/jobs"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks"
 	"github.com/gomeeseeks/meeseeks-box/template"
 	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
@@ -70,6 +71,24 @@ func Test_MeeseeksInteractions(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "command with a duration string timeout",
+			user:    "myuser",
+			message: "duration-echo hello!",
+			channel: "general",
+			expected: []expectedMessage{
+				expectedMessage{
+					TextMatcher: handshakeMatcher,
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+				expectedMessage{
+					TextMatcher: "^<@myuser> .*\n```\nhello!\n```$",
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+			},
+		},
 		{
 			name:    "unknown command case",
 			user:    "myuser",
@@ -109,6 +128,50 @@ func Test_MeeseeksInteractions(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "command not allowed in channel",
+			user:    "myuser",
+			message: "im-echo hello!",
+			channel: "general",
+			expected: []expectedMessage{
+				expectedMessage{
+					TextMatcher: "^<@myuser> Uuuuh, yeah! you are not allowed to do im-echo: this command can only be used over an IM conversation$",
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+			},
+		},
+		{
+			name:    "rate limited command first request",
+			user:    "myuser",
+			message: "limited-echo hello!",
+			channel: "general",
+			expected: []expectedMessage{
+				expectedMessage{
+					TextMatcher: handshakeMatcher,
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+				expectedMessage{
+					TextMatcher: "^<@myuser> .*\n```\nhello!\n```$",
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+			},
+		},
+		{
+			name:    "rate limited command over the limit",
+			user:    "myuser",
+			message: "limited-echo hello!",
+			channel: "general",
+			expected: []expectedMessage{
+				expectedMessage{
+					TextMatcher: "^<@myuser> Uuuh, slow down! too many requests to limited-echo, you can retry (59 minutes|1 hour) from now$",
+					Channel:     "generalID",
+					IsIM:        false,
+				},
+			},
+		},
 		{
 			name:    "fail command",
 			user:    "myuser",
@@ -144,11 +207,26 @@ func Test_MeeseeksInteractions(t *testing.T) {
 			  disallowed:
 			    command: false
 			    auth_strategy: none
+			  im-echo:
+			    command: echo
+			    auth_strategy: any
+			    im_only: true
 			  args-echo:
 			    command: echo
 			    auth_strategy: any
 			    timeout: 5
 			    args: ["pre-message"]
+			  duration-echo:
+			    command: echo
+			    auth_strategy: any
+			    timeout: 1m30s
+			  limited-echo:
+			    command: echo
+			    auth_strategy: any
+			    rate_limits:
+			      per_user:
+			        requests: 1
+			        per: 1h
 			`)).WithDBPath(dbpath).Load()
 
 		msgs, err := messenger.Listen(client)
@@ -188,3 +266,172 @@ func Test_MeeseeksInteractions(t *testing.T) {
 	})
 
 }
+
+type observedMessage struct {
+	stubs.MessageStub
+	events chan string
+}
+
+func (m observedMessage) JobRejected(err error) {
+	m.events <- fmt.Sprintf("rejected: %s", err)
+}
+
+func (m observedMessage) JobStarted(job jobs.Job) {
+	m.events <- fmt.Sprintf("started: %s", job.Status)
+}
+
+func (m observedMessage) JobFinished(job jobs.Job, output string, err error) {
+	m.events <- fmt.Sprintf("finished: %s %q %v", job.Status, output, err)
+}
+
+func Test_MeeseeksNotifiesObservers(t *testing.T) {
+	stubs.WithTmpDB(func(dbpath string) {
+		client, cnf := stubs.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			  fail:
+			    command: false
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+		go func() {
+			for range client.MessagesSent {
+			}
+		}()
+
+		msgs, err := messenger.Listen(client)
+		stubs.Must(t, "could not create listener", err)
+		m := meeseeks.New(client, msgs, formatter.New(cnf))
+		go m.Start()
+
+		tt := []struct {
+			name     string
+			message  string
+			expected []string
+		}{
+			{
+				name:     "successful job",
+				message:  "echo hello",
+				expected: []string{"started: Running", `finished: Successful "hello\n" <nil>`},
+			},
+			{
+				name:     "failed job",
+				message:  "fail",
+				expected: []string{"started: Running", `finished: Failed "" exit status 1`},
+			},
+			{
+				name:     "unknown command",
+				message:  "unknown",
+				expected: []string{"rejected: unknown command unknown"},
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				msg := observedMessage{
+					MessageStub: stubs.MessageStub{Text: tc.message, Channel: "general", ChannelID: "generalID", User: "myuser"},
+					events:      make(chan string, len(tc.expected)),
+				}
+				client.MessagesCh() <- msg
+				for _, expected := range tc.expected {
+					stubs.AssertEquals(t, expected, <-msg.events)
+				}
+			})
+		}
+		m.Shutdown()
+	})
+}
+
+type routedMessage struct {
+	observedMessage
+	mode string
+}
+
+func (m routedMessage) GetReplyMode() string {
+	return m.mode
+}
+
+func Test_MeeseeksRoutesReplies(t *testing.T) {
+	handshakeMatcher := fmt.Sprintf("^(%s)$", strings.Join(template.DefaultHandshakeMessages, "|"))
+
+	stubs.WithTmpDB(func(dbpath string) {
+		client, cnf := stubs.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+
+		msgs, err := messenger.Listen(client)
+		stubs.Must(t, "could not create listener", err)
+		m := meeseeks.New(client, msgs, formatter.New(cnf))
+		go m.Start()
+
+		tt := []struct {
+			name     string
+			mode     string
+			message  string
+			events   []string
+			expected []expectedMessage
+		}{
+			{
+				name:    "im",
+				mode:    "im",
+				message: "echo hello",
+				events:  []string{"started: Running"},
+				expected: []expectedMessage{
+					{TextMatcher: handshakeMatcher, Channel: "myuser", IsIM: true},
+					{TextMatcher: "^<@myuser> .*\n```\nhello\n```$", Channel: "myuser", IsIM: true},
+				},
+			},
+			{
+				name:    "silent",
+				mode:    "silent",
+				message: "echo hello",
+				events:  []string{"started: Running", `finished: Successful "hello\n" <nil>`},
+			},
+			{
+				name:    "callback",
+				mode:    "callback",
+				message: "unknown",
+				events:  []string{"rejected: unknown command unknown"},
+			},
+			{
+				name:    "channel",
+				mode:    "channel",
+				message: "echo hello",
+				events:  []string{"started: Running"},
+				expected: []expectedMessage{
+					{TextMatcher: handshakeMatcher, Channel: "generalID"},
+					{TextMatcher: "^<@myuser> .*\n```\nhello\n```$", Channel: "generalID"},
+				},
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				msg := routedMessage{
+					observedMessage: observedMessage{
+						MessageStub: stubs.MessageStub{Text: tc.message, Channel: "general", ChannelID: "generalID", User: "myuser"},
+						events:      make(chan string, 2),
+					},
+					mode: tc.mode,
+				}
+				client.MessagesCh() <- msg
+				for _, expected := range tc.events {
+					stubs.AssertEquals(t, expected, <-msg.events)
+				}
+				for _, expected := range tc.expected {
+					actual := <-client.MessagesSent
+					stubs.AssertMatches(t, expected.TextMatcher, actual.Text)
+					stubs.AssertEquals(t, expected.Channel, actual.Channel)
+					stubs.AssertEquals(t, expected.IsIM, actual.IsIM)
+				}
+			})
+		}
+		m.Shutdown()
+	})
+}
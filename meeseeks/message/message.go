@@ -19,3 +19,17 @@ type Message interface {
 	// IsIM
 	IsIM() bool
 }
+
+// StructuredMessage is implemented by the messages that also carry arguments
+// that were already split, which are appended to the ones parsed from the
+// text without parsing them again, and the environment for the command
+type StructuredMessage interface {
+	GetArgs() []string
+	GetEnv() map[string]string
+}
+
+// RoutedMessage is implemented by the messages whose replies may not go to the
+// channel they come from, the mode is one of the request reply modes
+type RoutedMessage interface {
+	GetReplyMode() string
+}
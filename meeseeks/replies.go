@@ -1,9 +1,11 @@
 package meeseeks
 
 import (
+	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/command"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
+	"github.com/gomeeseeks/meeseeks-box/ratelimit"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,9 +15,11 @@ func (m *Meeseeks) replyWithError(msg message.Message, err error) {
 		log.Fatalf("could not render failure template: %s", err)
 	}
 
-	if err = m.client.Reply(content, m.formatter.ErrorColor(), msg.GetChannelID()); err != nil {
-		log.Errorf("Failed to reply: %s", err)
-	}
+	m.reply(request.Request{
+		UserID:    msg.GetUserID(),
+		ChannelID: msg.GetChannelID(),
+		ReplyMode: request.ReplyModeOf(msg),
+	}, content, m.formatter.ErrorColor())
 }
 
 func (m *Meeseeks) replyWithUnknownCommand(req request.Request) {
@@ -26,9 +30,7 @@ func (m *Meeseeks) replyWithUnknownCommand(req request.Request) {
 		log.Fatalf("could not render unknown command template: %s", err)
 	}
 
-	if err = m.client.Reply(msg, m.formatter.ErrorColor(), req.ChannelID); err != nil {
-		log.Errorf("Failed to reply: %s", err)
-	}
+	m.reply(req, msg, m.formatter.ErrorColor())
 }
 
 func (m *Meeseeks) replyWithHandshake(req request.Request, cmd command.Command) {
@@ -40,23 +42,36 @@ func (m *Meeseeks) replyWithHandshake(req request.Request, cmd command.Command)
 		log.Fatalf("could not render unknown command template: %s", err)
 	}
 
-	if err = m.client.Reply(msg, m.formatter.InfoColor(), req.ChannelID); err != nil {
-		log.Errorf("Failed to reply: %s", err)
-	}
+	m.reply(req, msg, m.formatter.InfoColor())
 }
 
-func (m *Meeseeks) replyWithUnauthorizedCommand(req request.Request, cmd command.Command) {
-	log.Debugf("User %s is not allowed to run command '%s' on channel '%s'", req.Username,
-		req.Command, req.Channel)
+func (m *Meeseeks) replyWithUnauthorizedCommand(req request.Request, cmd command.Command, err error) {
+	log.Debugf("User %s is not allowed to run command '%s' on channel '%s': %s", req.Username,
+		req.Command, req.Channel, err)
 
-	msg, err := m.formatter.WithTemplates(cmd.Templates()).RenderUnauthorizedCommand(req.UserLink, req.Command)
+	reason := ""
+	if err != auth.ErrUserNotAllowed {
+		reason = err.Error()
+	}
+
+	msg, err := m.formatter.WithTemplates(cmd.Templates()).RenderUnauthorizedCommand(req.UserLink, req.Command, reason)
 	if err != nil {
 		log.Fatalf("could not render unathorized command template %s", err)
 	}
 
-	if err = m.client.Reply(msg, m.formatter.ErrorColor(), req.ChannelID); err != nil {
-		log.Errorf("Failed to reply: %s", err)
+	m.reply(req, msg, m.formatter.ErrorColor())
+}
+
+func (m *Meeseeks) replyWithRateLimitedCommand(req request.Request, cmd command.Command, limit ratelimit.Result) {
+	log.Debugf("User %s exceeded the rate limit %s of command '%s'", req.Username, limit.Limit, req.Command)
+
+	msg, err := m.formatter.WithTemplates(cmd.Templates()).RenderRateLimited(req.UserLink, req.Command,
+		limit.Limit, limit.RetryAt)
+	if err != nil {
+		log.Fatalf("could not render rate limited command template %s", err)
 	}
+
+	m.reply(req, msg, m.formatter.ErrorColor())
 }
 
 func (m *Meeseeks) replyWithCommandFailed(req request.Request, cmd command.Command, err error, out string) {
@@ -65,9 +80,7 @@ func (m *Meeseeks) replyWithCommandFailed(req request.Request, cmd command.Comma
 		log.Fatalf("could not render failure template %s", err)
 	}
 
-	if err = m.client.Reply(msg, m.formatter.ErrorColor(), req.ChannelID); err != nil {
-		log.Errorf("Failed to reply: %s", err)
-	}
+	m.reply(req, msg, m.formatter.ErrorColor())
 }
 
 func (m *Meeseeks) replyWithSuccess(req request.Request, cmd command.Command, out string) {
@@ -77,7 +90,23 @@ func (m *Meeseeks) replyWithSuccess(req request.Request, cmd command.Command, ou
 		log.Fatalf("could not render success template %s", err)
 	}
 
-	if err = m.client.Reply(msg, m.formatter.SuccessColor(), req.ChannelID); err != nil {
+	m.reply(req, msg, m.formatter.SuccessColor())
+}
+
+// reply sends the content to where the request wants its replies, which is the
+// channel it comes from unless it picked another reply mode
+func (m *Meeseeks) reply(req request.Request, content, color string) {
+	var err error
+	switch req.ReplyMode {
+	case request.ReplySilently, request.ReplyToCallback:
+		log.Debugf("Not replying to user %s in the chat as the request replies %s", req.UserID, req.ReplyMode)
+		return
+	case request.ReplyToIM:
+		err = m.client.ReplyIM(content, color, req.UserID)
+	default:
+		err = m.client.Reply(content, color, req.ChannelID)
+	}
+	if err != nil {
 		log.Errorf("Failed to reply: %s", err)
 	}
 }
@@ -2,6 +2,8 @@ package request
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/request/parser"
@@ -10,6 +12,31 @@ import (
 // ErrNoCommandToRun is returned when a request can't identify a command to run
 var ErrNoCommandToRun = errors.New("No command to run")
 
+// Modes in which the replies to a request are sent
+const (
+	// ReplyToChannel replies in the channel the request comes from, which is
+	// what an empty mode does
+	ReplyToChannel = "channel"
+	// ReplyToIM replies in an IM to the user that sent the request
+	ReplyToIM = "im"
+	// ReplyToCallback doesn't reply in the chat, the sender of the request
+	// posts the result to its callback URL instead
+	ReplyToCallback = "callback"
+	// ReplySilently doesn't reply at all, the job and its logs are stored
+	ReplySilently = "silent"
+)
+
+// ValidateReplyMode returns an error when the mode is not one of the reply
+// modes, an empty mode is valid as it replies to the channel
+func ValidateReplyMode(mode string) error {
+	switch mode {
+	case "", ReplyToChannel, ReplyToIM, ReplyToCallback, ReplySilently:
+		return nil
+	}
+	return fmt.Errorf("invalid reply mode %q, it should be one of %s, %s, %s or %s",
+		mode, ReplyToChannel, ReplyToIM, ReplyToCallback, ReplySilently)
+}
+
 // Request is a structure that holds all the command execution request
 type Request struct {
 	Command     string   `json:"Command"`
@@ -21,6 +48,24 @@ type Request struct {
 	ChannelID   string   `json:"CannelID"`
 	ChannelLink string   `json:"CannelLink"`
 	IsIM        bool     `json:"IsIM"`
+	// NoChannel is set on the requests that are not sent from any channel or
+	// IM, like the REST API calls authenticated with a client certificate
+	NoChannel bool `json:"NoChannel,omitempty"`
+
+	// Env is never persisted with the job as its values can be secrets
+	Env       map[string]string `json:"-"`
+	ReplyMode string            `json:"ReplyMode,omitempty"`
+}
+
+// EnvNames returns the sorted names of the environment variables, which can be
+// logged as opposed to their values
+func EnvNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // FromMessage gets a message and generates a valid request from it
@@ -30,6 +75,12 @@ func FromMessage(msg message.Message) (Request, error) {
 		return Request{}, err
 	}
 
+	var env map[string]string
+	if s, ok := msg.(message.StructuredMessage); ok {
+		args = append(args, s.GetArgs()...)
+		env = s.GetEnv()
+	}
+
 	if len(args) == 0 {
 		return Request{}, ErrNoCommandToRun
 	}
@@ -44,5 +95,16 @@ func FromMessage(msg message.Message) (Request, error) {
 		ChannelID:   msg.GetChannelID(),
 		ChannelLink: msg.GetChannelLink(),
 		IsIM:        msg.IsIM(),
+		Env:         env,
+		ReplyMode:   ReplyModeOf(msg),
 	}, nil
 }
+
+// ReplyModeOf returns how the replies to the message are sent, which is to its
+// channel unless the message picks another mode
+func ReplyModeOf(msg message.Message) string {
+	if r, ok := msg.(message.RoutedMessage); ok {
+		return r.GetReplyMode()
+	}
+	return ""
+}
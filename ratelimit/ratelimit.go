@@ -0,0 +1,323 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
+	log "github.com/sirupsen/logrus"
+)
+
+var bucketsKey = []byte("rate_limits")
+
+// DefaultSweepInterval is how often the buckets that are full again are deleted
+const DefaultSweepInterval = 10 * time.Minute
+
+// Limit is a token bucket that allows a number of requests per period
+//
+// The bucket starts full and is refilled continuously, so it allows bursts of
+// up to the configured number of requests. A limit without requests is
+// disabled.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) isEnabled() bool {
+	return l.Requests > 0
+}
+
+func (l Limit) validate() error {
+	if l.Requests < 0 {
+		return fmt.Errorf("requests can't be negative")
+	}
+	if l.Requests > 0 && l.Per <= 0 {
+		return fmt.Errorf("a period is required to allow %d requests", l.Requests)
+	}
+	return nil
+}
+
+// refillRate returns the tokens added to the bucket per second
+func (l Limit) refillRate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// waitFor returns how long it takes to refill the bucket up to one token
+func (l Limit) waitFor(tokens float64) time.Duration {
+	seconds := (1 - tokens) / l.refillRate()
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d per %s", l.Requests, l.Per)
+}
+
+// Limits are the rate limits applied to a set of requests
+type Limits struct {
+	// Global is shared by all the users
+	Global Limit
+	// PerUser is applied to each user separately
+	PerUser Limit
+}
+
+func (l Limits) validate() error {
+	if err := l.Global.validate(); err != nil {
+		return fmt.Errorf("invalid global limit: %s", err)
+	}
+	if err := l.PerUser.validate(); err != nil {
+		return fmt.Errorf("invalid per user limit: %s", err)
+	}
+	return nil
+}
+
+type limits struct {
+	global   Limits
+	commands map[string]Limits
+	// exempt are the commands that the global per user limit does not apply to
+	exempt map[string]bool
+	m      sync.RWMutex
+}
+
+var configured = &limits{
+	commands: map[string]Limits{},
+	exempt:   map[string]bool{},
+}
+
+// Configure sets the limits applied to all the requests and the ones applied
+// to the requests of each command
+//
+// Limits are tracked in the database, so reconfiguring them does not reset the
+// state of the buckets.
+func Configure(global Limits, commands map[string]Limits) error {
+	if err := global.validate(); err != nil {
+		return err
+	}
+	c := make(map[string]Limits, len(commands))
+	for command, l := range commands {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("command %s: %s", command, err)
+		}
+		c[command] = l
+	}
+
+	configured.m.Lock()
+	defer configured.m.Unlock()
+
+	configured.global = global
+	configured.commands = c
+	return nil
+}
+
+// Exempt makes the global per user limit skip the requests of the commands, so
+// users can still cancel their jobs once they reach it
+//
+// The limits of the commands themselves still apply.
+func Exempt(commands ...string) {
+	configured.m.Lock()
+	defer configured.m.Unlock()
+
+	for _, command := range commands {
+		configured.exempt[command] = true
+	}
+}
+
+// Result is the outcome of checking a request against the rate limits
+type Result struct {
+	Allowed bool
+	// Limit describes the limit that was exceeded
+	Limit string
+	// RetryAt is when the request will be allowed by all the limits
+	RetryAt time.Time
+}
+
+// Take checks the request against all the limits that apply to it, and only
+// when all of them allow it, takes a token from each one of their buckets
+func Take(command, userID string) (Result, error) {
+	applied := appliedLimits(command, userID)
+	if len(applied) == 0 {
+		return Result{Allowed: true}, nil
+	}
+
+	now := time.Now().UTC()
+	result := Result{Allowed: true}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketsKey)
+		if err != nil {
+			return fmt.Errorf("could not get rate limits bucket: %s", err)
+		}
+
+		states := make([]state, 0, len(applied))
+		for _, a := range applied {
+			s, err := loadState(bucket, a, now)
+			if err != nil {
+				return err
+			}
+			if s.Tokens < 1 {
+				retryAt := now.Add(a.limit.waitFor(s.Tokens))
+				if retryAt.After(result.RetryAt) {
+					result = Result{Limit: a.description, RetryAt: retryAt}
+				}
+			}
+			states = append(states, s)
+		}
+		if !result.Allowed {
+			return nil
+		}
+
+		for i, a := range applied {
+			states[i].Tokens--
+			if err := saveState(bucket, a, states[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("could not check rate limits: %s", err)
+	}
+	if !result.Allowed {
+		log.Infof("Request of command %s by user %s exceeded the rate limit %s, it can be retried at %s",
+			command, userID, result.Limit, result.RetryAt)
+	}
+	return result, nil
+}
+
+// appliedLimit is a limit along with the key of the bucket that tracks it
+type appliedLimit struct {
+	limit       Limit
+	key         string
+	description string
+}
+
+func appliedLimits(command, userID string) []appliedLimit {
+	configured.m.RLock()
+	defer configured.m.RUnlock()
+
+	applied := make([]appliedLimit, 0)
+	add := func(l Limit, key, description string) {
+		if l.isEnabled() {
+			applied = append(applied, appliedLimit{
+				limit:       l,
+				key:         key,
+				description: fmt.Sprintf("%s %s", l, description),
+			})
+		}
+	}
+
+	add(configured.global.Global, "global", "globally")
+	if !configured.exempt[command] {
+		add(configured.global.PerUser, fmt.Sprintf("user:%s", userID), "per user")
+	}
+	if l, ok := configured.commands[command]; ok {
+		add(l.Global, fmt.Sprintf("command:%s", command),
+			fmt.Sprintf("for command %s", command))
+		add(l.PerUser, fmt.Sprintf("command:%s:user:%s", command, userID),
+			fmt.Sprintf("per user for command %s", command))
+	}
+	return applied
+}
+
+// state is the persisted state of a bucket
+//
+// FullAt is when the bucket is refilled up to its capacity, from then on it is
+// the same as a bucket that has never been used, so it can be deleted.
+type state struct {
+	Tokens    float64   `json:"Tokens"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+	FullAt    time.Time `json:"FullAt"`
+}
+
+// loadState returns the state of the bucket refilled up to now, buckets that
+// have never been used start full
+func loadState(bucket *bolt.Bucket, a appliedLimit, now time.Time) (state, error) {
+	capacity := float64(a.limit.Requests)
+
+	payload := bucket.Get([]byte(a.key))
+	if payload == nil {
+		return state{Tokens: capacity, UpdatedAt: now}, nil
+	}
+	s := state{}
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, fmt.Errorf("could not unmarshal rate limit %s: %s", a.key, err)
+	}
+
+	if elapsed := now.Sub(s.UpdatedAt); elapsed > 0 {
+		s.Tokens += elapsed.Seconds() * a.limit.refillRate()
+	}
+	s.Tokens = math.Min(s.Tokens, capacity)
+	s.UpdatedAt = now
+	return s, nil
+}
+
+func saveState(bucket *bolt.Bucket, a appliedLimit, s state) error {
+	missing := float64(a.limit.Requests) - s.Tokens
+	s.FullAt = s.UpdatedAt.Add(time.Duration(math.Ceil(missing / a.limit.refillRate() * float64(time.Second))))
+
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not marshal rate limit %s: %s", a.key, err)
+	}
+	return bucket.Put([]byte(a.key), payload)
+}
+
+// Sweep deletes the buckets that are full again, it returns how many were
+// deleted
+func Sweep() (int, error) {
+	now := time.Now().UTC()
+	swept := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketsKey)
+		if bucket == nil {
+			return nil
+		}
+
+		keys := make([][]byte, 0)
+		err := bucket.ForEach(func(key, payload []byte) error {
+			s := state{}
+			if err := json.Unmarshal(payload, &s); err != nil {
+				return fmt.Errorf("could not unmarshal rate limit %s: %s", key, err)
+			}
+			if !now.Before(s.FullAt) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		swept = len(keys)
+		return nil
+	})
+	return swept, err
+}
+
+// SweepEvery sweeps the buckets periodically until the stop channel is closed
+func SweepEvery(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			swept, err := Sweep()
+			if err != nil {
+				log.Errorf("Could not sweep rate limits: %s", err)
+				continue
+			}
+			if swept > 0 {
+				log.Debugf("Swept %d rate limit buckets that are full again", swept)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomeeseeks/meeseeks-box/ratelimit"
+	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
+)
+
+func Test_RateLimits(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure rate limits", ratelimit.Configure(
+			ratelimit.Limits{
+				Global: ratelimit.Limit{Requests: 4, Per: time.Minute},
+			},
+			map[string]ratelimit.Limits{
+				"deploy": {PerUser: ratelimit.Limit{Requests: 2, Per: time.Hour}},
+			}))
+		defer ratelimit.Configure(ratelimit.Limits{}, nil)
+
+		for i := 0; i < 2; i++ {
+			r, err := ratelimit.Take("deploy", "someone")
+			stubs.Must(t, "failed to take from the rate limit", err)
+			stubs.AssertEquals(t, true, r.Allowed)
+		}
+
+		start := time.Now()
+		r, err := ratelimit.Take("deploy", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, false, r.Allowed)
+		stubs.AssertEquals(t, "2 per 1h0m0s per user for command deploy", r.Limit)
+		if wait := r.RetryAt.Sub(start); wait < 29*time.Minute || wait > 31*time.Minute {
+			t.Fatalf("expected to be able to retry in about 30 minutes, got %s", wait)
+		}
+
+		r, err = ratelimit.Take("deploy", "someone_else")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, true, r.Allowed)
+
+		r, err = ratelimit.Take("echo", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, true, r.Allowed)
+
+		r, err = ratelimit.Take("echo", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, false, r.Allowed)
+		stubs.AssertEquals(t, "4 per 1m0s globally", r.Limit)
+	}))
+}
+
+func Test_RateLimitsArePersisted(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		limits := ratelimit.Limits{PerUser: ratelimit.Limit{Requests: 1, Per: time.Hour}}
+		stubs.Must(t, "failed to configure rate limits", ratelimit.Configure(limits, nil))
+		defer ratelimit.Configure(ratelimit.Limits{}, nil)
+
+		r, err := ratelimit.Take("echo", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, true, r.Allowed)
+
+		stubs.Must(t, "failed to configure rate limits", ratelimit.Configure(limits, nil))
+		r, err = ratelimit.Take("deploy", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, false, r.Allowed)
+		stubs.AssertEquals(t, "1 per 1h0m0s per user", r.Limit)
+	}))
+}
+
+func Test_CommandsCanBeExemptFromThePerUserLimit(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure rate limits", ratelimit.Configure(
+			ratelimit.Limits{PerUser: ratelimit.Limit{Requests: 1, Per: time.Hour}},
+			map[string]ratelimit.Limits{
+				"cancel": {PerUser: ratelimit.Limit{Requests: 2, Per: time.Hour}},
+			}))
+		defer ratelimit.Configure(ratelimit.Limits{}, nil)
+		ratelimit.Exempt("cancel")
+
+		r, err := ratelimit.Take("echo", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, true, r.Allowed)
+
+		for i := 0; i < 2; i++ {
+			r, err = ratelimit.Take("cancel", "someone")
+			stubs.Must(t, "failed to take from the rate limit", err)
+			stubs.AssertEquals(t, true, r.Allowed)
+		}
+
+		r, err = ratelimit.Take("cancel", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, false, r.Allowed)
+		stubs.AssertEquals(t, "2 per 1h0m0s per user for command cancel", r.Limit)
+	}))
+}
+
+func Test_FullBucketsAreSwept(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		stubs.Must(t, "failed to configure rate limits", ratelimit.Configure(
+			ratelimit.Limits{PerUser: ratelimit.Limit{Requests: 2, Per: 100 * time.Millisecond}},
+			map[string]ratelimit.Limits{
+				"deploy": {PerUser: ratelimit.Limit{Requests: 1, Per: time.Hour}},
+			}))
+		defer ratelimit.Configure(ratelimit.Limits{}, nil)
+
+		for _, userID := range []string{"someone", "someone_else"} {
+			_, err := ratelimit.Take("deploy", userID)
+			stubs.Must(t, "failed to take from the rate limit", err)
+		}
+
+		swept, err := ratelimit.Sweep()
+		stubs.Must(t, "failed to sweep rate limits", err)
+		stubs.AssertEquals(t, 0, swept)
+
+		time.Sleep(100 * time.Millisecond)
+		swept, err = ratelimit.Sweep()
+		stubs.Must(t, "failed to sweep rate limits", err)
+		stubs.AssertEquals(t, 2, swept)
+
+		r, err := ratelimit.Take("deploy", "someone")
+		stubs.Must(t, "failed to take from the rate limit", err)
+		stubs.AssertEquals(t, false, r.Allowed)
+		stubs.AssertEquals(t, "1 per 1h0m0s per user for command deploy", r.Limit)
+	}))
+}
+
+func Test_InvalidRateLimits(t *testing.T) {
+	tc := []struct {
+		name     string
+		global   ratelimit.Limits
+		commands map[string]ratelimit.Limits
+		expected string
+	}{
+		{
+			name:     "negative requests",
+			global:   ratelimit.Limits{Global: ratelimit.Limit{Requests: -1, Per: time.Hour}},
+			expected: "invalid global limit: requests can't be negative",
+		},
+		{
+			name: "no period",
+			commands: map[string]ratelimit.Limits{
+				"deploy": {PerUser: ratelimit.Limit{Requests: 3}},
+			},
+			expected: "command deploy: invalid per user limit: a period is required to allow 3 requests",
+		},
+	}
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ratelimit.Configure(tc.global, tc.commands)
+			if err == nil || err.Error() != tc.expected {
+				t.Fatalf("wrong error, expected %s; got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
 	"github.com/sirupsen/logrus"
 
@@ -23,8 +25,21 @@ type Client struct {
 	// through a channel
 	rtm     *slack.RTM
 	matcher messageMatcher
+	userIDs *userIDs
 }
 
+// userIDs caches the IDs of the users by name so they are not listed on every
+// lookup, the cache is refreshed when a name is missing or it is too old, as
+// users join and change their names at any time
+type userIDs struct {
+	byName   map[string]string
+	loadedAt time.Time
+	m        sync.Mutex
+}
+
+// userIDsTTL is how long the cached user IDs are used for
+const userIDsTTL = time.Minute
+
 // ParseChannelLink implements the messenger.MessengerClient interface
 func (c Client) ParseChannelLink(channel string) (string, error) {
 	r, err := regexp.Compile("<#(.*)\\|.*>")
@@ -56,6 +71,70 @@ func (c Client) GetUsername(userID string) string {
 	return c.matcher.getUser(userID)
 }
 
+// GetUserID implements the auth.UserResolver interface, deleted users are
+// ignored because their names can be taken by other users
+func (c Client) GetUserID(username string) (string, error) {
+	c.userIDs.m.Lock()
+	defer c.userIDs.m.Unlock()
+
+	if id, ok := c.userIDs.byName[username]; ok && time.Since(c.userIDs.loadedAt) < userIDsTTL {
+		return id, nil
+	}
+
+	users, err := c.apiClient.GetUsers()
+	if err != nil {
+		return "", fmt.Errorf("could not list users: %s", err)
+	}
+	byName := make(map[string]string, len(users))
+	for _, u := range users {
+		if !u.Deleted {
+			byName[u.Name] = u.ID
+		}
+	}
+	c.userIDs.byName, c.userIDs.loadedAt = byName, time.Now()
+
+	if id, ok := byName[username]; ok {
+		return id, nil
+	}
+	return "", auth.ErrUserNotFound
+}
+
+// GetUserIDsByEmail implements the auth.UserEmailResolver interface, emails are
+// lowercased so they are compared case insensitively
+func (c Client) GetUserIDsByEmail() (map[string]string, error) {
+	users, err := c.apiClient.GetUsers()
+	if err != nil {
+		return nil, fmt.Errorf("could not list users: %s", err)
+	}
+	ids := make(map[string]string, len(users))
+	for _, u := range users {
+		if u.Profile.Email != "" && !u.Deleted {
+			ids[strings.ToLower(u.Profile.Email)] = u.ID
+		}
+	}
+	return ids, nil
+}
+
+// GetUserGroupMembers implements the auth.UserGroupResolver interface, the
+// handle can be prefixed with @
+func (c Client) GetUserGroupMembers(handle string) ([]string, error) {
+	handle = strings.TrimPrefix(handle, "@")
+	groups, err := c.apiClient.GetUserGroups()
+	if err != nil {
+		return nil, fmt.Errorf("could not list user groups: %s", err)
+	}
+	for _, g := range groups {
+		if g.Handle == handle {
+			members, err := c.apiClient.GetUserGroupMembers(g.ID)
+			if err != nil {
+				return nil, fmt.Errorf("could not list members of user group %s: %s", handle, err)
+			}
+			return members, nil
+		}
+	}
+	return nil, fmt.Errorf("user group %s not found", handle)
+}
+
 // GetUserLink implements the messenger.MessengerClient interface
 func (c Client) GetUserLink(userID string) string {
 	return fmt.Sprintf("<@%s>", userID)
@@ -79,7 +158,7 @@ func (c Client) IsIM(channelID string) bool {
 // Connect builds a new chat client
 func Connect(debug bool, token string) (*Client, error) {
 	if token == "" {
-		return nil, fmt.Errorf("could not connect to slack: SLACK_TOKEN env var is empty")
+		return nil, fmt.Errorf("could not connect to slack: no slack_token configured and SLACK_TOKEN env var is empty")
 	}
 
 	slackClient := slack.New(token)
@@ -100,6 +179,7 @@ func Connect(debug bool, token string) (*Client, error) {
 		apiClient: slackClient,
 		rtm:       rtm,
 		matcher:   newMessageMatcher(rtm),
+		userIDs:   &userIDs{},
 	}, nil
 }
 
@@ -115,12 +195,14 @@ func newMessageMatcher(rtm *slack.RTM) messageMatcher {
 	}
 }
 
-// GetUser finds the username given a userID
+// GetUser finds the username given a userID, falling back to the userID
+//
+// Usernames are only used for display, users are always authorized by ID.
 func (m *messageMatcher) getUser(userID string) string {
 	u, err := m.rtm.GetUserInfo(userID)
 	if err != nil {
 		logrus.Errorf("could not find user with id %s because %s, weeeird", userID, err)
-		return "unknown-user"
+		return userID
 	}
 	return u.Name
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"time"
 
 	tmpl "text/template"
 
@@ -19,6 +20,7 @@ const (
 	FailureKey        = "failure"
 	UnknownCommandKey = "unknowncommand"
 	UnauthorizedKey   = "unauthorized"
+	RateLimitedKey    = "ratelimited"
 )
 
 // Default command templates
@@ -30,8 +32,10 @@ var (
 		"{{ with $out := .output }}\n```\n{{ $out }}```{{ end }}", FailureKey)
 	DefaultUnknownCommandTemplate = fmt.Sprintf("{{ .user }} {{ AnyValue \"%s\" . }} {{ .command }}",
 		UnknownCommandKey)
-	DefaultUnauthorizedTemplate = fmt.Sprintf("{{ .user }} {{ AnyValue \"%s\" . }} {{ .command }}",
-		UnauthorizedKey)
+	DefaultUnauthorizedTemplate = fmt.Sprintf("{{ .user }} {{ AnyValue \"%s\" . }} {{ .command }}"+
+		"{{ with $reason := .reason }}: {{ $reason }}{{ end }}", UnauthorizedKey)
+	DefaultRateLimitedTemplate = fmt.Sprintf("{{ .user }} {{ AnyValue \"%s\" . }} {{ .command }}, "+
+		"you can retry {{ HumanizeTime .retry }}", RateLimitedKey)
 )
 
 // GetDefaultTemplates returns a map with the default templates
@@ -42,6 +46,7 @@ func GetDefaultTemplates() map[string]string {
 		FailureKey:        DefaultFailureTemplate,
 		UnknownCommandKey: DefaultUnknownCommandTemplate,
 		UnauthorizedKey:   DefaultUnauthorizedTemplate,
+		RateLimitedKey:    DefaultRateLimitedTemplate,
 	}
 }
 
@@ -54,6 +59,7 @@ var (
 	DefaultFailedMessages         = []string{"Uuuh!, no, it failed"}
 	DefaultUnauthorizedMessages   = []string{"Uuuuh, yeah! you are not allowed to do"}
 	DefaultUnknownCommandMessages = []string{"Uuuh! no, I don't know how to do"}
+	DefaultRateLimitedMessages    = []string{"Uuuh, slow down! too many requests to"}
 )
 
 // GetDefaultMessages returns a map with the default messages
@@ -64,6 +70,7 @@ func GetDefaultMessages() map[string][]string {
 		FailureKey:        DefaultFailedMessages,
 		UnknownCommandKey: DefaultUnknownCommandMessages,
 		UnauthorizedKey:   DefaultUnauthorizedMessages,
+		RateLimitedKey:    DefaultRateLimitedMessages,
 	}
 }
 
@@ -145,14 +152,27 @@ func (t Templates) RenderUnknownCommand(user, cmd string) (string, error) {
 	return t.renderers[UnknownCommandKey].Render(p)
 }
 
-// RenderUnauthorizedCommand renders an unauthorized command message
-func (t Templates) RenderUnauthorizedCommand(user, cmd string) (string, error) {
+// RenderUnauthorizedCommand renders an unauthorized command message, the
+// reason can be empty when there is no need to explain it
+func (t Templates) RenderUnauthorizedCommand(user, cmd, reason string) (string, error) {
 	p := t.newPayload()
 	p["user"] = user
 	p["command"] = cmd
+	p["reason"] = reason
 	return t.renderers[UnauthorizedKey].Render(p)
 }
 
+// RenderRateLimited renders a message for a request that exceeded a rate
+// limit, along with the limit and when it can be retried
+func (t Templates) RenderRateLimited(user, cmd, limit string, retry time.Time) (string, error) {
+	p := t.newPayload()
+	p["user"] = user
+	p["command"] = cmd
+	p["limit"] = limit
+	p["retry"] = retry
+	return t.renderers[RateLimitedKey].Render(p)
+}
+
 // RenderSuccess renders a success message
 func (t Templates) RenderSuccess(user, output string) (string, error) {
 	p := t.newPayload()
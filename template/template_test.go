@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gomeeseeks/meeseeks-box/template"
 	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
@@ -169,9 +170,15 @@ func Test_DefaultTemplates(t *testing.T) {
 	unknownCommandMatcher, err := regexp.Compile(fmt.Sprintf("<@myself> (%s) mycommand", strings.Join(template.DefaultUnknownCommandMessages, "|")))
 	stubs.Must(t, "can't compile default unknown command matcher", err)
 
-	unauthorizedCommandMatcher, err := regexp.Compile(fmt.Sprintf("<@myself> (%s) mycommand", strings.Join(template.DefaultUnauthorizedMessages, "|")))
+	unauthorizedCommandMatcher, err := regexp.Compile(fmt.Sprintf("^<@myself> (%s) mycommand$", strings.Join(template.DefaultUnauthorizedMessages, "|")))
 	stubs.Must(t, "can't compile default unauthorized command matcher", err)
 
+	unauthorizedCommandWithReasonMatcher, err := regexp.Compile(fmt.Sprintf("^<@myself> (%s) mycommand: not here$", strings.Join(template.DefaultUnauthorizedMessages, "|")))
+	stubs.Must(t, "can't compile default unauthorized command with reason matcher", err)
+
+	rateLimitedMatcher, err := regexp.Compile(fmt.Sprintf("^<@myself> (%s) mycommand, you can retry 10 minutes from now$", strings.Join(template.DefaultRateLimitedMessages, "|")))
+	stubs.Must(t, "can't compile default rate limited matcher", err)
+
 	tt := []struct {
 		name     string
 		renderer func() (string, error)
@@ -223,10 +230,24 @@ func Test_DefaultTemplates(t *testing.T) {
 		{
 			name: "Unauthorized command",
 			renderer: func() (string, error) {
-				return templates.RenderUnauthorizedCommand("<@myself>", "mycommand")
+				return templates.RenderUnauthorizedCommand("<@myself>", "mycommand", "")
 			},
 			matcher: unauthorizedCommandMatcher,
 		},
+		{
+			name: "Unauthorized command with reason",
+			renderer: func() (string, error) {
+				return templates.RenderUnauthorizedCommand("<@myself>", "mycommand", "not here")
+			},
+			matcher: unauthorizedCommandWithReasonMatcher,
+		},
+		{
+			name: "Rate limited command",
+			renderer: func() (string, error) {
+				return templates.RenderRateLimited("<@myself>", "mycommand", "3 per 1h0m0s per user", time.Now().Add(10*time.Minute+time.Second))
+			},
+			matcher: rateLimitedMatcher,
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
@@ -11,8 +11,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gomeeseeks/meeseeks-box/auth"
 	"github.com/gomeeseeks/meeseeks-box/config"
 	"github.com/gomeeseeks/meeseeks-box/db"
+	"github.com/gomeeseeks/meeseeks-box/duration"
 	"github.com/gomeeseeks/meeseeks-box/meeseeks/message"
 
 	log "github.com/sirupsen/logrus"
@@ -81,7 +83,7 @@ func (h Harness) Load() (ClientStub, config.Config) {
 		c.Database = db.DatabaseConfig{
 			Path:    h.dbpath,
 			Mode:    0600,
-			Timeout: 2 * time.Second,
+			Timeout: duration.Duration(2 * time.Second),
 		}
 	}
 	if err := config.LoadConfig(c); err != nil {
@@ -219,7 +221,7 @@ func WithTmpDB(f func(dbpath string)) error {
 	db.Configure(db.DatabaseConfig{
 		Path:    dbpath,
 		Mode:    0600,
-		Timeout: 1 * time.Second,
+		Timeout: duration.Duration(1 * time.Second),
 	})
 
 	f(dbpath)
@@ -266,3 +268,43 @@ func (m MetadataStub) GetUsername(userID string) string {
 func (m MetadataStub) IsIM(_ string) bool {
 	return m.IM
 }
+
+// UserResolverStub resolves user names into IDs using a map of names to IDs
+type UserResolverStub map[string]string
+
+// GetUserID implements the auth.UserResolver interface
+func (u UserResolverStub) GetUserID(username string) (string, error) {
+	id, ok := u[username]
+	if !ok {
+		return "", auth.ErrUserNotFound
+	}
+	return id, nil
+}
+
+// GetUserIDsByEmail implements the auth.UserEmailResolver interface, emails are
+// the keys of the map that contain an @
+func (u UserResolverStub) GetUserIDsByEmail() (map[string]string, error) {
+	ids := make(map[string]string)
+	for name, id := range u {
+		if strings.Contains(name, "@") {
+			ids[strings.ToLower(name)] = id
+		}
+	}
+	return ids, nil
+}
+
+// UserGroupResolverStub resolves users as the UserResolverStub and lists the
+// members of user groups by handle, without the @ prefix
+type UserGroupResolverStub struct {
+	UserResolverStub
+	UserGroups map[string][]string
+}
+
+// GetUserGroupMembers implements the auth.UserGroupResolver interface
+func (u UserGroupResolverStub) GetUserGroupMembers(handle string) ([]string, error) {
+	members, ok := u.UserGroups[strings.TrimPrefix(handle, "@")]
+	if !ok {
+		return nil, fmt.Errorf("user group %s not found", handle)
+	}
+	return members, nil
+}
@@ -2,34 +2,253 @@ package tokens
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/coreos/bbolt"
 	"github.com/gomeeseeks/meeseeks-box/db"
+	"github.com/gomeeseeks/meeseeks-box/meeseeks/request"
 	"github.com/sirupsen/logrus"
 )
 
 var tokensBucketKey = []byte("tokens")
 
+// hashTokensMigration replaces the plaintext tokens with their hashes
+const hashTokensMigration = "tokens-hashed"
+
+// allowArgsMigration allows the tokens that existed before arguments required
+// permission to keep appending them
+const allowArgsMigration = "tokens-allow-args"
+
+// PrefixLength is how many characters of a token are stored in plaintext to
+// identify it, which is the first group of the UUID
+const PrefixLength = 8
+
 // ErrTokenNotFound is returned when a token can't be found given an ID
 var ErrTokenNotFound = fmt.Errorf("no token found")
 
+// Errors returned when a token can't be used
+var (
+	ErrTokenExpired     = fmt.Errorf("token has expired")
+	ErrTokenExhausted   = fmt.Errorf("token has reached its max uses")
+	ErrSourceNotAllowed = fmt.Errorf("token can't be used from this address")
+	// ErrSignatureRequired is returned when a token that has a signing
+	// secret is used without signing the request
+	ErrSignatureRequired = fmt.Errorf("token requires signed requests")
+	// ErrTokenNotSigned is returned when a request is signed for a token that
+	// has no signing secret
+	ErrTokenNotSigned = fmt.Errorf("token has no signing secret")
+	// ErrArgsNotAllowed is returned when arguments are appended to the text
+	// of a token that doesn't allow it
+	ErrArgsNotAllowed = fmt.Errorf("token doesn't allow appending arguments")
+)
+
+// DefaultSweepInterval is how often the tokens that can't be used anymore are
+// deleted
+const DefaultSweepInterval = time.Hour
+
 // NewTokenRequest is used to create a new token
+//
+// A zero ExpiresOn or MaxUses means the token doesn't expire or has unlimited
+// uses, and an empty AllowedCIDRs allows using it from any address. Requests
+// can only append arguments to the text when AllowArgs is set, and only set
+// the environment variables named in AllowedEnv.
+//
+// ReplyMode is how the replies to the requests are sent by default, which is
+// to the channel when empty, and CallbackURL is where the results are posted
+// when replying to the callback.
 type NewTokenRequest struct {
-	UserLink    string
-	ChannelLink string
-	Text        string
+	UserLink     string
+	ChannelLink  string
+	Text         string
+	Description  string
+	ExpiresOn    time.Time
+	MaxUses      int
+	AllowedCIDRs []string
+	AllowArgs    bool
+	AllowedEnv   []string
+	ReplyMode    string
+	CallbackURL  string
 }
 
-// Token is a persisted token
+// Token is a persisted token, which is identified by the prefix of the secret
+// token as only its hash is stored
 type Token struct {
-	TokenID     string    `json:"token"`
-	UserLink    string    `json:"userLink"`
-	ChannelLink string    `json:"channelLink"`
-	Text        string    `json:"text"`
-	CreatedOn   time.Time `json:"created_on"`
+	Prefix       string    `json:"prefix"`
+	UserLink     string    `json:"userLink"`
+	ChannelLink  string    `json:"channelLink"`
+	Text         string    `json:"text"`
+	Description  string    `json:"description,omitempty"`
+	CreatedOn    time.Time `json:"created_on"`
+	ExpiresOn    time.Time `json:"expires_on,omitempty"`
+	MaxUses      int       `json:"max_uses,omitempty"`
+	Uses         int       `json:"uses"`
+	AllowedCIDRs []string  `json:"allowed_cidrs,omitempty"`
+	Signed       bool      `json:"signed,omitempty"`
+	AllowArgs    bool      `json:"allow_args,omitempty"`
+	AllowedEnv   []string  `json:"allowed_env,omitempty"`
+	ReplyMode    string    `json:"reply_mode,omitempty"`
+	CallbackURL  string    `json:"callback_url,omitempty"`
+}
+
+// storedToken is the token as it is persisted, keyed by its prefix
+//
+// The signing secret is kept as is because it's needed to verify the
+// signatures.
+type storedToken struct {
+	Token
+	Salt   string `json:"salt"`
+	Hash   string `json:"hash"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// verify checks in constant time whether the secret token matches the hash
+func (s storedToken) verify(token string) bool {
+	hash, err := hashToken(s.Salt, token)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(s.Hash)) == 1
+}
+
+func hashToken(salt, token string) (string, error) {
+	s, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid token salt: %s", err)
+	}
+	h := sha256.New()
+	h.Write(s)
+	h.Write([]byte(token))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newStoredToken salts and hashes the secret token
+func newStoredToken(t Token, token string) (storedToken, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return storedToken{}, fmt.Errorf("could not create salt for token: %s", err)
+	}
+	s := storedToken{Token: t, Salt: hex.EncodeToString(salt)}
+	s.Prefix = prefixOf(token)
+
+	hash, err := hashToken(s.Salt, token)
+	if err != nil {
+		return storedToken{}, err
+	}
+	s.Hash = hash
+	return s, nil
+}
+
+// prefixOf returns the part of the token that identifies it
+func prefixOf(token string) string {
+	if len(token) < PrefixLength {
+		return token
+	}
+	return token[:PrefixLength]
+}
+
+func put(bucket *bolt.Bucket, s storedToken) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %s", err)
+	}
+	return bucket.Put([]byte(s.Prefix), payload)
+}
+
+// lookup returns the stored token that matches the secret token
+func lookup(bucket *bolt.Bucket, token string) (storedToken, error) {
+	s := storedToken{}
+	if bucket == nil {
+		return s, ErrTokenNotFound
+	}
+	payload := bucket.Get([]byte(prefixOf(token)))
+	if payload == nil {
+		return s, ErrTokenNotFound
+	}
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, err
+	}
+	if !s.verify(token) {
+		return s, ErrTokenNotFound
+	}
+	return s, nil
+}
+
+// IsExpired returns whether the token expired by the passed time
+func (t Token) IsExpired(now time.Time) bool {
+	return !t.ExpiresOn.IsZero() && !now.Before(t.ExpiresOn)
+}
+
+// IsExhausted returns whether the token has been used as many times as allowed
+func (t Token) IsExhausted() bool {
+	return t.MaxUses > 0 && t.Uses >= t.MaxUses
+}
+
+// allows returns whether the token can be used from the IP address
+func (t Token) allows(ip string) bool {
+	if len(t.AllowedCIDRs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range t.AllowedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsEnv returns whether requests using the token can set the environment
+// variable
+func (t Token) AllowsEnv(name string) bool {
+	for _, allowed := range t.AllowedEnv {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r NewTokenRequest) validate() error {
+	if r.MaxUses < 0 {
+		return fmt.Errorf("invalid max uses %d: it can't be negative", r.MaxUses)
+	}
+	if r.Text == "" && r.AllowArgs {
+		return fmt.Errorf("user tokens can't allow arguments as they have no command")
+	}
+	for _, cidr := range r.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %s: %s", cidr, err)
+		}
+	}
+	for _, name := range r.AllowedEnv {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	if err := request.ValidateReplyMode(r.ReplyMode); err != nil {
+		return err
+	}
+	if r.CallbackURL != "" {
+		u, err := url.Parse(r.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid callback URL %s: it should be an http or https URL", r.CallbackURL)
+		}
+	} else if r.ReplyMode == request.ReplyToCallback {
+		return fmt.Errorf("replying to the callback requires a callback URL")
+	}
+	return nil
 }
 
 // createUUID has been _honored_ from hashicorp UUID
@@ -46,65 +265,321 @@ func createUUID() (string, error) {
 		buf[10:16]), nil
 }
 
-// Create gets a new token request and creates a token persistence record. It returns the created token.
+// Create gets a new token request and creates a token persistence record. It
+// returns the created token, which can't be recovered later as only its prefix
+// and a salted hash are stored.
 func Create(r NewTokenRequest) (string, error) {
-	token, err := createUUID()
+	return create(r, "")
+}
+
+// CreateSigned creates a token that can only be used with signed requests, it
+// returns the token and the secret used to sign the requests
+func CreateSigned(r NewTokenRequest) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("could not create signing secret: %s", err)
+	}
+	token, err := create(r, hex.EncodeToString(secret))
 	if err != nil {
-		return "", fmt.Errorf("could not create UUID for token: %s", err)
+		return "", "", err
 	}
+	return token, hex.EncodeToString(secret), nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+func create(r NewTokenRequest, secret string) (string, error) {
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+
+	var token string
+	err := db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(tokensBucketKey)
 		if err != nil {
 			return err
 		}
 
+		// Prefixes are random, so it's unlikely but possible that one is taken
+		for token == "" || bucket.Get([]byte(prefixOf(token))) != nil {
+			if token, err = createUUID(); err != nil {
+				return fmt.Errorf("could not create UUID for token: %s", err)
+			}
+		}
+
 		t := Token{
-			TokenID:     token,
-			UserLink:    r.UserLink,
-			ChannelLink: r.ChannelLink,
-			Text:        r.Text,
-			CreatedOn:   time.Now(),
+			UserLink:     r.UserLink,
+			ChannelLink:  r.ChannelLink,
+			Text:         r.Text,
+			Description:  r.Description,
+			CreatedOn:    time.Now(),
+			ExpiresOn:    r.ExpiresOn,
+			MaxUses:      r.MaxUses,
+			AllowedCIDRs: r.AllowedCIDRs,
+			Signed:       secret != "",
+			AllowArgs:    r.AllowArgs,
+			AllowedEnv:   r.AllowedEnv,
+			ReplyMode:    r.ReplyMode,
+			CallbackURL:  r.CallbackURL,
 		}
-		tb, err := json.Marshal(t)
+		s, err := newStoredToken(t, token)
 		if err != nil {
-			return fmt.Errorf("could not marshal token: %s", err)
+			return err
 		}
+		s.Secret = secret
 
-		logrus.Debugf("Creating token %#v", t)
-		return bucket.Put([]byte(token), tb)
+		logrus.Debugf("Creating token %#v", s.Token)
+		return put(bucket, s)
 	})
-	return token, err
+	if err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
-// Get returns the token given an ID, it may return ErrTokenNotFound when there is no such token
-func Get(tokenID string) (Token, error) {
-	var token Token
+// Get returns the token given the secret token, it may return ErrTokenNotFound
+// when there is no such token
+func Get(token string) (Token, error) {
+	var s storedToken
 	err := db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(tokensBucketKey)
-		if bucket == nil {
-			return ErrTokenNotFound
+		var err error
+		s, err = lookup(tx.Bucket(tokensBucketKey), token)
+		return err
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	logrus.Debugf("Returning token %#v with prefix %s", s.Token, s.Prefix)
+	return s.Token, nil
+}
+
+// Use checks that the token can be used from the IP address and counts the
+// use, it returns the token as it was before being used
+//
+// The accept function, when it's not nil, is called with the token once it's
+// known to be usable, and the use is not counted when it returns an error, so
+// the requests that are rejected don't use up the token.
+//
+// It may return ErrTokenNotFound, ErrTokenExpired, ErrTokenExhausted,
+// ErrSourceNotAllowed or ErrSignatureRequired when the token can't be used.
+func Use(tokenID, ip string, accept func(Token) error) (Token, error) {
+	return use(ip, accept, func(bucket *bolt.Bucket) (storedToken, error) {
+		s, err := lookup(bucket, tokenID)
+		if err == nil && s.Secret != "" {
+			return s, ErrSignatureRequired
 		}
+		return s, err
+	})
+}
 
-		payload := bucket.Get([]byte(tokenID))
+// UseSigned is the same as Use for signed requests, which identify the token
+// by its prefix. The verify function is called with the signing secret of the
+// token and the token is not used when it returns an error.
+//
+// It may also return ErrTokenNotSigned when the token has no signing secret.
+func UseSigned(prefix, ip string, verify func(secret string) error, accept func(Token) error) (Token, error) {
+	return use(ip, accept, func(bucket *bolt.Bucket) (storedToken, error) {
+		s := storedToken{}
+		if bucket == nil || len(prefix) != PrefixLength {
+			return s, ErrTokenNotFound
+		}
+		payload := bucket.Get([]byte(prefix))
 		if payload == nil {
-			return ErrTokenNotFound
+			return s, ErrTokenNotFound
+		}
+		if err := json.Unmarshal(payload, &s); err != nil {
+			return s, err
+		}
+		if s.Secret == "" {
+			return s, ErrTokenNotSigned
+		}
+		return s, verify(s.Secret)
+	})
+}
+
+func use(ip string, accept func(Token) error, find func(*bolt.Bucket) (storedToken, error)) (Token, error) {
+	var token Token
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucketKey)
+		s, err := find(bucket)
+		if err != nil {
+			return err
+		}
+		token = s.Token
+
+		// The source is checked first so clients outside of the allowed
+		// networks can't learn whether the token expired or was exhausted
+		switch {
+		case !token.allows(ip):
+			return ErrSourceNotAllowed
+		case token.IsExpired(time.Now()):
+			return ErrTokenExpired
+		case token.IsExhausted():
+			return ErrTokenExhausted
+		}
+		if accept != nil {
+			if err := accept(token); err != nil {
+				return err
+			}
 		}
 
-		return json.Unmarshal(payload, &token)
+		s.Uses++
+		return put(bucket, s)
 	})
-	logrus.Debugf("Returning token %#v with ID %s", token, tokenID)
 	return token, err
 }
 
-// Revoke destroys a token by ID
-func Revoke(tokenID string) error {
+// Sweep deletes the tokens that can't be used anymore because they expired or
+// reached their max uses, it returns how many were deleted
+func Sweep() (int, error) {
+	now := time.Now()
+	swept := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucketKey)
+		if bucket == nil {
+			return nil
+		}
+
+		ids := make([][]byte, 0)
+		err := bucket.ForEach(func(id, payload []byte) error {
+			t := Token{}
+			if err := json.Unmarshal(payload, &t); err != nil {
+				return err
+			}
+			if t.IsExpired(now) || t.IsExhausted() {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := bucket.Delete(id); err != nil {
+				return err
+			}
+		}
+		swept = len(ids)
+		return nil
+	})
+	return swept, err
+}
+
+// SweepEvery sweeps the tokens periodically until the stop channel is closed
+func SweepEvery(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			swept, err := Sweep()
+			if err != nil {
+				logrus.Errorf("Could not sweep tokens: %s", err)
+				continue
+			}
+			if swept > 0 {
+				logrus.Infof("Swept %d tokens that can't be used anymore", swept)
+			}
+		}
+	}
+}
+
+// Revoke destroys a token by prefix, the whole token can be passed too
+func Revoke(prefix string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(tokensBucketKey)
 		if bucket == nil {
 			return ErrTokenNotFound
 		}
-		return bucket.Delete([]byte(tokenID))
+		key := []byte(prefixOf(prefix))
+		if bucket.Get(key) == nil {
+			return ErrTokenNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// MigrateHashes replaces the tokens stored in plaintext with their prefix and
+// a salted hash, the tokens keep working as they were
+func MigrateHashes() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return db.Migrate(tx, hashTokensMigration, func() error {
+			bucket := tx.Bucket(tokensBucketKey)
+			if bucket == nil {
+				return nil
+			}
+
+			// plaintext tokens were keyed by the token itself, stored in the
+			// field that is now the prefix
+			plaintext := make(map[string]Token)
+			err := bucket.ForEach(func(key, payload []byte) error {
+				s := storedToken{}
+				if err := json.Unmarshal(payload, &s); err != nil {
+					return fmt.Errorf("could not unmarshal token: %s", err)
+				}
+				if s.Hash == "" {
+					plaintext[string(key)] = s.Token
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for token, t := range plaintext {
+				if err := bucket.Delete([]byte(token)); err != nil {
+					return err
+				}
+				if bucket.Get([]byte(prefixOf(token))) != nil {
+					return fmt.Errorf("token prefix %s is already taken", prefixOf(token))
+				}
+				s, err := newStoredToken(t, token)
+				if err != nil {
+					return err
+				}
+				if err := put(bucket, s); err != nil {
+					return err
+				}
+			}
+			logrus.Infof("Migrated %d tokens to hashes", len(plaintext))
+			return nil
+		})
+	})
+}
+
+// MigrateAllowArgs allows the tokens created before appending arguments
+// required permission to keep appending them
+func MigrateAllowArgs() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return db.Migrate(tx, allowArgsMigration, func() error {
+			bucket := tx.Bucket(tokensBucketKey)
+			if bucket == nil {
+				return nil
+			}
+
+			stored := make([]storedToken, 0)
+			err := bucket.ForEach(func(_, payload []byte) error {
+				s := storedToken{}
+				if err := json.Unmarshal(payload, &s); err != nil {
+					return fmt.Errorf("could not unmarshal token: %s", err)
+				}
+				stored = append(stored, s)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, s := range stored {
+				s.AllowArgs = true
+				if err := put(bucket, s); err != nil {
+					return err
+				}
+			}
+			logrus.Infof("Allowed %d existing tokens to append arguments", len(stored))
+			return nil
+		})
 	})
 }
 
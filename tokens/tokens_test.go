@@ -1,8 +1,13 @@
 package tokens_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
+	"github.com/gomeeseeks/meeseeks-box/db"
 	stubs "github.com/gomeeseeks/meeseeks-box/testingstubs"
 	"github.com/gomeeseeks/meeseeks-box/tokens"
 )
@@ -22,7 +27,7 @@ func Test_TokenLifecycle(t *testing.T) {
 		tk, err := tokens.Get(id)
 		stubs.Must(t, "could not get token back", err)
 
-		stubs.AssertEquals(t, id, tk.TokenID)
+		stubs.AssertEquals(t, id[:tokens.PrefixLength], tk.Prefix)
 		stubs.AssertEquals(t, "myuser", tk.UserLink)
 		stubs.AssertEquals(t, "mychannel", tk.ChannelLink)
 		stubs.AssertEquals(t, "echo hello", tk.Text)
@@ -93,3 +98,196 @@ func Test_TokenListing(t *testing.T) {
 		}
 	})
 }
+
+func Test_TokenRestrictions(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		limited, err := tokens.Create(tokens.NewTokenRequest{
+			Text:         "echo limited",
+			MaxUses:      2,
+			AllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.0/24"},
+		})
+		stubs.Must(t, "could not create token", err)
+
+		_, err = tokens.Use(limited, "172.16.0.1", nil)
+		stubs.AssertEquals(t, tokens.ErrSourceNotAllowed, err)
+
+		refused := errors.New("refused")
+		_, err = tokens.Use(limited, "10.1.2.3", func(tokens.Token) error { return refused })
+		stubs.AssertEquals(t, refused, err)
+
+		for _, ip := range []string{"10.1.2.3", "192.168.1.20"} {
+			_, err = tokens.Use(limited, ip, nil)
+			stubs.Must(t, "could not use token", err)
+		}
+		_, err = tokens.Use(limited, "10.1.2.3", nil)
+		stubs.AssertEquals(t, tokens.ErrTokenExhausted, err)
+		_, err = tokens.Use(limited, "172.16.0.1", nil)
+		stubs.AssertEquals(t, tokens.ErrSourceNotAllowed, err)
+
+		tk, err := tokens.Get(limited)
+		stubs.Must(t, "could not get token back", err)
+		stubs.AssertEquals(t, 2, tk.Uses)
+
+		expired, err := tokens.Create(tokens.NewTokenRequest{
+			Text:      "echo expired",
+			ExpiresOn: time.Now().Add(-time.Minute),
+		})
+		stubs.Must(t, "could not create token", err)
+
+		_, err = tokens.Use(expired, "10.1.2.3", nil)
+		stubs.AssertEquals(t, tokens.ErrTokenExpired, err)
+
+		valid, err := tokens.Create(tokens.NewTokenRequest{
+			Text:      "echo valid",
+			ExpiresOn: time.Now().Add(time.Hour),
+		})
+		stubs.Must(t, "could not create token", err)
+
+		_, err = tokens.Use("unknown", "10.1.2.3", nil)
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+
+		swept, err := tokens.Sweep()
+		stubs.Must(t, "could not sweep tokens", err)
+		stubs.AssertEquals(t, 2, swept)
+
+		_, err = tokens.Get(expired)
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+		_, err = tokens.Get(valid)
+		stubs.Must(t, "could not get valid token back", err)
+	}))
+}
+
+func Test_InvalidTokenRequests(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		_, err := tokens.Create(tokens.NewTokenRequest{Text: "echo", MaxUses: -1})
+		stubs.AssertEquals(t, "invalid max uses -1: it can't be negative", err.Error())
+
+		_, err = tokens.Create(tokens.NewTokenRequest{Text: "echo", AllowedCIDRs: []string{"10.0.0.0"}})
+		stubs.AssertEquals(t, "invalid CIDR 10.0.0.0: invalid CIDR address: 10.0.0.0", err.Error())
+
+		_, err = tokens.Create(tokens.NewTokenRequest{UserLink: "someoneLink", AllowArgs: true})
+		stubs.AssertEquals(t, "user tokens can't allow arguments as they have no command", err.Error())
+	}))
+}
+
+func Test_TokensAreHashed(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		id, err := tokens.Create(tokens.NewTokenRequest{Text: "echo hashed"})
+		stubs.Must(t, "could not create token", err)
+
+		stubs.Must(t, "failed to read the db", db.View(func(tx *bolt.Tx) error {
+			stubs.AssertEquals(t, []byte(nil), tx.Bucket([]byte("tokens")).Get([]byte(id)))
+			payload := tx.Bucket([]byte("tokens")).Get([]byte(id[:tokens.PrefixLength]))
+			if payload == nil || strings.Contains(string(payload), id) {
+				t.Fatalf("token is not stored hashed: %s", payload)
+			}
+			return nil
+		}))
+
+		_, err = tokens.Get(id[:tokens.PrefixLength])
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+		_, err = tokens.Get(id[:tokens.PrefixLength] + "-0000-0000-0000-000000000000")
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+		_, err = tokens.Use(id[:tokens.PrefixLength], "", nil)
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+
+		stubs.Must(t, "could not revoke token", tokens.Revoke(id[:tokens.PrefixLength]))
+		_, err = tokens.Get(id)
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, err)
+		stubs.AssertEquals(t, tokens.ErrTokenNotFound, tokens.Revoke(id[:tokens.PrefixLength]))
+	}))
+}
+
+func Test_PlaintextTokensMigration(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		id := "0123abcd-0000-1111-2222-333344445555"
+		stubs.Must(t, "failed to store a plaintext token", db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("tokens"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(id), []byte(`{"token":"`+id+`","userLink":"myuser",`+
+				`"channelLink":"mychannel","text":"echo legacy","created_on":"2018-01-01T00:00:00Z"}`))
+		}))
+
+		stubs.Must(t, "failed to migrate tokens", tokens.MigrateHashes())
+		stubs.Must(t, "failed to migrate tokens twice", tokens.MigrateHashes())
+
+		tk, err := tokens.Use(id, "10.0.0.1", nil)
+		stubs.Must(t, "could not use migrated token", err)
+		stubs.AssertEquals(t, "0123abcd", tk.Prefix)
+		stubs.AssertEquals(t, "echo legacy", tk.Text)
+		stubs.AssertEquals(t, "myuser", tk.UserLink)
+
+		stubs.Must(t, "failed to read the db", db.View(func(tx *bolt.Tx) error {
+			stubs.AssertEquals(t, []byte(nil), tx.Bucket([]byte("tokens")).Get([]byte(id)))
+			return nil
+		}))
+	}))
+}
+
+func Test_TokenArgsAndEnvPermissions(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		_, err := tokens.Create(tokens.NewTokenRequest{Text: "echo", AllowedEnv: []string{"A=B"}})
+		stubs.AssertEquals(t, `invalid environment variable name "A=B"`, err.Error())
+
+		existing, err := tokens.Create(tokens.NewTokenRequest{Text: "echo existing"})
+		stubs.Must(t, "could not create token", err)
+
+		stubs.Must(t, "failed to migrate tokens", tokens.MigrateAllowArgs())
+		stubs.Must(t, "failed to migrate tokens twice", tokens.MigrateAllowArgs())
+
+		created, err := tokens.Create(tokens.NewTokenRequest{Text: "echo new", AllowedEnv: []string{"VERSION"}})
+		stubs.Must(t, "could not create token", err)
+
+		tk, err := tokens.Get(existing)
+		stubs.Must(t, "could not get token back", err)
+		stubs.AssertEquals(t, true, tk.AllowArgs)
+
+		tk, err = tokens.Get(created)
+		stubs.Must(t, "could not get token back", err)
+		stubs.AssertEquals(t, false, tk.AllowArgs)
+		stubs.AssertEquals(t, true, tk.AllowsEnv("VERSION"))
+		stubs.AssertEquals(t, false, tk.AllowsEnv("PATH"))
+	}))
+}
+
+func Test_TokenReplyMode(t *testing.T) {
+	stubs.Must(t, "failed to run tests", stubs.WithTmpDB(func(_ string) {
+		for _, tc := range []struct {
+			name     string
+			req      tokens.NewTokenRequest
+			expected string
+		}{
+			{
+				name:     "unknown mode",
+				req:      tokens.NewTokenRequest{Text: "echo", ReplyMode: "email"},
+				expected: `invalid reply mode "email", it should be one of channel, im, callback or silent`,
+			},
+			{
+				name:     "callback without URL",
+				req:      tokens.NewTokenRequest{Text: "echo", ReplyMode: "callback"},
+				expected: "replying to the callback requires a callback URL",
+			},
+			{
+				name:     "callback URL without scheme",
+				req:      tokens.NewTokenRequest{Text: "echo", ReplyMode: "callback", CallbackURL: "ci.example.com/done"},
+				expected: "invalid callback URL ci.example.com/done: it should be an http or https URL",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := tokens.Create(tc.req)
+				stubs.AssertEquals(t, tc.expected, err.Error())
+			})
+		}
+
+		created, err := tokens.Create(tokens.NewTokenRequest{Text: "echo", ReplyMode: "callback",
+			CallbackURL: "https://ci.example.com/done"})
+		stubs.Must(t, "could not create token", err)
+
+		tk, err := tokens.Get(created)
+		stubs.Must(t, "could not get token back", err)
+		stubs.AssertEquals(t, "callback", tk.ReplyMode)
+		stubs.AssertEquals(t, "https://ci.example.com/done", tk.CallbackURL)
+	}))
+}